@@ -1,5 +1,7 @@
 package api
 
+import "context"
+
 type DubboRequest struct {
 	Request map[string]interface{}
 }
@@ -15,3 +17,9 @@ type DubboResponse struct {
 func (u *DubboResponse) JavaClassName() string {
 	return "org.apache.dubbo.DubboResponse"
 }
+
+// DubboDemoProvider is the consumer stub of org.apache.dubbo.DubboDemoProvider.Test.
+// config.SetConsumerService fills SayHello in with the remote call.
+type DubboDemoProvider struct {
+	SayHello func(ctx context.Context, req *DubboRequest) (resp *DubboResponse, err error)
+}
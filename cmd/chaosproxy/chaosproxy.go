@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	hessian "github.com/apache/dubbo-go-hessian2"
+	"github.com/dustin/go-humanize"
+
+	"dubbo-demo/api"
+	"dubbo-demo/internal/chaos"
+)
+
+var (
+	listen = flag.String("listen", "127.0.0.1:20001", "address consumers connect to")
+	target = flag.String("target", "127.0.0.1:20000", "provider address")
+	admin  = flag.String("admin", "", "admin listen address, e.g. 127.0.0.1:20002; empty to disable")
+	buffer = flag.String("buffer", "", "socket buffer size for both sides, e.g. 16KiB; empty for the OS default")
+	loop   = flag.Duration("loop", 0, "repeat the -at schedule with this period, 0 to run it once")
+	at     schedule
+)
+
+func init() {
+	flag.Var(&at, "at", "run a command at an offset from start, e.g. -at '10s pause up 5s', repeatable")
+}
+
+// step is one scheduled command.
+type step struct {
+	after time.Duration
+	text  string
+	cmd   *command
+}
+
+// schedule is the flag.Value behind -at.
+type schedule []step
+
+func (s *schedule) String() string {
+	var parts []string
+	for _, st := range *s {
+		parts = append(parts, st.after.String()+" "+st.text)
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (s *schedule) Set(v string) error {
+	off, text, ok := strings.Cut(strings.TrimSpace(v), " ")
+	if !ok {
+		return fmt.Errorf("want OFFSET COMMAND, got %q", v)
+	}
+	d, err := time.ParseDuration(off)
+	if err != nil {
+		return err
+	}
+	cmd, err := parseCommand(text)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, step{after: d, text: strings.TrimSpace(text), cmd: cmd})
+	return nil
+}
+
+// Usage: chaosproxy [-listen 127.0.0.1:20001] [-target 127.0.0.1:20000] [-admin ADDR] [-at 'OFFSET COMMAND']...
+func main() {
+	flag.Parse()
+	hessian.RegisterPOJO(&api.DubboRequest{})
+	hessian.RegisterPOJO(&api.DubboResponse{})
+
+	var buf int
+	if *buffer != "" {
+		n, err := humanize.ParseBytes(*buffer)
+		if err != nil {
+			log.Fatalf("-buffer: %v", err)
+		}
+		buf = int(n)
+	}
+	p := newProxy(*target, buf)
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("proxying %s -> %s\n", ln.Addr(), *target)
+	if *admin != "" {
+		serveAdmin(*admin, p)
+	}
+	if len(at) > 0 {
+		go p.runSchedule(at, *loop)
+	}
+	log.Fatal(p.serve(ln))
+}
+
+func (p *proxy) runSchedule(steps schedule, period time.Duration) {
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].after < steps[j].after })
+	for start := time.Now(); ; start = start.Add(period) {
+		for _, st := range steps {
+			time.Sleep(time.Until(start.Add(st.after)))
+			log.Printf("schedule: %s\n", st.text)
+			p.do(st.cmd, 0)
+		}
+		if period <= 0 {
+			return
+		}
+		time.Sleep(time.Until(start.Add(period)))
+	}
+}
+
+// do runs a command against one connection, or all of them and every
+// later one when conn is 0. It returns what it touched.
+func (p *proxy) do(c *command, conn uint64) string {
+	p.mu.Lock()
+	var conns []*proxyConn
+	for id, pc := range p.conns {
+		if conn == 0 || id == conn {
+			conns = append(conns, pc)
+		}
+	}
+	if conn == 0 {
+		switch c.verb {
+		case "clear":
+			p.rules = nil
+			for _, d := range p.defaults {
+				d.Apply(chaos.Settings{})
+			}
+		case "on":
+			p.rules = append(p.rules, c.rule)
+		default:
+			c.applyTo(p.defaults)
+		}
+	}
+	p.mu.Unlock()
+
+	if c.verb == "on" {
+		return "rule added: " + c.rule.String()
+	}
+	for _, pc := range conns {
+		switch c.verb {
+		case "reset":
+			pc.reset()
+		case "halfopen":
+			pc.halfOpenNow()
+		case "clear":
+			for _, d := range pc.dirs {
+				d.Apply(chaos.Settings{})
+			}
+		default:
+			c.applyTo(pc.dirs)
+		}
+	}
+	return fmt.Sprintf("%s applied to %d connections", c.verb, len(conns))
+}
+
+// faults is the readable form of chaos.Settings.
+type faults struct {
+	Latency string `json:"latency,omitempty"`
+	Rate    string `json:"bandwidth,omitempty"`
+	Paused  string `json:"paused,omitempty"` // time left, or "until resume"
+}
+
+func faultsOf(s chaos.Settings) faults {
+	var f faults
+	if s.Latency > 0 {
+		f.Latency = s.Latency.String()
+	}
+	if s.Rate > 0 {
+		f.Rate = humanize.IBytes(uint64(s.Rate)) + "/s"
+	}
+	if left := time.Until(s.PausedUntil); left > 0 {
+		f.Paused = left.Round(time.Millisecond).String()
+		if left > 24*time.Hour {
+			f.Paused = "until resume"
+		}
+	}
+	return f
+}
+
+type dirStatus struct {
+	Bytes  int64  `json:"bytes"`
+	Frames int64  `json:"frames"`
+	Faults faults `json:"faults"`
+}
+
+type connStatus struct {
+	ID     uint64    `json:"id"`
+	Client string    `json:"client"`
+	Server string    `json:"server"`
+	Age    string    `json:"age"`
+	State  string    `json:"state"`
+	Up     dirStatus `json:"up"`
+	Down   dirStatus `json:"down"`
+}
+
+func (p *proxy) status() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := []connStatus{}
+	for _, c := range p.conns {
+		st := connStatus{
+			ID:     c.id,
+			Client: c.client.RemoteAddr().String(),
+			Server: c.server.RemoteAddr().String(),
+			Age:    time.Since(c.started).Round(time.Millisecond).String(),
+			State:  "open",
+		}
+		if s, ok := c.state.Load().(string); ok {
+			st.State = s
+		}
+		dir := func(i int) dirStatus {
+			return dirStatus{Bytes: c.bytes[i].Load(), Frames: c.frames[i].Load(), Faults: faultsOf(c.dirs[i].Settings())}
+		}
+		st.Up, st.Down = dir(up), dir(down)
+		conns = append(conns, st)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	rules := []rule{}
+	for _, r := range p.rules {
+		rules = append(rules, *r)
+	}
+	return map[string]interface{}{
+		"listen":   *listen,
+		"target":   p.target,
+		"defaults": map[string]faults{dirNames[up]: faultsOf(p.defaults[up].Settings()), dirNames[down]: faultsOf(p.defaults[down].Settings())},
+		"rules":    rules,
+		"conns":    conns,
+	}
+}
+
+// serveAdmin starts the admin listener on addr:
+//
+//	GET  /                     faults, rules and connections as JSON
+//	POST /cmd[?conn=ID] BODY   run the command in BODY, e.g. "pause up 5s"
+func serveAdmin(addr string, p *proxy) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, p.status())
+	})
+	mux.HandleFunc("/cmd", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a command", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cmd, err := parseCommand(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var conn uint64
+		if s := r.URL.Query().Get("conn"); s != "" {
+			if conn, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, "conn: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if cmd.verb == "on" {
+				http.Error(w, "rules apply to every connection", http.StatusBadRequest)
+				return
+			}
+		}
+		log.Printf("admin: %s\n", strings.TrimSpace(string(body)))
+		writeJSON(w, map[string]string{"result": p.do(cmd, conn)})
+	})
+
+	log.Printf("admin listening on %s\n", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("admin listener stopped: %v\n", err)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Printf("admin write error: %v\n", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"dubbo-demo/internal/chaos"
+)
+
+// Commands, as given to -at and to the admin listener:
+//
+//	latency up|down|both DURATION    delay bytes by DURATION, 0 to stop
+//	bandwidth up|down|both RATE      limit to RATE bytes/s (e.g. 8KiB), 0 to stop
+//	pause up|down|both [DURATION]    stop reading, until resume without DURATION
+//	resume [up|down|both]
+//	reset                            close with RST
+//	halfopen                         drop the provider side, keep the consumer open
+//	on id=N|method=NAME [times=K] ACTION
+//	clear                            lift all faults and rules
+//
+// up is consumer to provider, down is provider to consumer. An on rule acts
+// when a matching request passes the proxy. Its ACTION is one of drop,
+// drop-response, delay DURATION, pause up|down|both [DURATION], reset or
+// halfopen.
+type command struct {
+	verb string
+	dirs []int
+	dur  time.Duration
+	rate int64
+	rule *rule
+}
+
+// rule is a dubbo-aware trigger.
+type rule struct {
+	ID     int64  `json:"id,omitempty"` // -1 for any
+	Method string `json:"method,omitempty"`
+	Times  int    `json:"times,omitempty"` // 0 for unlimited
+	Action string `json:"action"`
+	Hits   int    `json:"hits"`
+
+	act *command
+}
+
+func (r *rule) String() string {
+	var b strings.Builder
+	b.WriteString("on")
+	if r.ID >= 0 {
+		fmt.Fprintf(&b, " id=%d", r.ID)
+	}
+	if r.Method != "" {
+		b.WriteString(" method=" + r.Method)
+	}
+	if r.Times > 0 {
+		fmt.Fprintf(&b, " times=%d", r.Times)
+	}
+	return b.String() + " " + r.Action
+}
+
+func (r *rule) matches(id int64, method string) bool {
+	return (r.ID < 0 || r.ID == id) && (r.Method == "" || r.Method == method)
+}
+
+func parseCommand(s string) (*command, error) {
+	f := strings.Fields(s)
+	if len(f) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	c := &command{verb: f[0]}
+	args := f[1:]
+	switch c.verb {
+	case "latency", "bandwidth", "pause":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s needs a direction", c.verb)
+		}
+		dirs, err := parseDirs(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.dirs, args = dirs, args[1:]
+		switch {
+		case c.verb == "bandwidth" && len(args) == 1:
+			rate, err := humanize.ParseBytes(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("bandwidth %q: %w", args[0], err)
+			}
+			c.rate, args = int64(rate), nil
+		case c.verb == "bandwidth":
+			return nil, fmt.Errorf("bandwidth needs a rate")
+		case len(args) == 1:
+			if c.dur, err = time.ParseDuration(args[0]); err != nil {
+				return nil, err
+			}
+			args = nil
+		case c.verb == "latency":
+			return nil, fmt.Errorf("latency needs a duration")
+		}
+	case "resume":
+		c.dirs = []int{up, down}
+		if len(args) > 0 {
+			dirs, err := parseDirs(args[0])
+			if err != nil {
+				return nil, err
+			}
+			c.dirs, args = dirs, args[1:]
+		}
+	case "reset", "halfopen", "clear":
+	case "on":
+		r, err := parseRule(args)
+		if err != nil {
+			return nil, err
+		}
+		c.rule, args = r, nil
+	default:
+		return nil, fmt.Errorf("unknown command %q", c.verb)
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%s: unexpected %q", c.verb, strings.Join(args, " "))
+	}
+	return c, nil
+}
+
+func parseDirs(s string) ([]int, error) {
+	switch s {
+	case "up":
+		return []int{up}, nil
+	case "down":
+		return []int{down}, nil
+	case "both":
+		return []int{up, down}, nil
+	}
+	return nil, fmt.Errorf("direction must be up, down or both, not %q", s)
+}
+
+func parseRule(args []string) (*rule, error) {
+	r := &rule{ID: -1}
+	for len(args) > 0 {
+		k, v, ok := strings.Cut(args[0], "=")
+		if !ok {
+			break
+		}
+		var err error
+		switch k {
+		case "id":
+			r.ID, err = strconv.ParseInt(v, 10, 64)
+		case "method":
+			r.Method = v
+		case "times":
+			r.Times, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown match %q", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+		args = args[1:]
+	}
+	if r.ID < 0 && r.Method == "" {
+		return nil, fmt.Errorf("on needs id=N or method=NAME")
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("on needs an action")
+	}
+	r.Action = strings.Join(args, " ")
+	switch args[0] {
+	case "drop", "drop-response":
+		if len(args) > 1 {
+			return nil, fmt.Errorf("%s takes no arguments", args[0])
+		}
+		r.act = &command{verb: args[0]}
+	case "delay":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("delay needs a duration")
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return nil, err
+		}
+		r.act = &command{verb: "delay", dur: d}
+	case "pause", "reset", "halfopen":
+		c, err := parseCommand(r.Action)
+		if err != nil {
+			return nil, err
+		}
+		r.act = c
+	default:
+		return nil, fmt.Errorf("unknown action %q", args[0])
+	}
+	return r, nil
+}
+
+// applyTo changes the fault settings of one connection's directions.
+func (c *command) applyTo(dirs [2]*chaos.Direction) {
+	for _, i := range c.dirs {
+		d := dirs[i]
+		switch c.verb {
+		case "latency":
+			d.SetLatency(c.dur)
+		case "bandwidth":
+			d.SetRate(c.rate)
+		case "pause":
+			d.Pause(c.dur)
+		case "resume":
+			d.Resume()
+		}
+	}
+}
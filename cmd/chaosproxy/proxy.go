@@ -0,0 +1,343 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dubbo-demo/internal/chaos"
+	"dubbo-demo/internal/dubboframe"
+)
+
+const (
+	up   = 0 // consumer to provider
+	down = 1 // provider to consumer
+
+	// maxFrame is the largest frame held for inspection; anything claiming
+	// more is taken as not dubbo and the connection is passed through raw.
+	maxFrame = 16 << 20
+)
+
+var dirNames = [2]string{"up", "down"}
+
+// proxy accepts consumer connections and forwards them to the provider.
+type proxy struct {
+	target string
+	buffer int
+
+	mu       sync.Mutex
+	defaults [2]*chaos.Direction // copied into every new connection
+	rules    []*rule
+	conns    map[uint64]*proxyConn
+	nextID   uint64
+}
+
+func newProxy(target string, buffer int) *proxy {
+	return &proxy{
+		target:   target,
+		buffer:   buffer,
+		defaults: [2]*chaos.Direction{chaos.NewDirection(), chaos.NewDirection()},
+		conns:    map[uint64]*proxyConn{},
+	}
+}
+
+func (p *proxy) serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(c.(*net.TCPConn))
+	}
+}
+
+func (p *proxy) handle(client *net.TCPConn) {
+	sc, err := net.DialTimeout("tcp", p.target, 5*time.Second)
+	if err != nil {
+		log.Printf("dial %s: %v\n", p.target, err)
+		client.SetLinger(0)
+		client.Close()
+		return
+	}
+	server := sc.(*net.TCPConn)
+	if p.buffer > 0 {
+		// small buffers make a paused direction back up into the sender
+		// after kilobytes rather than megabytes
+		for _, c := range []*net.TCPConn{client, server} {
+			c.SetReadBuffer(p.buffer)
+			c.SetWriteBuffer(p.buffer)
+		}
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	c := &proxyConn{
+		id:       p.nextID,
+		p:        p,
+		client:   client,
+		server:   server,
+		started:  time.Now(),
+		done:     make(chan struct{}),
+		dropResp: map[int64]bool{},
+	}
+	for i := range c.dirs {
+		c.dirs[i] = chaos.NewDirection()
+		c.dirs[i].Apply(p.defaults[i].Settings())
+	}
+	p.conns[c.id] = c
+	p.mu.Unlock()
+
+	log.Printf("conn %d: %s -> %s opened\n", c.id, client.RemoteAddr(), server.RemoteAddr())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); c.pipe(up, client, server) }()
+	go func() { defer wg.Done(); c.pipe(down, server, client) }()
+	wg.Wait()
+	c.close()
+
+	p.mu.Lock()
+	delete(p.conns, c.id)
+	p.mu.Unlock()
+	log.Printf("conn %d: closed after %v, up %d bytes, down %d bytes\n",
+		c.id, time.Since(c.started).Round(time.Millisecond), c.bytes[up].Load(), c.bytes[down].Load())
+}
+
+// match returns the rule a request triggers, counting the hit.
+func (p *proxy) match(id int64, method string) *rule {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, r := range p.rules {
+		if !r.matches(id, method) {
+			continue
+		}
+		r.Hits++
+		if r.Times > 0 && r.Hits >= r.Times {
+			p.rules = append(p.rules[:i:i], p.rules[i+1:]...)
+		}
+		return r
+	}
+	return nil
+}
+
+// proxyConn is one consumer connection and its provider side.
+type proxyConn struct {
+	id             uint64
+	p              *proxy
+	client, server *net.TCPConn
+	started        time.Time
+	dirs           [2]*chaos.Direction
+	bytes, frames  [2]atomic.Int64
+	halfOpen       atomic.Bool
+	state          atomic.Value // string, set once the connection is faulted
+
+	mu       sync.Mutex
+	dropResp map[int64]bool // request IDs whose response is swallowed
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// piece is a unit forwarded in one write: a whole frame or, once a stream
+// turns out not to be dubbo, whatever one read returned.
+type piece struct {
+	data []byte
+	at   time.Time // when it was read
+	hold time.Duration
+}
+
+// pipe copies src to dst in direction dir. A reader goroutine applies
+// pauses and rules; the writer applies latency and bandwidth, so a slow
+// writer backs up into the reader and from there into the sender's window.
+func (c *proxyConn) pipe(dir int, src, dst *net.TCPConn) {
+	d := c.dirs[dir]
+	queue := make(chan piece, 64)
+	go func() {
+		defer close(queue)
+		var fr framer
+		buf := make([]byte, 64<<10)
+		for {
+			if !d.Wait(c.done) {
+				return
+			}
+			n, err := src.Read(buf[:d.Chunk(len(buf))])
+			now := time.Now()
+			for _, f := range fr.feed(buf[:n]) {
+				pc, forward := c.inspect(dir, f)
+				if !forward {
+					continue
+				}
+				pc.at = now
+				select {
+				case queue <- pc:
+				case <-c.done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for pc := range queue {
+		if wait := time.Until(pc.at.Add(d.Settings().Latency + pc.hold)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-c.done:
+				return
+			}
+		}
+		time.Sleep(d.Pace(len(pc.data)))
+		if dir == up && c.halfOpen.Load() {
+			// the provider is gone; keep swallowing what the consumer sends
+			continue
+		}
+		if _, err := dst.Write(pc.data); err != nil {
+			if dir == down && c.halfOpen.Load() {
+				continue
+			}
+			c.close()
+			return
+		}
+		c.bytes[dir].Add(int64(len(pc.data)))
+	}
+	if !c.halfOpen.Load() {
+		// pass the FIN on; a half-open consumer side must not see one
+		dst.CloseWrite()
+	}
+}
+
+// inspect applies rules to a frame and reports whether to forward it.
+func (c *proxyConn) inspect(dir int, f frame) (piece, bool) {
+	pc := piece{data: f.data}
+	if f.header == nil {
+		return pc, true
+	}
+	c.frames[dir].Add(1)
+	h := f.header
+	if dir == down {
+		c.mu.Lock()
+		drop := c.dropResp[h.ID]
+		delete(c.dropResp, h.ID)
+		c.mu.Unlock()
+		if drop && !h.Request {
+			log.Printf("conn %d: dropped response to request %d\n", c.id, h.ID)
+			return pc, false
+		}
+		return pc, true
+	}
+	if !h.Request || h.Event {
+		return pc, true
+	}
+	method := ""
+	if fr, _, err := dubboframe.Decode(f.data); err == nil && fr.Request != nil {
+		method = fr.Request.Method
+	}
+	r := c.p.match(h.ID, method)
+	if r == nil {
+		return pc, true
+	}
+	log.Printf("conn %d: request %d %s matched %q\n", c.id, h.ID, method, r.String())
+	switch r.act.verb {
+	case "drop":
+		return pc, false
+	case "drop-response":
+		c.mu.Lock()
+		c.dropResp[h.ID] = true
+		c.mu.Unlock()
+	case "delay":
+		pc.hold = r.act.dur
+	case "pause":
+		// the matching request still goes through; what follows it stalls
+		r.act.applyTo(c.dirs)
+	case "reset":
+		c.reset()
+		return pc, false
+	case "halfopen":
+		c.halfOpenNow()
+		return pc, false
+	}
+	return pc, true
+}
+
+// reset aborts both sides with RST.
+func (c *proxyConn) reset() {
+	c.state.Store("reset")
+	c.client.SetLinger(0)
+	c.server.SetLinger(0)
+	c.close()
+}
+
+// halfOpenNow drops the provider side without telling the consumer. The
+// consumer's writes keep succeeding and nothing ever comes back, like a peer
+// that vanished without a FIN reaching us.
+func (c *proxyConn) halfOpenNow() {
+	if c.halfOpen.Swap(true) {
+		return
+	}
+	c.state.Store("halfopen")
+	c.server.SetLinger(0)
+	c.server.Close()
+}
+
+func (c *proxyConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.client.Close()
+		c.server.Close()
+	})
+}
+
+// frame is a complete dubbo frame with its header, or raw bytes.
+type frame struct {
+	data   []byte
+	header *dubboframe.Header
+}
+
+// framer splits a stream into whole dubbo frames so rules can act on them.
+// A stream that does not parse as dubbo is passed through raw from then on.
+type framer struct {
+	buf []byte
+	raw bool
+}
+
+func (f *framer) feed(b []byte) []frame {
+	if len(b) == 0 {
+		return nil
+	}
+	if f.raw {
+		return []frame{{data: append([]byte(nil), b...)}}
+	}
+	f.buf = append(f.buf, b...)
+	var out []frame
+	for len(f.buf) > 0 {
+		if len(f.buf) < dubboframe.HeaderLen {
+			if f.buf[0] != 0xda || (len(f.buf) > 1 && f.buf[1] != 0xbb) {
+				return f.passthrough(out)
+			}
+			break
+		}
+		h, err := dubboframe.ParseHeader(f.buf)
+		n := dubboframe.HeaderLen + h.BodyLen
+		if err != nil || n > maxFrame {
+			return f.passthrough(out)
+		}
+		if len(f.buf) < n {
+			break
+		}
+		data := make([]byte, n)
+		copy(data, f.buf)
+		out = append(out, frame{data: data, header: &h})
+		f.buf = f.buf[n:]
+	}
+	return out
+}
+
+func (f *framer) passthrough(out []frame) []frame {
+	f.raw = true
+	out = append(out, frame{data: f.buf})
+	f.buf = nil
+	return out
+}
@@ -2,21 +2,81 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"flag"
 	"log"
-	"math/rand"
-	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
 	"dubbo.apache.org/dubbo-go/v3/config"
 	_ "dubbo.apache.org/dubbo-go/v3/imports"
 	hessian "github.com/apache/dubbo-go-hessian2"
+	"go.uber.org/zap"
 
 	"dubbo-demo/api"
+	"dubbo-demo/internal/breaker"
+	"dubbo-demo/internal/capacity"
+	_ "dubbo-demo/internal/deadline"
+	"dubbo-demo/internal/failure"
+	"dubbo-demo/internal/flightrec"
+	"dubbo-demo/internal/hedge"
+	"dubbo-demo/internal/loadgen"
+	_ "dubbo-demo/internal/localregistry"
+	"dubbo-demo/internal/metrics"
+	"dubbo-demo/internal/record"
+	"dubbo-demo/internal/reqlog"
+	"dubbo-demo/internal/tracing"
 )
 
+var (
+	concurrency = flag.Int("c", 1, "number of concurrent callers")
+	qps         = flag.Float64("qps", 0, "target aggregate calls per second, 0 for unlimited")
+	duration    = flag.Duration("d", 0, "how long to run, 0 to run until interrupted")
+	costSpec    = flag.String("cost", "uniform:3s,10s", "cost distribution: fixed:D, uniform:MIN,MAX, exp:MEAN or hist:FILE")
+	recordPath  = flag.String("record", "requests.jsonl", "append every call to this JSON lines file, empty to disable")
+	healthEvery = flag.Duration("health", 0, "log the state of every client, session and pending request this often, 0 to disable")
+	spreadEvery = flag.Duration("spread", 0, "log each provider's share of the calls and its remaining capacity this often, 0 to disable")
+	metricsAddr = flag.String("metrics", "", "serve Prometheus metrics on this address at /metrics, e.g. :9091, empty to disable")
+	traceFile   = flag.String("trace", "", "append the spans of traced calls to this OTLP-JSON file, empty to disable")
+	traceSample = flag.Float64("trace-sample", 1, "share of calls to trace with -trace, 0 to 1")
+	flightDir   = flag.String("flightrec", "", "dump goroutines, heap, session logs and a runtime trace into this directory on transport timeouts, empty to disable")
+	flightTrace = flag.Duration("flightrec-trace", 3*time.Second, "how much runtime trace a -flightrec dump takes")
+	flightGap   = flag.Duration("flightrec-gap", time.Minute, "dump at most once this often with -flightrec")
+	policies    = failure.DefaultPolicies()
+	extraKeys   = requestKeys{}
+)
+
+func init() {
+	flag.Var(policies, "on-error", "per error class policy, e.g. write_timeout=retry:2:500ms,decode=abort")
+	flag.Var(extraKeys, "set", "extra request key=value sent with every call, repeatable, e.g. -set stall=5s")
+}
+
 // export DUBBO_GO_CONFIG_PATH= PATH_TO_SAMPLES/direct/go-client/conf/dubbogo.yml
 func main() {
+	flag.Parse()
+	costs, err := loadgen.ParseCost(*costSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var recorder *record.Writer
+	if *recordPath != "" {
+		if recorder, err = record.Create(*recordPath); err != nil {
+			log.Fatal(err)
+		}
+		defer recorder.Close()
+	}
+	if *traceFile != "" {
+		tp, err := tracing.Setup(*traceFile, "dubbo-demo-consumer", *traceSample)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer tp.Close()
+	}
+
 	config.SetConsumerService(dubboDemoImpl)
 	hessian.RegisterPOJO(&api.DubboRequest{})
 	hessian.RegisterPOJO(&api.DubboResponse{})
@@ -24,29 +84,124 @@ func main() {
 	if err := config.Load(); err != nil {
 		panic(err)
 	}
+	var flight *flightrec.Recorder
+	if *flightDir != "" {
+		if flight, err = flightrec.New(*flightDir, *flightTrace, *flightGap); err != nil {
+			log.Fatal(err)
+		}
+		flightrec.CaptureLogs()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	if *healthEvery > 0 {
+		go reportHealth(ctx, *healthEvery)
+	}
+	if *spreadEvery > 0 {
+		go reportSpread(ctx, *spreadEvery)
+	}
+	if *metricsAddr != "" {
+		metrics.Serve(*metricsAddr)
+	}
 
-	for {
-		cost := fmt.Sprintf("%ss", strconv.Itoa(Random(3, 10)))
+	log.Printf("load: concurrency=%d qps=%v duration=%v cost=%v on-error=%v set=%v\n", *concurrency, *qps, *duration, costs, policies, extraKeys)
+	guard := failure.NewGuard(policies)
+	stats := loadgen.NewStats(func(err error) string { return failure.Classify(err).String() })
+	loadgen.Run(ctx, loadgen.Config{
+		Concurrency: *concurrency,
+		QPS:         *qps,
+		Duration:    *duration,
+	}, stats, func(callCtx context.Context) error {
 		req := &api.DubboRequest{
 			Request: map[string]interface{}{
-				"cost": cost,
+				"cost": loadgen.FormatCost(costs.Next()),
 			},
 		}
-		reply, err := dubboDemoImpl.SayHello(context.Background(), req)
-		if err != nil {
-			panic(err)
+		for k, v := range extraKeys {
+			req.Request[k] = v
 		}
-		log.Printf("client response result: %s\n", reply.Reponse)
+		stopRun, err := guard.Do(ctx, func() error {
+			return sayHello(callCtx, req, recorder)
+		}, func(class failure.Class, err error) {
+			log.Printf("client call error [%s]: %s\n", class, failure.Summary(err))
+			if flight != nil && (class == failure.WriteTimeout || class == failure.ReadTimeout) {
+				flight.Trigger(class.String(), err)
+			}
+		})
+		if stopRun {
+			log.Printf("aborting run on %s error\n", failure.Classify(err))
+			abort()
+		}
+		var open *breaker.OpenError
+		if errors.As(err, &open) {
+			waitForProbe(ctx, open)
+		}
+		return err
+	})
+	stats.Report(os.Stdout)
+	guard.Report(os.Stdout)
+	capacity.Report(os.Stdout)
+	hedge.Report(os.Stdout)
+}
+
+// waitForProbe holds a caller the circuit breaker turned away until the
+// breaker's next probe, so that callers do not spin on it. While the probe
+// is out, when it returns is unknown, so the caller takes a short nap.
+func waitForProbe(ctx context.Context, open *breaker.OpenError) {
+	wait := time.Until(open.RetryAt)
+	if wait <= 0 {
+		wait = 100 * time.Millisecond
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
 	}
 }
 
-var dubboDemoImpl = new(DubboDemoProvider)
+var dubboDemoImpl = new(api.DubboDemoProvider)
 
-type DubboDemoProvider struct {
-	SayHello func(ctx context.Context, req *api.DubboRequest) (resp *api.DubboResponse, err error)
-}
+func sayHello(ctx context.Context, req *api.DubboRequest, recorder *record.Writer) error {
+	// the reqlog-consumer filter sends this ID and logs the call under it
+	id := reqlog.NewID()
+	attachments := map[string]interface{}{reqlog.IDKey: id}
+	ctx = context.WithValue(ctx, constant.AttachmentKey, attachments)
+	// the capacity filter notes which provider the call went to
+	var provider string
+	ctx = capacity.WithProvider(ctx, &provider)
+	// and the hedged cluster which of its attempts answered
+	var attempt int
+	ctx = hedge.WithAttempt(ctx, &attempt)
 
-func Random(min, max int) int {
-	rand.Seed(time.Now().Unix())
-	return rand.Intn(max-min) + min
+	st := time.Now()
+	reply, err := dubboDemoImpl.SayHello(ctx, req)
+	class := ""
+	if err != nil {
+		class = failure.Classify(err).String()
+	}
+	spec, _ := req.Request["cost"].(string)
+	cost, _ := time.ParseDuration(spec)
+	metrics.ObserveCall(cost, time.Since(st), class)
+	if recorder != nil {
+		entry := record.NewEntry(st, req.Request, attachments, err)
+		entry.Class = class
+		entry.Provider = provider
+		entry.Attempt = attempt
+		if werr := recorder.Write(entry); werr != nil {
+			log.Printf("record call error: %v\n", werr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	lg := reqlog.Logger().With(zap.String("request_id", id), zap.String("cost", spec))
+	if len(reply.Reponse) > 256 {
+		lg.Info("client response result", zap.ByteString("result", reply.Reponse[:256]), zap.Int("bytes", len(reply.Reponse)))
+		return nil
+	}
+	lg.Info("client response result", zap.ByteString("result", reply.Reponse))
+	return nil
 }
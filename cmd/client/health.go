@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"dubbo-demo/internal/sessions"
+)
+
+// reportHealth logs the consumer's clients and getty sessions every period
+// until ctx is done:
+//
+//	health: pending=2 oldest=1.2s
+//	health: 127.0.0.1:20000 references=1 sessions=1
+//	health:   session 3 127.0.0.1:52814->127.0.0.1:20000 seen=1m0s idle=4ms rtt=312µs responses=5310 read=1190440B/5312 write=1174712B/5313
+//
+// pending counts requests still waiting for a response; entries that are
+// older than the request timeout belong to calls that have already failed.
+// getty keeps no start time for a session, so seen is how long the report
+// has been listing it rather than its age.
+// rtt is a heartbeat sent on the session for the report, so a session that
+// stops answering shows up here before calls on it time out.
+func reportHealth(ctx context.Context, period time.Duration) {
+	firstSeen := map[uint32]time.Time{}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		p := sessions.Pending()
+		log.Printf("health: pending=%d oldest=%v\n", p.Count, p.Oldest.Round(time.Millisecond))
+
+		clients := sessions.ClientStats()
+		seen := map[uint32]bool{}
+		for _, c := range clients {
+			for _, s := range c.Sessions {
+				seen[s.ID] = true
+				if _, ok := firstSeen[s.ID]; !ok {
+					firstSeen[s.ID] = now
+				}
+			}
+		}
+		for id := range firstSeen {
+			if !seen[id] {
+				delete(firstSeen, id)
+			}
+		}
+		rtts := pingAll(clients, period/2)
+		for _, c := range clients {
+			log.Printf("health: %s references=%d sessions=%d\n", c.Address, c.References, len(c.Sessions))
+			for _, s := range c.Sessions {
+				log.Printf("health:   session %d %s->%s seen=%v idle=%v rtt=%s responses=%d read=%dB/%d write=%dB/%d\n",
+					s.ID, s.Local, s.Remote,
+					now.Sub(firstSeen[s.ID]).Round(time.Second), now.Sub(s.Active).Round(time.Millisecond), rtts[s.ID],
+					s.Requests, s.ReadBytes, s.ReadPkgs, s.WriteBytes, s.WritePkgs)
+			}
+		}
+	}
+}
+
+// pingAll sends a heartbeat on every session at once, so that one stuck
+// session does not hold up the report for the others.
+func pingAll(clients []sessions.ClientStat, timeout time.Duration) map[uint32]string {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		rtts = map[uint32]string{}
+	)
+	for _, c := range clients {
+		for _, st := range c.Sessions {
+			s := sessions.ClientByID(st.ID)
+			if s == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(id uint32) {
+				defer wg.Done()
+				rtt, err := sessions.Ping(s, timeout)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					rtts[id] = "error(" + err.Error() + ")"
+					return
+				}
+				rtts[id] = rtt.Round(time.Microsecond).String()
+			}(st.ID)
+		}
+	}
+	wg.Wait()
+	return rtts
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// requestKeys collects repeated -set key=value flags into extra
+// DubboRequest.Request entries, e.g. to drive the provider's fault keys.
+type requestKeys map[string]string
+
+func (k requestKeys) String() string {
+	pairs := make([]string, 0, len(k))
+	for key, value := range k {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (k requestKeys) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("want key=value, got %q", s)
+	}
+	k[key] = value
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"dubbo-demo/internal/capacity"
+)
+
+// reportSpread logs how the calls of the last period spread over the
+// providers, with the capacity each reported last, every period until ctx is
+// done:
+//
+//	spread: 127.0.0.1:20001 12% (61 calls, 0 rejected) remaining=3 inflight=2 | 127.0.0.1:20002 88% (437 calls, 0 rejected) remaining=41 inflight=9
+//
+// remaining and inflight come from the provider's adaptivesvc limiter, so
+// they stay unknown unless the reference uses the adaptivesvc cluster.
+func reportSpread(ctx context.Context, period time.Duration) {
+	last := map[string]capacity.Provider{}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ps := capacity.Snapshot()
+		var total uint64
+		for _, p := range ps {
+			total += p.Calls - last[p.Address].Calls
+		}
+		parts := make([]string, 0, len(ps))
+		for _, p := range ps {
+			calls, rejected := p.Calls-last[p.Address].Calls, p.Rejected-last[p.Address].Rejected
+			share := 0.0
+			if total > 0 {
+				share = 100 * float64(calls) / float64(total)
+			}
+			parts = append(parts, fmt.Sprintf("%s %.0f%% (%d calls, %d rejected) %s",
+				p.Address, share, calls, rejected, p.Capacity()))
+			last[p.Address] = p
+		}
+		if len(parts) > 0 {
+			log.Printf("spread: %s\n", strings.Join(parts, " | "))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	hessian "github.com/apache/dubbo-go-hessian2"
+
+	"dubbo-demo/api"
+	"dubbo-demo/internal/dubboframe"
+)
+
+var compact = flag.Bool("compact", false, "print one JSON object per line instead of indented JSON")
+
+var (
+	dumpStart = regexp.MustCompile(`\[\]byte\{`)
+	byteToken = regexp.MustCompile(`0x[0-9a-fA-F]{1,2}`)
+	session   = regexp.MustCompile(`session \{([^}]*)\}`)
+)
+
+// dumped is one frame found in a log line.
+type dumped struct {
+	Source  string `json:"source"`
+	Session string `json:"session,omitempty"`
+	Offset  int    `json:"offset"`
+	*dubboframe.Frame
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// Usage: dubbodump [-compact] [FILE...], reading stdin without files.
+func main() {
+	flag.Parse()
+	hessian.RegisterPOJO(&api.DubboRequest{})
+	hessian.RegisterPOJO(&api.DubboResponse{})
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	if !*compact {
+		enc.SetIndent("", "  ")
+	}
+	if flag.NArg() == 0 {
+		scan("stdin", os.Stdin, enc)
+		return
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scan(name, f, enc)
+		f.Close()
+	}
+}
+
+func scan(name string, r io.Reader, enc *json.Encoder) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		var sess string
+		if m := session.FindStringSubmatch(text); m != nil {
+			sess = m[1]
+		}
+		for i, loc := range dumpStart.FindAllStringIndex(text, -1) {
+			source := fmt.Sprintf("%s:%d", name, line)
+			if i > 0 {
+				source += fmt.Sprintf("#%d", i+1)
+			}
+			for _, d := range frames(source, sess, parseDump(text[loc[1]:])) {
+				if err := enc.Encode(d); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		log.Printf("%s: %v\n", name, err)
+	}
+}
+
+// parseDump reads the bytes of a %#v []byte dump up to its closing brace. A
+// dump cut off before the brace may end in a partial token, which is dropped.
+func parseDump(s string) []byte {
+	end := strings.IndexByte(s, '}')
+	complete := end >= 0
+	if complete {
+		s = s[:end]
+	}
+	tokens := byteToken.FindAllStringIndex(s, -1)
+	if !complete && len(tokens) > 0 && !strings.HasPrefix(strings.TrimSpace(s[tokens[len(tokens)-1][1]:]), ",") {
+		tokens = tokens[:len(tokens)-1]
+	}
+	out := make([]byte, 0, len(tokens))
+	for _, t := range tokens {
+		v, _ := strconv.ParseUint(s[t[0]+2:t[1]], 16, 8)
+		out = append(out, byte(v))
+	}
+	return out
+}
+
+// frames decodes every frame in b; a getty write can carry several.
+func frames(source, sess string, b []byte) []dumped {
+	var out []dumped
+	for off := 0; off < len(b); {
+		f, n, err := dubboframe.Decode(b[off:])
+		if err != nil {
+			out = append(out, dumped{Source: source, Session: sess, Offset: off,
+				Skipped: fmt.Sprintf("%d bytes: %v", len(b)-off, err)})
+			break
+		}
+		out = append(out, dumped{Source: source, Session: sess, Offset: off, Frame: f})
+		off += n
+	}
+	return out
+}
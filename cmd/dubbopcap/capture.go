@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// packet is one captured link-layer frame.
+type packet struct {
+	ts   time.Time
+	link uint32
+	data []byte
+}
+
+// maxPacket bounds the captured length of a packet, and so what a corrupt
+// length field can make the readers allocate. tcpdump's default snaplen is
+// the same 256 KiB.
+const maxPacket = 256 << 10
+
+// capture reads packets from a pcap or pcapng file.
+type capture interface {
+	next() (packet, error)
+}
+
+// openCapture sniffs the file magic and returns the matching reader.
+func openCapture(r io.Reader) (capture, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading capture magic: %w", err)
+	}
+	switch {
+	case binary.BigEndian.Uint32(magic) == pcapngSHB:
+		return &pcapngReader{r: br}, nil
+	default:
+		return newPcapReader(br)
+	}
+}
+
+// Classic pcap: a 24 byte file header, then 16 byte record headers.
+type pcapReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	nanos bool
+	link  uint32
+	// snaplen is the longest record the file header allows, capped at
+	// maxPacket.
+	snaplen uint32
+	hdr     [16]byte
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var fh [24]byte
+	if _, err := io.ReadFull(r, fh[:]); err != nil {
+		return nil, fmt.Errorf("reading pcap header: %w", err)
+	}
+	p := &pcapReader{r: r}
+	switch binary.LittleEndian.Uint32(fh[:4]) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nanos = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("not a pcap or pcapng file (magic %x)", fh[:4])
+	}
+	p.link = p.order.Uint32(fh[20:24]) & 0x0fffffff
+	p.snaplen = p.order.Uint32(fh[16:20])
+	if p.snaplen == 0 || p.snaplen > maxPacket {
+		p.snaplen = maxPacket
+	}
+	return p, nil
+}
+
+func (p *pcapReader) next() (packet, error) {
+	if _, err := io.ReadFull(p.r, p.hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		return packet{}, err
+	}
+	sec := int64(p.order.Uint32(p.hdr[0:4]))
+	frac := int64(p.order.Uint32(p.hdr[4:8]))
+	if !p.nanos {
+		frac *= 1000
+	}
+	caplen := p.order.Uint32(p.hdr[8:12])
+	if caplen > p.snaplen {
+		return packet{}, fmt.Errorf("pcap: record of %d bytes is longer than the snaplen of %d", caplen, p.snaplen)
+	}
+	data := make([]byte, caplen)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		// a capture killed mid-write ends in a partial record
+		return packet{}, io.EOF
+	}
+	return packet{ts: time.Unix(sec, frac), link: p.link, data: data}, nil
+}
+
+// pcapng: a sequence of blocks, each section starting with a section header
+// that fixes the byte order, and interface blocks giving link type and
+// timestamp resolution.
+const (
+	pcapngSHB = 0x0a0d0d0a
+	pcapngIDB = 1
+	pcapngPB  = 2 // obsolete packet block
+	pcapngSPB = 3
+	pcapngEPB = 6
+
+	// maxBlock leaves room for a packet's options besides its data.
+	maxBlock = maxPacket + 64<<10
+)
+
+type pcapngIface struct {
+	link    uint32
+	snaplen uint32
+	// perSec is the number of timestamp units in a second.
+	perSec uint64
+}
+
+type pcapngReader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ifaces []pcapngIface
+}
+
+func (p *pcapngReader) next() (packet, error) {
+	for {
+		typ, body, err := p.block()
+		if err != nil {
+			return packet{}, err
+		}
+		switch typ {
+		case pcapngSHB:
+			p.ifaces = nil
+		case pcapngIDB:
+			p.ifaces = append(p.ifaces, p.iface(body))
+		case pcapngEPB, pcapngPB:
+			if len(body) < 20 {
+				continue
+			}
+			id := p.order.Uint32(body[0:4])
+			if typ == pcapngPB {
+				id = uint32(p.order.Uint16(body[0:2]))
+			}
+			if int(id) >= len(p.ifaces) {
+				continue
+			}
+			ifc := p.ifaces[id]
+			ts := uint64(p.order.Uint32(body[4:8]))<<32 | uint64(p.order.Uint32(body[8:12]))
+			caplen := int(p.order.Uint32(body[12:16]))
+			if caplen > int(ifc.snaplen) {
+				return packet{}, fmt.Errorf("pcapng: packet of %d bytes is longer than the snaplen of %d", caplen, ifc.snaplen)
+			}
+			if 20+caplen > len(body) {
+				caplen = len(body) - 20
+			}
+			return packet{ts: ifc.time(ts), link: ifc.link, data: body[20 : 20+caplen]}, nil
+		case pcapngSPB:
+			// simple packets carry no timestamp; they are rare in captures of
+			// interest here and cannot be placed on the timeline
+			continue
+		}
+	}
+}
+
+// block reads one block and returns its type and body, without the type,
+// length and trailing length fields.
+func (p *pcapngReader) block() (uint32, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint32(hdr[0:4]) == pcapngSHB {
+		// the byte order magic follows the length, read it to learn the order
+		var bom [4]byte
+		if _, err := io.ReadFull(p.r, bom[:]); err != nil {
+			return 0, nil, io.EOF
+		}
+		switch binary.LittleEndian.Uint32(bom[:]) {
+		case 0x1a2b3c4d:
+			p.order = binary.LittleEndian
+		case 0x4d3c2b1a:
+			p.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("pcapng: bad byte order magic %x", bom)
+		}
+		total := p.order.Uint32(hdr[4:8])
+		if total < 16 || total > maxBlock {
+			return 0, nil, fmt.Errorf("pcapng: bad section header length %d", total)
+		}
+		rest := make([]byte, total-12)
+		if _, err := io.ReadFull(p.r, rest); err != nil {
+			return 0, nil, io.EOF
+		}
+		return pcapngSHB, nil, nil
+	}
+	if p.order == nil {
+		return 0, nil, errors.New("pcapng: block before section header")
+	}
+	typ := p.order.Uint32(hdr[0:4])
+	total := p.order.Uint32(hdr[4:8])
+	if total < 12 || total > maxBlock {
+		return 0, nil, fmt.Errorf("pcapng: bad block length %d", total)
+	}
+	body := make([]byte, total-8)
+	if _, err := io.ReadFull(p.r, body); err != nil {
+		return 0, nil, io.EOF
+	}
+	return typ, body[:len(body)-4], nil
+}
+
+func (p *pcapngReader) iface(body []byte) pcapngIface {
+	ifc := pcapngIface{perSec: 1e6, snaplen: maxPacket}
+	if len(body) < 8 {
+		return ifc
+	}
+	ifc.link = uint32(p.order.Uint16(body[0:2]))
+	if n := p.order.Uint32(body[4:8]); n != 0 && n < maxPacket {
+		ifc.snaplen = n
+	}
+	for opts := body[8:]; len(opts) >= 4; {
+		code := p.order.Uint16(opts[0:2])
+		n := int(p.order.Uint16(opts[2:4]))
+		if code == 0 || 4+n > len(opts) {
+			break
+		}
+		if code == 9 && n >= 1 { // if_tsresol: 10^-v or, with the top bit, 2^-v seconds
+			v := uint64(opts[4] & 0x7f)
+			if opts[4]&0x80 != 0 && v < 64 {
+				ifc.perSec = 1 << v
+			} else if opts[4]&0x80 == 0 && v <= 19 {
+				ifc.perSec = 1
+				for ; v > 0; v-- {
+					ifc.perSec *= 10
+				}
+			}
+		}
+		adv := 4 + (n+3)&^3
+		if adv > len(opts) {
+			break
+		}
+		opts = opts[adv:]
+	}
+	return ifc
+}
+
+func (ifc pcapngIface) time(ts uint64) time.Time {
+	sec, rem := ts/ifc.perSec, ts%ifc.perSec
+	hi, lo := bits.Mul64(rem, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, ifc.perSec)
+	return time.Unix(int64(sec), int64(nsec))
+}
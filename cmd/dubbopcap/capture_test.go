@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	clientISN = 1000 // first payload byte from the consumer
+	serverISN = 5000 // first payload byte from the provider
+)
+
+// heartbeat is a dubbo heartbeat frame with a hessian null body, a request
+// when req is set and its response otherwise.
+func heartbeat(id int64, req bool) []byte {
+	b := make([]byte, 17)
+	b[0], b[1] = 0xda, 0xbb
+	b[2] = 0x20 | 2 // event, hessian2
+	if req {
+		b[2] |= 0x80 | 0x40 // request, two way
+	} else {
+		b[3] = 20 // OK
+	}
+	binary.BigEndian.PutUint64(b[4:12], uint64(id))
+	binary.BigEndian.PutUint32(b[12:16], 1)
+	b[16] = 'N'
+	return b
+}
+
+func cat(bs ...[]byte) []byte { return bytes.Join(bs, nil) }
+
+// tcpSeg is one segment of the test connection; seq counts from the
+// sender's first payload byte.
+type tcpSeg struct {
+	dir     int
+	seq     uint32
+	flags   byte
+	payload []byte
+}
+
+// handshake opens the connection, so that segments arriving out of order
+// are placed against a known start.
+var handshake = []tcpSeg{
+	{dir: toServer, seq: ^uint32(0), flags: flagSYN},
+	{dir: toClient, seq: ^uint32(0), flags: flagSYN | flagACK},
+}
+
+// ipv4 builds a raw IPv4 packet carrying s between 10.0.0.1:40000 and
+// 10.0.0.2:20000.
+func ipv4(s tcpSeg) []byte {
+	client, server := netip.MustParseAddrPort("10.0.0.1:40000"), netip.MustParseAddrPort("10.0.0.2:20000")
+	src, dst, isn := client, server, uint32(clientISN)
+	if s.dir == toClient {
+		src, dst, isn = server, client, serverISN
+	}
+	b := make([]byte, 40+len(s.payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8], b[9] = 64, 6
+	copy(b[12:16], src.Addr().AsSlice())
+	copy(b[16:20], dst.Addr().AsSlice())
+	tcp := b[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:4], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:8], isn+s.seq)
+	tcp[12] = 5 << 4
+	tcp[13] = s.flags | flagACK
+	if s.flags&flagSYN != 0 && s.dir == toServer {
+		tcp[13] = s.flags
+	}
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	copy(tcp[20:], s.payload)
+	return b
+}
+
+var epoch = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// pcapFile writes segs as raw IP records of a little-endian microsecond
+// pcap, a millisecond apart.
+func pcapFile(snaplen uint32, segs ...tcpSeg) []byte {
+	var b []byte
+	le := binary.LittleEndian
+	b = le.AppendUint32(b, 0xa1b2c3d4)
+	b = le.AppendUint16(b, 2)
+	b = le.AppendUint16(b, 4)
+	b = append(b, make([]byte, 8)...)
+	b = le.AppendUint32(b, snaplen)
+	b = le.AppendUint32(b, linkRaw)
+	for i, s := range segs {
+		data := ipv4(s)
+		ts := epoch.Add(time.Duration(i) * time.Millisecond)
+		b = le.AppendUint32(b, uint32(ts.Unix()))
+		b = le.AppendUint32(b, uint32(ts.Nanosecond()/1000))
+		b = le.AppendUint32(b, uint32(len(data)))
+		b = le.AppendUint32(b, uint32(len(data)))
+		b = append(b, data...)
+	}
+	return b
+}
+
+// pcapngFile writes segs as enhanced packet blocks of a big-endian pcapng
+// with one raw IP interface, a millisecond apart.
+func pcapngFile(snaplen uint32, segs ...tcpSeg) []byte {
+	be := binary.BigEndian
+	block := func(b []byte, typ uint32, body []byte) []byte {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		b = be.AppendUint32(b, typ)
+		b = be.AppendUint32(b, uint32(12+len(body)))
+		b = append(b, body...)
+		return be.AppendUint32(b, uint32(12+len(body)))
+	}
+	shb := be.AppendUint32(nil, 0x1a2b3c4d)
+	shb = be.AppendUint16(shb, 1)
+	shb = be.AppendUint16(shb, 0)
+	shb = be.AppendUint64(shb, ^uint64(0))
+	b := block(nil, pcapngSHB, shb)
+
+	idb := be.AppendUint16(nil, linkRaw)
+	idb = be.AppendUint16(idb, 0)
+	idb = be.AppendUint32(idb, snaplen)
+	b = block(b, pcapngIDB, idb)
+
+	for i, s := range segs {
+		data := ipv4(s)
+		ts := uint64(epoch.Add(time.Duration(i) * time.Millisecond).UnixMicro())
+		epb := be.AppendUint32(nil, 0)
+		epb = be.AppendUint32(epb, uint32(ts>>32))
+		epb = be.AppendUint32(epb, uint32(ts))
+		epb = be.AppendUint32(epb, uint32(len(data)))
+		epb = be.AppendUint32(epb, uint32(len(data)))
+		b = block(b, pcapngEPB, append(epb, data...))
+	}
+	return b
+}
+
+// analyze runs a capture through the same steps as main.
+func analyze(capture []byte) (*analysis, error) {
+	capt, err := openCapture(bytes.NewReader(capture))
+	if err != nil {
+		return nil, err
+	}
+	a := &analysis{conns: map[[2]netip.AddrPort]*conn{}, pending: map[callKey]*call{}}
+	for {
+		p, err := capt.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.packet(p)
+	}
+	a.finish()
+	return a, nil
+}
+
+func TestCapture(t *testing.T) {
+	req1, req2, req3 := heartbeat(1, true), heartbeat(2, true), heartbeat(3, true)
+	resp1, resp2 := heartbeat(1, false), heartbeat(2, false)
+	// falseMagic starts like a frame but has no serialization ID
+	falseMagic := append([]byte{0xda, 0xbb, 0x80}, make([]byte, 13)...)
+
+	segs := func(s ...tcpSeg) []tcpSeg { return append(append([]tcpSeg(nil), handshake...), s...) }
+	inOrder := segs(
+		tcpSeg{dir: toServer, seq: 0, payload: req1},
+		tcpSeg{dir: toClient, seq: 0, payload: resp1},
+	)
+	outOfOrder := segs(
+		tcpSeg{dir: toServer, seq: 10, payload: cat(req1[10:], req2[:5])},
+		tcpSeg{dir: toServer, seq: 22, payload: req2[5:]},
+		tcpSeg{dir: toServer, seq: 0, payload: req1[:10]},
+		tcpSeg{dir: toClient, seq: 17, payload: resp2},
+		tcpSeg{dir: toClient, seq: 0, payload: resp1},
+	)
+	junk := cat([]byte("xx\xda"), falseMagic, []byte{0xbb})
+	resync := segs(
+		tcpSeg{dir: toServer, seq: 0, payload: junk[:8]},
+		tcpSeg{dir: toServer, seq: 8, payload: cat(junk[8:], req1[:3])},
+		tcpSeg{dir: toServer, seq: uint32(len(junk) + 3), payload: cat(req1[3:], req2)},
+	)
+	lost := segs(
+		tcpSeg{dir: toServer, seq: 0, payload: req1[:8]},
+		// req1[8:] was never captured
+		tcpSeg{dir: toServer, seq: 17, payload: req2},
+		tcpSeg{dir: toServer, seq: 34, payload: req3},
+	)
+
+	for _, tc := range []struct {
+		name    string
+		capture []byte
+		calls   []int64 // request IDs, in capture order
+		// answered counts the calls with a response
+		answered  int
+		junk, gap int // consumer to provider
+		err       string
+	}{
+		{name: "pcap in order", capture: pcapFile(65535, inOrder...), calls: []int64{1}, answered: 1},
+		{name: "pcapng in order", capture: pcapngFile(65535, inOrder...), calls: []int64{1}, answered: 1},
+		{name: "pcap out of order", capture: pcapFile(65535, outOfOrder...), calls: []int64{1, 2}, answered: 2},
+		{name: "pcapng out of order", capture: pcapngFile(0, outOfOrder...), calls: []int64{1, 2}, answered: 2},
+		{name: "pcap resync on magic", capture: pcapFile(65535, resync...), calls: []int64{1, 2}, junk: len(junk)},
+		{name: "pcapng resync on magic", capture: pcapngFile(65535, resync...), calls: []int64{1, 2}, junk: len(junk)},
+		{name: "pcap lost segment", capture: pcapFile(65535, lost...), calls: []int64{2, 3}, junk: 8, gap: 1},
+		{name: "pcapng lost segment", capture: pcapngFile(65535, lost...), calls: []int64{2, 3}, junk: 8, gap: 1},
+		{name: "pcap record over snaplen", capture: pcapFile(48, inOrder...), err: "longer than the snaplen of 48"},
+		{name: "pcap record over maxPacket", capture: pcapFile(0, tcpSeg{dir: toServer, payload: make([]byte, maxPacket)}), err: "longer than the snaplen"},
+		{name: "pcapng packet over snaplen", capture: pcapngFile(48, inOrder...), err: "longer than the snaplen of 48"},
+		{name: "pcapng block over maxBlock", capture: pcapngFile(0, tcpSeg{dir: toServer, payload: make([]byte, maxBlock)}), err: "bad block length"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := analyze(tc.capture)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			answered := 0
+			for _, cl := range a.calls {
+				ids = append(ids, cl.ID)
+				if cl.Answered {
+					answered++
+				}
+			}
+			if len(ids) != len(tc.calls) {
+				t.Fatalf("calls %v, want %v", ids, tc.calls)
+			}
+			for i := range ids {
+				if ids[i] != tc.calls[i] {
+					t.Fatalf("calls %v, want %v", ids, tc.calls)
+				}
+			}
+			if answered != tc.answered {
+				t.Errorf("%d calls answered, want %d", answered, tc.answered)
+			}
+			if len(a.order) != 1 {
+				t.Fatalf("%d connections, want 1", len(a.order))
+			}
+			h := a.order[0].dirs[toServer]
+			if h.junk != tc.junk || h.gaps != tc.gap {
+				t.Errorf("%d bytes skipped in %d gaps, want %d in %d", h.junk, h.gaps, tc.junk, tc.gap)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// Link types, as numbered in pcap file headers and pcapng interface blocks.
+const (
+	linkNull     = 0   // BSD loopback, 4 byte host order address family
+	linkEthernet = 1   // Ethernet II, optionally 802.1Q tagged
+	linkRaw      = 101 // raw IPv4 or IPv6
+	linkRawAlt   = 12  // raw IP as some BSDs number it
+	linkLoop     = 108 // OpenBSD loopback, network order family
+	linkLinuxSLL = 113 // Linux cooked capture, tcpdump -i any
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276 // Linux cooked capture v2
+)
+
+// TCP flags.
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+	flagACK = 0x10
+)
+
+// segment is the TCP part of a packet.
+type segment struct {
+	src, dst netip.AddrPort
+	seq, ack uint32
+	flags    byte
+	window   uint16
+	payload  []byte
+}
+
+// decodeTCP peels the link and IP layers off a captured frame. ok is false
+// for anything that is not a TCP segment, including IP fragments.
+func decodeTCP(p packet) (seg segment, ok bool) {
+	ip, ok := ipPayload(p.link, p.data)
+	if !ok || len(ip) < 1 {
+		return seg, false
+	}
+	var tcp []byte
+	var src, dst netip.Addr
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return seg, false
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		if ip[9] != 6 || ihl < 20 || total < ihl || len(ip) < ihl {
+			return seg, false
+		}
+		if frag := binary.BigEndian.Uint16(ip[6:8]); frag&0x3fff != 0 {
+			return seg, false
+		}
+		if total < len(ip) {
+			ip = ip[:total] // drop Ethernet padding
+		}
+		src = netip.AddrFrom4([4]byte(ip[12:16]))
+		dst = netip.AddrFrom4([4]byte(ip[16:20]))
+		tcp = ip[ihl:]
+	case 6:
+		if len(ip) < 40 {
+			return seg, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(ip[4:6]))
+		if total < len(ip) {
+			ip = ip[:total]
+		}
+		src = netip.AddrFrom16([16]byte(ip[8:24]))
+		dst = netip.AddrFrom16([16]byte(ip[24:40]))
+		next, rest := ip[6], ip[40:]
+		for next != 6 {
+			switch next {
+			case 0, 43, 60: // hop-by-hop, routing, destination options
+				if len(rest) < 8 {
+					return seg, false
+				}
+				n := 8 + int(rest[1])*8
+				if len(rest) < n {
+					return seg, false
+				}
+				next, rest = rest[0], rest[n:]
+			default: // fragments and anything else
+				return seg, false
+			}
+		}
+		tcp = rest
+	default:
+		return seg, false
+	}
+
+	if len(tcp) < 20 {
+		return seg, false
+	}
+	off := int(tcp[12]>>4) * 4
+	if off < 20 || len(tcp) < off {
+		return seg, false
+	}
+	seg = segment{
+		src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:2])),
+		dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:4])),
+		seq:     binary.BigEndian.Uint32(tcp[4:8]),
+		ack:     binary.BigEndian.Uint32(tcp[8:12]),
+		flags:   tcp[13],
+		window:  binary.BigEndian.Uint16(tcp[14:16]),
+		payload: tcp[off:],
+	}
+	return seg, true
+}
+
+// ipPayload returns the IP packet inside a link-layer frame.
+func ipPayload(link uint32, b []byte) ([]byte, bool) {
+	switch link {
+	case linkEthernet:
+		if len(b) < 14 {
+			return nil, false
+		}
+		typ, rest := binary.BigEndian.Uint16(b[12:14]), b[14:]
+		for typ == 0x8100 || typ == 0x88a8 { // VLAN tags
+			if len(rest) < 4 {
+				return nil, false
+			}
+			typ, rest = binary.BigEndian.Uint16(rest[2:4]), rest[4:]
+		}
+		return rest, typ == 0x0800 || typ == 0x86dd
+	case linkNull, linkLoop:
+		if len(b) < 4 {
+			return nil, false
+		}
+		return b[4:], true
+	case linkLinuxSLL:
+		if len(b) < 16 {
+			return nil, false
+		}
+		typ := binary.BigEndian.Uint16(b[14:16])
+		return b[16:], typ == 0x0800 || typ == 0x86dd
+	case linkSLL2:
+		if len(b) < 20 {
+			return nil, false
+		}
+		typ := binary.BigEndian.Uint16(b[0:2])
+		return b[20:], typ == 0x0800 || typ == 0x86dd
+	case linkRaw, linkRawAlt, linkIPv4, linkIPv6:
+		return b, true
+	}
+	return nil, false
+}
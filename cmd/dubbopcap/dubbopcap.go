@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"time"
+
+	hessian "github.com/apache/dubbo-go-hessian2"
+
+	"dubbo-demo/api"
+	"dubbo-demo/internal/loadgen"
+)
+
+var (
+	port    = flag.Uint("port", 20000, "provider port; traffic to or from it is analyzed")
+	verbose = flag.Bool("v", false, "list every call, not just the unanswered ones")
+	jsonOut = flag.Bool("json", false, "print calls as JSON lines instead of the report")
+)
+
+// call is a request frame and, once seen, its response.
+type call struct {
+	Conn      string        `json:"conn"`
+	ID        int64         `json:"id"`
+	Heartbeat bool          `json:"heartbeat,omitempty"`
+	From      string        `json:"from"`
+	Method    string        `json:"method,omitempty"`
+	Sent      time.Time     `json:"sent"`
+	Bytes     int           `json:"bytes"`
+	Answered  bool          `json:"answered"`
+	Latency   time.Duration `json:"latency_ns,omitempty"`
+	Status    byte          `json:"status,omitempty"`
+	Outcome   string        `json:"outcome,omitempty"`
+	// Acked says whether the peer acknowledged the request's last byte, i.e.
+	// whether the request made it off the sending host.
+	Acked bool `json:"acked"`
+
+	conn   *conn
+	dir    int
+	seqEnd uint32
+}
+
+type callKey struct {
+	conn *conn
+	dir  int // direction the request travelled
+	id   int64
+}
+
+// analysis collects connections and calls across the capture.
+type analysis struct {
+	packets, segments int
+	first, last       time.Time
+	conns             map[[2]netip.AddrPort]*conn
+	order             []*conn
+	pending           map[callKey]*call
+	calls             []*call
+	orphans           int // responses with no request in the capture
+}
+
+// Usage: dubbopcap [-port 20000] [-v] [-json] FILE
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: dubbopcap [-port N] [-v] [-json] capture.pcap")
+		os.Exit(2)
+	}
+	hessian.RegisterPOJO(&api.DubboRequest{})
+	hessian.RegisterPOJO(&api.DubboResponse{})
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	capt, err := openCapture(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a := &analysis{conns: map[[2]netip.AddrPort]*conn{}, pending: map[callKey]*call{}}
+	for {
+		p, err := capt.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.packet(p)
+	}
+	a.finish()
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, c := range a.calls {
+			if err := enc.Encode(c); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	a.report(os.Stdout, flag.Arg(0))
+}
+
+func (a *analysis) packet(p packet) {
+	a.packets++
+	if a.first.IsZero() {
+		a.first = p.ts
+	}
+	a.last = p.ts
+	seg, ok := decodeTCP(p)
+	if !ok {
+		return
+	}
+	var dir int
+	var client, server netip.AddrPort
+	switch uint(*port) {
+	case uint(seg.dst.Port()):
+		dir, client, server = toServer, seg.src, seg.dst
+	case uint(seg.src.Port()):
+		dir, client, server = toClient, seg.dst, seg.src
+	default:
+		return
+	}
+	a.segments++
+	key := [2]netip.AddrPort{client, server}
+	c := a.conns[key]
+	if c == nil || (seg.flags&flagSYN != 0 && seg.flags&flagACK == 0 && (c.fin || c.rst)) {
+		// a SYN after the old connection closed reuses the port pair
+		c = newConn(client, server, p.ts)
+		a.conns[key] = c
+		a.order = append(a.order, c)
+	}
+	c.segment(dir, seg, p.ts, a.frame)
+}
+
+// frame pairs requests with responses travelling the other way.
+func (a *analysis) frame(ev frameEvent) {
+	f := ev.frame
+	if f.Header.Request {
+		cl := &call{
+			Conn:      ev.conn.client.String(),
+			ID:        f.Header.ID,
+			Heartbeat: f.Header.Event,
+			From:      dirNames[ev.dir],
+			Sent:      ev.start,
+			Bytes:     f.Have,
+			conn:      ev.conn,
+			dir:       ev.dir,
+			seqEnd:    ev.seqEnd,
+		}
+		if f.Request != nil {
+			cl.Method = f.Request.Method
+		}
+		a.calls = append(a.calls, cl)
+		if f.Header.TwoWay {
+			a.pending[callKey{ev.conn, ev.dir, f.Header.ID}] = cl
+		}
+		return
+	}
+	key := callKey{ev.conn, 1 - ev.dir, f.Header.ID}
+	cl := a.pending[key]
+	if cl == nil {
+		a.orphans++
+		return
+	}
+	delete(a.pending, key)
+	cl.Answered = true
+	cl.Latency = ev.end.Sub(cl.Sent)
+	cl.Status = f.Header.Status
+	switch {
+	case f.Response == nil:
+		cl.Outcome = "ok"
+	case f.Response.Kind == "exception":
+		cl.Outcome = "exception"
+	default:
+		cl.Outcome = f.Response.Kind
+	}
+	if f.Error != "" {
+		cl.Outcome = "undecodable: " + f.Error
+	}
+}
+
+func (a *analysis) finish() {
+	for _, c := range a.order {
+		for dir, h := range c.dirs {
+			h.flush(c, dir, a.frame)
+		}
+		c.finish(a.last)
+	}
+	for _, cl := range a.calls {
+		h := cl.conn.dirs[cl.dir]
+		cl.Acked = h.ackedSet && !seqAfter(cl.seqEnd, h.acked)
+	}
+}
+
+func (a *analysis) report(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s: %d packets, %d TCP segments on port %d, %d connections, %v\n",
+		name, a.packets, a.segments, *port, len(a.order), a.last.Sub(a.first).Round(time.Millisecond))
+
+	lat := loadgen.NewStats(nil)
+	var calls, answered, beats, beatsAnswered int
+	var unanswered []*call
+	for _, cl := range a.calls {
+		if cl.Heartbeat {
+			beats++
+			if cl.Answered {
+				beatsAnswered++
+			}
+		} else {
+			calls++
+			if cl.Answered {
+				answered++
+				lat.Observe(cl.Latency, nil)
+			}
+		}
+		if !cl.Answered {
+			unanswered = append(unanswered, cl)
+		}
+	}
+	fmt.Fprintf(w, "calls: %d, answered: %d, unanswered: %d\n", calls, answered, calls-answered)
+	if answered > 0 {
+		fmt.Fprintf(w, "latency: p50=%v p90=%v p99=%v max=%v\n",
+			lat.Percentile(0.5), lat.Percentile(0.9), lat.Percentile(0.99), lat.Percentile(1))
+	}
+	fmt.Fprintf(w, "heartbeats: %d, answered: %d\n", beats, beatsAnswered)
+	if a.orphans > 0 {
+		fmt.Fprintf(w, "responses without a request in the capture: %d\n", a.orphans)
+	}
+
+	fmt.Fprintln(w)
+	var empty, refused int
+	for _, c := range a.order {
+		if c.dirs[toServer].bytes == 0 && c.dirs[toClient].bytes == 0 && !*verbose {
+			// reconnect attempts against a dead provider pile up quickly
+			empty++
+			if c.rst {
+				refused++
+			}
+			continue
+		}
+		flags := ""
+		for _, f := range []struct {
+			set  bool
+			name string
+		}{{c.syn, "syn"}, {c.fin, "fin"}, {c.rst, "rst"}} {
+			if f.set {
+				flags += " " + f.name
+			}
+		}
+		fmt.Fprintf(w, "connection %v -> %v, %s to %s%s\n", c.client, c.server,
+			c.first.Format("15:04:05.000"), c.last.Format("15:04:05.000"), flags)
+		for dir, h := range c.dirs {
+			unacked := ""
+			if h.ackedSet && seqAfter(h.next, h.acked) {
+				unacked = fmt.Sprintf(", %d bytes unacknowledged at the end", h.next-h.acked)
+			}
+			fmt.Fprintf(w, "  %s: %d bytes, %d frames, %d retransmits, %d gaps, %d bytes skipped%s\n",
+				dirNames[dir], h.bytes, h.frames, h.retransmits, h.gaps, h.junk, unacked)
+		}
+		for _, s := range c.stalls {
+			closer := "consumer"
+			if s.stalled == toServer {
+				closer = "provider"
+			}
+			open := ""
+			if s.open {
+				open = ", still closed at the end"
+			}
+			fmt.Fprintf(w, "  zero window: %s stopped reading at %s for %v, %s writes stalled%s\n",
+				closer, s.start.Format("15:04:05.000"), s.end.Sub(s.start).Round(time.Millisecond), dirNames[s.stalled], open)
+		}
+	}
+
+	if empty > 0 {
+		fmt.Fprintf(w, "%d more connections carried no data, %d of them reset\n", empty, refused)
+	}
+
+	if len(unanswered) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "unanswered:")
+		for _, cl := range unanswered {
+			printCall(w, cl)
+		}
+	}
+	if *verbose {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "calls:")
+		sorted := append([]*call(nil), a.calls...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Sent.Before(sorted[j].Sent) })
+		for _, cl := range sorted {
+			printCall(w, cl)
+		}
+	}
+}
+
+func printCall(w io.Writer, cl *call) {
+	what := cl.Method
+	if cl.Heartbeat {
+		what = "heartbeat"
+	}
+	result := "no response"
+	if cl.Answered {
+		result = fmt.Sprintf("%v %s", cl.Latency.Round(time.Microsecond), cl.Outcome)
+	}
+	acked := "not acked"
+	if cl.Acked {
+		acked = "acked"
+	}
+	fmt.Fprintf(w, "  %s %s id=%d %s %s, %d bytes %s, %s\n",
+		cl.Sent.Format("15:04:05.000000"), cl.Conn, cl.ID, cl.From, what, cl.Bytes, acked, result)
+}
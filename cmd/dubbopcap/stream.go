@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"sort"
+	"time"
+
+	"dubbo-demo/internal/dubboframe"
+)
+
+const (
+	toServer = 0 // consumer to provider
+	toClient = 1 // provider to consumer
+
+	// maxOutOfOrder bounds the bytes held waiting for a hole to fill. A
+	// capture that dropped a segment never fills it, so past this the hole
+	// is skipped.
+	maxOutOfOrder = 4 << 20
+	// maxFrame is the largest frame length believed; anything larger is
+	// taken as a false magic match while resynchronizing.
+	maxFrame = 64 << 20
+)
+
+var dirNames = [2]string{"consumer->provider", "provider->consumer"}
+
+// seqAfter reports whether a comes after b in sequence space.
+func seqAfter(a, b uint32) bool { return int32(a-b) > 0 }
+
+// frameEvent is a frame seen on the wire.
+type frameEvent struct {
+	conn  *conn
+	dir   int
+	frame *dubboframe.Frame
+	start time.Time // first byte captured
+	end   time.Time // last byte captured
+	// seqEnd is the sequence number just past the frame, to check whether
+	// the peer acknowledged it.
+	seqEnd uint32
+}
+
+// stall is a period during which a side advertised a zero receive window.
+type stall struct {
+	stalled    int // the direction whose sender had to wait, toClient when the consumer stopped reading
+	start, end time.Time
+	open       bool
+}
+
+// half is one direction of a connection.
+type half struct {
+	started bool
+	next    uint32 // next expected sequence number
+	ooo     map[uint32]oooSegment
+	oooLen  int
+
+	buf      []byte
+	bufSeq   uint32
+	bufStart time.Time
+
+	bytes, frames, retransmits, gaps, junk int
+	// acked is the highest sequence number of this direction the peer has
+	// acknowledged.
+	acked    uint32
+	ackedSet bool
+	zeroFrom time.Time // when the sender of this direction closed its window
+}
+
+type oooSegment struct {
+	data []byte
+	ts   time.Time
+}
+
+// conn is one TCP connection to the provider port.
+type conn struct {
+	client, server netip.AddrPort
+	first, last    time.Time
+	syn, fin, rst  bool
+	dirs           [2]*half
+	stalls         []stall
+}
+
+func newConn(client, server netip.AddrPort, ts time.Time) *conn {
+	c := &conn{client: client, server: server, first: ts, last: ts}
+	for i := range c.dirs {
+		c.dirs[i] = &half{ooo: make(map[uint32]oooSegment)}
+	}
+	return c
+}
+
+// segment feeds one TCP segment travelling in direction dir and calls emit
+// for every frame it completes.
+func (c *conn) segment(dir int, seg segment, ts time.Time, emit func(frameEvent)) {
+	c.last = ts
+	h, peer := c.dirs[dir], c.dirs[1-dir]
+	if seg.flags&flagRST != 0 {
+		c.rst = true
+	}
+	if seg.flags&flagFIN != 0 {
+		c.fin = true
+	}
+	if seg.flags&flagACK != 0 && (!peer.ackedSet || seqAfter(seg.ack, peer.acked)) {
+		peer.acked, peer.ackedSet = seg.ack, true
+	}
+	c.window(dir, seg, ts)
+
+	if seg.flags&flagSYN != 0 {
+		c.syn = true
+		h.started, h.next = true, seg.seq+1
+		return
+	}
+	if len(seg.payload) == 0 {
+		return
+	}
+	if !h.started {
+		// capture began mid-connection; take the first data seen as the start
+		h.started, h.next = true, seg.seq
+	}
+	h.add(c, dir, seg.seq, seg.payload, ts, emit)
+}
+
+// window tracks zero-window advertisements by the sender of seg.
+func (c *conn) window(dir int, seg segment, ts time.Time) {
+	if seg.flags&(flagSYN|flagRST) != 0 {
+		return
+	}
+	h := c.dirs[dir]
+	switch {
+	case seg.window == 0 && h.zeroFrom.IsZero():
+		h.zeroFrom = ts
+	case seg.window != 0 && !h.zeroFrom.IsZero():
+		// the sender of dir is the receiver of the other direction
+		c.stalls = append(c.stalls, stall{stalled: 1 - dir, start: h.zeroFrom, end: ts})
+		h.zeroFrom = time.Time{}
+	}
+}
+
+func (h *half) add(c *conn, dir int, seq uint32, data []byte, ts time.Time, emit func(frameEvent)) {
+	if seqAfter(seq, h.next) {
+		if _, dup := h.ooo[seq]; !dup {
+			h.ooo[seq] = oooSegment{data: append([]byte(nil), data...), ts: ts}
+			h.oooLen += len(data)
+		}
+		if h.oooLen > maxOutOfOrder {
+			h.skipHole()
+			h.drain(c, dir, emit)
+		}
+		return
+	}
+	if skip := int(h.next - seq); skip > 0 {
+		if skip >= len(data) {
+			h.retransmits++
+			return
+		}
+		data = data[skip:]
+	}
+	if len(data) > 0 {
+		h.deliver(c, dir, data, ts, emit)
+	}
+	h.drain(c, dir, emit)
+}
+
+// drain delivers held segments that have become contiguous.
+func (h *half) drain(c *conn, dir int, emit func(frameEvent)) {
+	for len(h.ooo) > 0 {
+		progressed := false
+		for seq, s := range h.ooo {
+			if seqAfter(seq, h.next) {
+				continue
+			}
+			delete(h.ooo, seq)
+			h.oooLen -= len(s.data)
+			progressed = true
+			if skip := int(h.next - seq); skip < len(s.data) {
+				h.deliver(c, dir, s.data[skip:], s.ts, emit)
+			}
+		}
+		if !progressed {
+			return
+		}
+	}
+}
+
+// skipHole gives up on missing bytes and moves on to the earliest held
+// segment. The frame being assembled is lost with them.
+func (h *half) skipHole() {
+	if len(h.ooo) == 0 {
+		return
+	}
+	seqs := make([]uint32, 0, len(h.ooo))
+	for seq := range h.ooo {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqAfter(seqs[j], seqs[i]) })
+	h.gaps++
+	h.junk += len(h.buf)
+	h.buf = h.buf[:0]
+	h.next = seqs[0]
+}
+
+// flush skips any remaining holes at the end of the capture.
+func (h *half) flush(c *conn, dir int, emit func(frameEvent)) {
+	for len(h.ooo) > 0 {
+		h.skipHole()
+		h.drain(c, dir, emit)
+	}
+}
+
+func (h *half) deliver(c *conn, dir int, data []byte, ts time.Time, emit func(frameEvent)) {
+	if len(h.buf) == 0 {
+		h.bufStart = ts
+		h.bufSeq = h.next
+	}
+	h.buf = append(h.buf, data...)
+	h.next += uint32(len(data))
+	h.bytes += len(data)
+
+	for len(h.buf) >= dubboframe.HeaderLen {
+		n, err := dubboframe.Len(h.buf)
+		if err != nil || n > maxFrame {
+			h.resync()
+			continue
+		}
+		if len(h.buf) < n {
+			return
+		}
+		f, _, err := dubboframe.Decode(h.buf[:n])
+		if err != nil {
+			h.resync()
+			continue
+		}
+		h.frames++
+		emit(frameEvent{conn: c, dir: dir, frame: f, start: h.bufStart, end: ts, seqEnd: h.bufSeq + uint32(n)})
+		h.consume(n)
+		h.bufStart = ts
+	}
+}
+
+// resync drops bytes up to the next dubbo magic.
+func (h *half) resync() {
+	i := bytes.Index(h.buf[1:], []byte{0xda, 0xbb})
+	if i < 0 {
+		h.junk += len(h.buf) - 1
+		h.consume(len(h.buf) - 1)
+		return
+	}
+	h.junk += i + 1
+	h.consume(i + 1)
+}
+
+func (h *half) consume(n int) {
+	h.buf = h.buf[:copy(h.buf, h.buf[n:])]
+	h.bufSeq += uint32(n)
+}
+
+// finish closes stalls still open at the end of the capture.
+func (c *conn) finish(end time.Time) {
+	for dir, h := range c.dirs {
+		if !h.zeroFrom.IsZero() {
+			c.stalls = append(c.stalls, stall{stalled: 1 - dir, start: h.zeroFrom, end: end, open: true})
+		}
+	}
+}
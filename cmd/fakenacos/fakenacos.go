@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"dubbo-demo/internal/fakenacos"
+)
+
+var (
+	addr      = flag.String("addr", "127.0.0.1:8848", "HTTP address; gRPC listens on the port 1000 above")
+	ttl       = flag.Duration("ttl", fakenacos.DefaultTTL, "how long an HTTP instance lasts without a beat; it is removed after twice that")
+	pushDelay = flag.Duration("push-delay", 0, "hold every push to subscribers this long")
+)
+
+// Usage: fakenacos [-addr 127.0.0.1:8848] [-ttl 15s] [-push-delay 0]
+func main() {
+	flag.Parse()
+	s, err := fakenacos.Listen(*addr, *ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *pushDelay > 0 {
+		if _, err := s.Do("push-delay " + pushDelay.String()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("fake nacos on %s, gRPC on %s, admin on http://%s/fake/\n", s.Addr(), s.GRPCAddr(), s.Addr())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	s.Close()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/config"
+	"dubbo.apache.org/dubbo-go/v3/config/generic"
+	_ "dubbo.apache.org/dubbo-go/v3/imports"
+	hessian "github.com/apache/dubbo-go-hessian2"
+
+	"dubbo-demo/api"
+	_ "dubbo-demo/internal/deadline"
+	"dubbo-demo/internal/hessianjson"
+	_ "dubbo-demo/internal/localregistry"
+	_ "dubbo-demo/internal/metrics" // keeps the metrics reporter off :9090
+	_ "dubbo-demo/internal/reqlog"
+)
+
+var (
+	iface   = flag.String("interface", "org.apache.dubbo.DubboDemoProvider.Test", "service interface")
+	method  = flag.String("method", "SayHello", "method to call")
+	group   = flag.String("group", "", "service group, defaults to the application group")
+	version = flag.String("version", "", "service version, defaults to the application version")
+	url     = flag.String("url", "", "provider URL for a direct call, e.g. dubbo://127.0.0.1:20000")
+	types   = flag.String("types", "", "comma separated Java parameter types, inferred from -args when empty")
+	args    = flag.String("args", "[]", "JSON array of arguments, or @FILE to read it from a file")
+	pojo    = flag.Bool("pojo", false, "send objects whose \"class\" is a known POJO as that POJO instead of a map")
+	timeout = flag.Duration("timeout", 10*time.Second, "request timeout")
+	wait    = flag.Duration("wait", 3*time.Second, "how long to wait for a provider to show up")
+)
+
+// pojos are the classes -pojo can build; everything else goes out as a map.
+var pojos = map[string]func() hessian.POJO{
+	(&api.DubboRequest{}).JavaClassName():  func() hessian.POJO { return &api.DubboRequest{} },
+	(&api.DubboResponse{}).JavaClassName(): func() hessian.POJO { return &api.DubboResponse{} },
+}
+
+// export DUBBO_GO_CONFIG_PATH=dubbo-client.yaml
+func main() {
+	flag.Parse()
+	hessian.RegisterPOJO(&api.DubboRequest{})
+	hessian.RegisterPOJO(&api.DubboResponse{})
+
+	values, err := parseArgs(*args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	objects := make([]hessian.Object, len(values))
+	paramTypes := make([]string, len(values))
+	for i, v := range values {
+		objects[i], paramTypes[i] = toHessian(v)
+	}
+	if *types != "" {
+		paramTypes = strings.Split(*types, ",")
+		if len(paramTypes) != len(objects) {
+			log.Fatalf("-types lists %d types for %d arguments", len(paramTypes), len(objects))
+		}
+	}
+
+	if err := config.Load(); err != nil {
+		panic(err)
+	}
+	svc, err := genericReference()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	st := time.Now()
+	res, err := svc.Invoke(ctx, *method, paramTypes, objects)
+	log.Printf("invoke %s.%s(%s) took %v\n", *iface, *method, strings.Join(paramTypes, ","), time.Since(st))
+	if err != nil {
+		log.Fatalf("invoke error: %v", err)
+	}
+
+	out, err := json.MarshalIndent(hessianjson.Value(res), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+}
+
+func genericReference() (*generic.GenericService, error) {
+	root := config.GetRootConfig()
+	rc := &config.ReferenceConfig{
+		InterfaceName:  *iface,
+		Protocol:       "dubbo",
+		Group:          *group,
+		Version:        *version,
+		URL:            *url,
+		Generic:        "true",
+		Retries:        "0",
+		RequestTimeout: timeout.String(),
+	}
+	if err := rc.Init(root); err != nil {
+		return nil, err
+	}
+	rc.GenericLoad("invoke")
+
+	for deadline := time.Now().Add(*wait); !rc.GetInvoker().IsAvailable(); {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no provider of %s available after %v", *iface, *wait)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return rc.GetRPCService().(*generic.GenericService), nil
+}
+
+func parseArgs(s string) ([]interface{}, error) {
+	data := []byte(s)
+	if strings.HasPrefix(s, "@") {
+		var err error
+		if data, err = os.ReadFile(s[1:]); err != nil {
+			return nil, err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var values []interface{}
+	if err := dec.Decode(&values); err != nil {
+		return nil, fmt.Errorf("-args must be a JSON array: %w", err)
+	}
+	return values, nil
+}
+
+// toHessian converts a decoded JSON value into what hessian should encode
+// and guesses the Java type the provider expects for it.
+func toHessian(v interface{}) (hessian.Object, string) {
+	switch v := v.(type) {
+	case nil:
+		return nil, "java.lang.Object"
+	case bool:
+		return v, "java.lang.Boolean"
+	case string:
+		return v, "java.lang.String"
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, "java.lang.Long"
+		}
+		f, _ := v.Float64()
+		return f, "java.lang.Double"
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i], _ = toHessian(v[i])
+		}
+		return list, "java.util.List"
+	case map[string]interface{}:
+		class, _ := v["class"].(string)
+		if newPOJO, ok := pojos[class]; ok && *pojo {
+			obj, err := decodePOJO(v, newPOJO())
+			if err == nil {
+				return obj, class
+			}
+			log.Printf("cannot build %s, sending a map: %v\n", class, err)
+		}
+		m := make(map[interface{}]interface{}, len(v))
+		for k, field := range v {
+			m[k], _ = toHessian(field)
+		}
+		if class != "" {
+			return m, class
+		}
+		return m, "java.util.Map"
+	default:
+		return v, "java.lang.Object"
+	}
+}
+
+func decodePOJO(v map[string]interface{}, obj hessian.POJO) (hessian.POJO, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(obj); err != nil {
+		return nil, err
+	}
+	// numbers inside interface{} fields still need to become int64/float64
+	rv := reflect.ValueOf(obj).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		if f := rv.Field(i); f.CanSet() && f.Kind() == reflect.Map && f.Type().Elem().Kind() == reflect.Interface {
+			for _, key := range f.MapKeys() {
+				if n, ok := f.MapIndex(key).Interface().(json.Number); ok {
+					converted, _ := toHessian(n)
+					f.SetMapIndex(key, reflect.ValueOf(converted))
+				}
+			}
+		}
+	}
+	return obj, nil
+}
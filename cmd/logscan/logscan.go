@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	heartbeat = flag.Duration("heartbeat", 30*time.Second, "getty heartbeat-period, to estimate the last heartbeat when debug logs are off")
+	verbose   = flag.Bool("v", false, "print timelines for every session and every process event")
+	match     = flag.String("session", "", "only report sessions whose token contains this")
+)
+
+// sessionEvent is one line about a session.
+type sessionEvent struct {
+	ts     time.Time
+	line   int
+	kind   string
+	detail string
+	stat   counters
+}
+
+// session is a getty session as seen from one log.
+type session struct {
+	source   string
+	token    string
+	side     string
+	local    string
+	remote   string
+	events   []sessionEvent
+	stat     counters // latest counters seen
+	failure  *sessionEvent
+	opened   time.Time
+	referred bool // opened is the refer time, getty logs no open for clients
+	ended    time.Time
+	how      string
+}
+
+// procEvent is a line about the process rather than a session: registry
+// notifications, shutdown, call errors.
+type procEvent struct {
+	ts     time.Time
+	kind   string
+	detail string
+	count  int
+	until  time.Time
+}
+
+// source is everything read from one log.
+type source struct {
+	name       string
+	lines      int
+	sessions   map[string]*session
+	order      []*session
+	last       *session
+	refers     map[string]time.Time // provider address to first refer time
+	heartbeats []time.Time          // debug heartbeat lines, any session
+	events     []*procEvent
+}
+
+// Usage: logscan [-heartbeat 30s] [-v] [-session TEXT] [FILE...]
+func main() {
+	flag.Parse()
+	var sources []*source
+	if flag.NArg() == 0 {
+		sources = append(sources, scan("stdin", os.Stdin))
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sources = append(sources, scan(name, f))
+		f.Close()
+	}
+	for i, s := range sources {
+		if i > 0 {
+			fmt.Println()
+		}
+		s.report(os.Stdout)
+	}
+}
+
+func scan(name string, r io.Reader) *source {
+	src := &source{name: name, sessions: map[string]*session{}, refers: map[string]time.Time{}}
+	sc := bufio.NewScanner(r)
+	// WritePkg warnings carry the whole frame as a Go literal
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	var cur *entry
+	for sc.Scan() {
+		src.lines++
+		line := strings.TrimRight(ansiRe.ReplaceAllString(sc.Text(), ""), "\r")
+		if e, ok := parseStart(line); ok {
+			if cur != nil {
+				src.entry(*cur)
+			}
+			e.line = src.lines
+			cur = &e
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if strings.HasPrefix(line, "panic: ") {
+			// a crash is its own record, stamped with the last time seen
+			src.entry(*cur)
+			cur = &entry{line: src.lines, ts: cur.ts, msg: line}
+			continue
+		}
+		cur.more = append(cur.more, line)
+	}
+	if cur != nil {
+		src.entry(*cur)
+	}
+	if err := sc.Err(); err != nil {
+		log.Printf("%s: %v\n", name, err)
+	}
+	for _, s := range src.order {
+		s.settle()
+	}
+	return src
+}
+
+func (src *source) entry(e entry) {
+	text := e.text()
+	if src.sessionEntry(e, text) {
+		return
+	}
+	src.procEntry(e, text)
+}
+
+// sessionEntry attributes the entry to a session if it names one, by token
+// or by the addresses of a net.OpError.
+func (src *source) sessionEntry(e entry, text string) bool {
+	kind := classify(e.msg)
+	ev := sessionEvent{ts: e.ts, line: e.line, kind: kind, stat: parseCounters(e.msg)}
+	var s *session
+	if m := tokenRe.FindStringSubmatch(e.msg); m != nil {
+		s = src.session(m[0], m[2], m[4], m[5])
+	} else if m := opRe.FindStringSubmatch(text); m != nil {
+		s = src.byAddr(m[2], m[3])
+		switch {
+		case kind != evLog:
+		case strings.HasPrefix(e.msg, "panic:"):
+			ev.kind = evPanic
+		default:
+			// a call or client error quoting the session's net.OpError
+			ev.kind = evCallFailed
+		}
+	} else if partRe.MatchString(e.msg) {
+		// logged right after the WritePkg warning, without a token
+		s, ev.kind = src.last, evPartial
+	} else if strings.Contains(e.msg, "session-closed") && kind != evLog {
+		// getty prints "session-closed" instead of the token once the
+		// connection is gone; the session is the one that just exited
+		s = src.closing()
+	}
+	if s == nil {
+		return false
+	}
+	ev.detail = detail(ev.kind, text)
+	s.events = append(s.events, ev)
+	if ev.stat.ok {
+		s.stat = ev.stat
+	}
+	src.last = s
+	return true
+}
+
+func (src *source) session(token, side, local, remote string) *session {
+	key := token
+	if s := src.sessions[key]; s != nil {
+		return s
+	}
+	s := &session{source: src.name, token: token, side: strings.ToLower(strings.SplitN(side, "_", 2)[1]), local: local, remote: remote}
+	src.sessions[key] = s
+	src.order = append(src.order, s)
+	return s
+}
+
+// byAddr finds the session on local->remote, creating an anonymous one if
+// the log never printed its token.
+func (src *source) byAddr(local, remote string) *session {
+	for i := len(src.order) - 1; i >= 0; i-- {
+		if s := src.order[i]; s.local == local && s.remote == remote {
+			return s
+		}
+	}
+	side := "UNKNOWN"
+	if _, ok := src.refers[remote]; ok {
+		side = "CLIENT"
+	}
+	return src.session("{tcp:TCP_"+side+":?:"+local+"<->"+remote+"}", "TCP_"+side, local, remote)
+}
+
+// closing picks the session a "session-closed" line belongs to: the latest
+// one that exited and has not been seen closing yet.
+func (src *source) closing() *session {
+	for i := len(src.order) - 1; i >= 0; i-- {
+		s := src.order[i]
+		var exited, closed bool
+		for _, ev := range s.events {
+			switch ev.kind {
+			case evExit, evEOF, evReadError, evWriteError:
+				exited = true
+			case evClosing:
+				closed = true
+			}
+		}
+		if exited && !closed {
+			return s
+		}
+	}
+	return src.last
+}
+
+// procEntry keeps the process-wide lines worth having on the timeline.
+func (src *source) procEntry(e entry, text string) {
+	msg := e.msg
+	var kind, what string
+	switch {
+	case strings.Contains(msg, "heartbeat request"), strings.Contains(msg, "heartbeat response"):
+		src.heartbeats = append(src.heartbeats, e.ts)
+		return
+	case strings.Contains(msg, "failed to send heartbeat"):
+		kind, what = "heartbeat", detail(evError, msg)
+	case referRe.MatchString(msg):
+		addr := referRe.FindStringSubmatch(msg)[1]
+		if _, ok := src.refers[addr]; !ok {
+			src.refers[addr] = e.ts
+		}
+		if !strings.Contains(msg, "selector add") {
+			return
+		}
+		kind, what = "registry", "provider added: "+addr
+	case dropRe.MatchString(msg):
+		kind, what = "registry", "provider removed: "+dropRe.FindStringSubmatch(msg)[1]
+	case isRegistry(e.caller):
+		kind, what = "registry", shorten(msg)
+	case strings.Contains(e.caller, "graceful_shutdown"), strings.HasPrefix(msg, "got signal"):
+		kind, what = "shutdown", shorten(msg)
+	case strings.HasPrefix(msg, "lifecycle:"):
+		// cmd/server's stage changes
+		kind, what = "lifecycle", shorten(strings.TrimPrefix(msg, "lifecycle: "))
+	case strings.HasPrefix(msg, "breaker:"):
+		// circuit breaker transitions in cmd/client
+		kind, what = "breaker", shorten(strings.TrimPrefix(msg, "breaker: "))
+	case classRe.MatchString(msg):
+		kind, what = "call-error", classRe.FindStringSubmatch(msg)[0]
+	case strings.HasPrefix(msg, "client response result"):
+		kind, what = "call-ok", "client response result"
+	case strings.Contains(msg, "net.DialTimeout"):
+		kind, what = "dial-error", detail(evError, msg)
+	case strings.HasPrefix(msg, "panic:"):
+		kind, what = "panic", shorten(msg)
+	case e.level == "ERROR" || e.level == "WARN":
+		if !*verbose {
+			return
+		}
+		kind, what = strings.ToLower(e.level), shorten(msg)
+	default:
+		return
+	}
+	if n := len(src.events); n > 0 {
+		if last := src.events[n-1]; last.kind == kind && last.detail == what {
+			last.count++
+			last.until = e.ts
+			return
+		}
+	}
+	src.events = append(src.events, &procEvent{ts: e.ts, kind: kind, detail: what, count: 1, until: e.ts})
+}
+
+func isRegistry(caller string) bool {
+	for _, p := range []string{"nacos/", "localregistry/", "directory/", "zookeeper/", "etcdv3/", "servicediscovery/", "registry/"} {
+		if strings.HasPrefix(caller, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// settle works out when the session started and how it ended.
+func (s *session) settle() {
+	sort.SliceStable(s.events, func(i, j int) bool { return s.events[i].line < s.events[j].line })
+	for i := range s.events {
+		ev := &s.events[i]
+		if ev.kind == evOpen && s.opened.IsZero() {
+			s.opened = ev.ts
+		}
+		if failures[ev.kind] && s.failure == nil {
+			s.failure = ev
+		}
+	}
+	last := s.events[len(s.events)-1]
+	s.how = "open at end of log"
+	for _, ev := range s.events {
+		if ev.kind == evEOF || ev.kind == evExit || ev.kind == evClosing {
+			s.ended, s.how = ev.ts, "closed"
+			if ev.kind == evEOF {
+				s.how = "closed by peer"
+			}
+			break
+		}
+	}
+	if s.failure != nil {
+		s.ended, s.how = s.failure.ts, s.failure.kind
+		if s.failure.detail != "" {
+			s.how += ": " + s.failure.detail
+		}
+	} else if s.ended.IsZero() {
+		s.ended = last.ts
+	}
+}
+
+// heartbeatGap says how long before the failure the last heartbeat went
+// out, from debug lines when the log has them, otherwise from the period.
+func (src *source) heartbeatGap(s *session) string {
+	if s.failure == nil {
+		return ""
+	}
+	at := s.failure.ts
+	if len(src.heartbeats) > 0 {
+		var last time.Time
+		for _, t := range src.heartbeats {
+			if !t.After(at) {
+				last = t
+			}
+		}
+		if last.IsZero() {
+			return "none logged"
+		}
+		return at.Sub(last).String()
+	}
+	if s.opened.IsZero() || *heartbeat <= 0 {
+		return "unknown"
+	}
+	age := at.Sub(s.opened)
+	if age < *heartbeat {
+		return "none yet (~" + age.String() + " old)"
+	}
+	return "~" + (age % *heartbeat).String()
+}
+
+func (src *source) report(w io.Writer) {
+	var shown []*session
+	failed := 0
+	for _, s := range src.order {
+		if !s.opened.IsZero() || s.side != "client" {
+			continue
+		}
+		// getty logs nothing when a client session opens; dubbo-go dials
+		// when it refers the provider, so that is the best start we have
+		if t, ok := src.refers[s.remote]; ok && !t.After(s.events[0].ts) {
+			s.opened, s.referred = t, true
+		}
+	}
+	for _, s := range src.order {
+		if *match != "" && !strings.Contains(s.token, *match) {
+			continue
+		}
+		if s.failure != nil {
+			failed++
+		}
+		shown = append(shown, s)
+	}
+	fmt.Fprintf(w, "%s: %d lines, %d sessions, %d failed\n", src.name, src.lines, len(shown), failed)
+
+	if len(shown) > 0 {
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SESSION\tSIDE\tOPENED\tENDED\tLIFETIME\tPKGS R/W\tBYTES R/W\tSINCE HEARTBEAT\tOUTCOME")
+		for _, s := range shown {
+			opened, lifetime := "?", "?"
+			if !s.opened.IsZero() {
+				opened = s.opened.Format("15:04:05")
+				if s.referred {
+					opened = "~" + opened
+				}
+				lifetime = s.ended.Sub(s.opened).String()
+			}
+			pkgs, bytes := "?", "?"
+			if s.stat.ok {
+				pkgs = fmt.Sprintf("%d/%d", s.stat.ReadPkgs, s.stat.WritePkgs)
+				bytes = fmt.Sprintf("%d/%d", s.stat.ReadBytes, s.stat.WriteBytes)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.token, s.side, opened, s.ended.Format("15:04:05"),
+				lifetime, pkgs, bytes, src.heartbeatGap(s), s.how)
+		}
+		tw.Flush()
+	}
+
+	for _, s := range shown {
+		if s.failure == nil && !*verbose {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\n", s.token)
+		if s.referred {
+			fmt.Fprintf(w, "  %s  %-15s provider %s referred\n", s.opened.Format("15:04:05"), evReferred, s.remote)
+		}
+		for _, ev := range s.events {
+			stat := ""
+			if ev.stat.ok {
+				stat = fmt.Sprintf("  [pkgs %d/%d bytes %d/%d]", ev.stat.ReadPkgs, ev.stat.WritePkgs, ev.stat.ReadBytes, ev.stat.WriteBytes)
+			}
+			fmt.Fprintf(w, "  %s  %-15s %s%s\n", ev.ts.Format("15:04:05"), ev.kind, ev.detail, stat)
+		}
+	}
+
+	if len(src.events) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "process events:")
+		for _, ev := range src.events {
+			if ev.kind == "call-ok" && !*verbose {
+				continue
+			}
+			repeat := ""
+			if ev.count > 1 {
+				repeat = fmt.Sprintf(" (x%d until %s)", ev.count, ev.until.Format("15:04:05"))
+			}
+			fmt.Fprintf(w, "  %s  %-15s %s%s\n", ev.ts.Format("15:04:05"), ev.kind, ev.detail, repeat)
+		}
+	}
+}
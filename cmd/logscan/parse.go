@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ansiRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	// timestamps of the dubbo-go logger (2024-01-09 20:40:42), the nacos sdk
+	// (2024-01-09T20:40:42.813+0800) and the standard library (2024/01/09 20:40:46)
+	tsRe    = regexp.MustCompile(`^(\d{4}[-/]\d{2}[-/]\d{2})[ T](\d{2}:\d{2}:\d{2}(?:\.\d+)?)(?:Z|[+-]\d{2}:?\d{2})?\s+(.*)$`)
+	levelRe = regexp.MustCompile(`^(DEBUG|INFO|WARN|ERROR|DPANIC|PANIC|FATAL)\s+(\S+)\s+(.*)$`)
+
+	tokenRe = regexp.MustCompile(`\{(\w+):([A-Z]+_(?:CLIENT|SERVER)):(\d+):([^<>{}\s]+)<->([^<>{}\s,]+)\}`)
+	statRe  = regexp.MustCompile(`Read Bytes: (\d+), Write Bytes: (\d+), Read Pkgs: (\d+), Write Pkgs: (\d+)`)
+	// net.OpError text, e.g. "write tcp 10.0.0.1:17947->10.0.0.2:20000: i/o timeout"
+	opRe     = regexp.MustCompile(`(read|write) tcp ((?:\[[0-9a-fA-F:.%\w]+\]|[\d.]+):\d+)->((?:\[[0-9a-fA-F:.%\w]+\]|[\d.]+):\d+): ([^\n\]}".;,]+)`)
+	referRe  = regexp.MustCompile(`(?:Refer service: |selector add service url\{)dubbo://(?:[^@/]*@)?([^/?]+)`)
+	dropRe   = regexp.MustCompile(`selector delete service url\{dubbo://(?:[^@/]*@)?([^/?]+)`)
+	partRe   = regexp.MustCompile(`start to close the session at (\w+) because (\d+) of (\d+) bytes`)
+	errTail  = regexp.MustCompile(`(?:err|error)[:{=]\s*([^\n]*)`)
+	classRe  = regexp.MustCompile(`client call error \[(\w+)\]`)
+	urlQuery = regexp.MustCompile(`(\w+://[^\s?{}]*)\?[^\s{}]*`)
+)
+
+// entry is one log record: a timestamped line and any continuation lines
+// (stack traces, panics) that follow it.
+type entry struct {
+	line   int
+	ts     time.Time
+	level  string
+	caller string
+	msg    string
+	more   []string
+}
+
+// parseStart returns the entry a line starts, or false for a continuation.
+func parseStart(line string) (entry, bool) {
+	if strings.HasPrefix(line, "{") {
+		return parseJSON(line)
+	}
+	m := tsRe.FindStringSubmatch(line)
+	if m == nil {
+		return entry{}, false
+	}
+	layout := "2006-01-02 15:04:05"
+	if strings.Contains(m[1], "/") {
+		layout = "2006/01/02 15:04:05"
+	}
+	// zones are dropped: every logger here writes local wall time and
+	// comparing wall clocks is what lines up a client log with a server log
+	ts, err := time.Parse(layout, m[1]+" "+m[2])
+	if err != nil {
+		return entry{}, false
+	}
+	e := entry{ts: ts, msg: m[3]}
+	if l := levelRe.FindStringSubmatch(m[3]); l != nil {
+		e.level, e.caller, e.msg = l[1], l[2], l[3]
+	}
+	return e, true
+}
+
+// parseJSON parses a request log line, e.g.
+// {"level":"INFO","time":"2024-01-09 20:40:42.813","line":"reqlog/reqlog.go:140","msg":"call","request_id":"..."}.
+// The fields besides those four follow the message as key=value, sorted.
+func parseJSON(line string) (entry, bool) {
+	var rec map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&rec); err != nil {
+		return entry{}, false
+	}
+	ts, err := time.Parse("2006-01-02 15:04:05.000", fmt.Sprint(rec["time"]))
+	if err != nil {
+		return entry{}, false
+	}
+	e := entry{ts: ts}
+	e.level, _ = rec["level"].(string)
+	e.caller, _ = rec["line"].(string)
+	e.msg, _ = rec["msg"].(string)
+	for _, k := range []string{"time", "level", "line", "msg"} {
+		delete(rec, k)
+	}
+	keys := make([]string, 0, len(rec))
+	for k := range rec {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e.msg += fmt.Sprintf(" %s=%v", k, rec[k])
+	}
+	return e, true
+}
+
+// text is the entry with its continuation lines, for pattern matching.
+func (e entry) text() string {
+	if len(e.more) == 0 {
+		return e.msg
+	}
+	return e.msg + "\n" + strings.Join(e.more, "\n")
+}
+
+// counters are the getty session counters printed by session.Stat().
+type counters struct {
+	ReadBytes, WriteBytes, ReadPkgs, WritePkgs int64
+	ok                                         bool
+}
+
+func parseCounters(s string) counters {
+	m := statRe.FindStringSubmatch(s)
+	if m == nil {
+		return counters{}
+	}
+	var c counters
+	c.ReadBytes, _ = strconv.ParseInt(m[1], 10, 64)
+	c.WriteBytes, _ = strconv.ParseInt(m[2], 10, 64)
+	c.ReadPkgs, _ = strconv.ParseInt(m[3], 10, 64)
+	c.WritePkgs, _ = strconv.ParseInt(m[4], 10, 64)
+	c.ok = true
+	return c
+}
+
+// Session event kinds. The failure kinds are the ones a session does not
+// come back from.
+const (
+	evOpen        = "open"
+	evReferred    = "referred"
+	evWriteError  = "write-error"
+	evReadError   = "read-error"
+	evError       = "error"
+	evIdleTimeout = "idle-timeout"
+	evPartial     = "partial-write"
+	evHandleError = "handle-error"
+	evPanic       = "panic"
+	evEOF         = "peer-closed"
+	evExit        = "exit"
+	evClosing     = "closing"
+	evCloseAsked  = "close-requested"
+	evCallFailed  = "call-failed"
+	evLog         = "log"
+)
+
+var failures = map[string]bool{
+	evWriteError:  true,
+	evReadError:   true,
+	evError:       true,
+	evIdleTimeout: true,
+	evPartial:     true,
+	evHandleError: true,
+	evPanic:       true,
+}
+
+// classify names what a session line says about its session.
+func classify(msg string) string {
+	switch {
+	case strings.Contains(msg, "got session:"):
+		return evOpen
+	case strings.Contains(msg, "[session.WritePkg]"):
+		return evWriteError
+	case strings.Contains(msg, "[session.conn.read] = error"):
+		return evReadError
+	case strings.Contains(msg, "read EOF"):
+		return evEOF
+	case strings.Contains(msg, "got error{"), strings.Contains(msg, "[OnOpen]"):
+		return evError
+	case strings.Contains(msg, "timeout{") && strings.Contains(msg, "reqNum{"):
+		return evIdleTimeout
+	case strings.Contains(msg, "[session.handlePackage] error"), strings.Contains(msg, "[session.handleTCPPackage]"),
+		strings.Contains(msg, "[session.handlePackage] panic"):
+		return evHandleError
+	case strings.Contains(msg, "gr will exit now"):
+		return evExit
+	case strings.Contains(msg, "is closing"), strings.Contains(msg, "closed now"):
+		return evClosing
+	case strings.Contains(msg, "closing session "):
+		// cmd/server's close fault
+		return evCloseAsked
+	case strings.HasPrefix(msg, "panic:"):
+		return evPanic
+	}
+	return evLog
+}
+
+// detail is the short human part of a session line: the error if there is
+// one, without the frame dump getty prints before it.
+func detail(kind, text string) string {
+	if m := opRe.FindStringSubmatch(text); m != nil {
+		return m[1] + ": " + strings.TrimSpace(m[4])
+	}
+	if m := partRe.FindStringSubmatch(text); m != nil {
+		return m[2] + " of " + m[3] + " bytes sent at " + m[1]
+	}
+	switch kind {
+	case evOpen, evExit, evClosing, evEOF:
+		return ""
+	}
+	first := strings.SplitN(text, "\n", 2)[0]
+	if ms := errTail.FindAllStringSubmatch(first, -1); ms != nil {
+		return shorten(ms[len(ms)-1][1])
+	}
+	first = tokenRe.ReplaceAllString(first, "")
+	first = statRe.ReplaceAllString(first, "")
+	return shorten(strings.Trim(first, " ,{}"))
+}
+
+// shorten drops URL query strings and caps the length of a message.
+func shorten(s string) string {
+	s = urlQuery.ReplaceAllString(s, "$1")
+	s = strings.TrimSpace(s)
+	if len(s) > 160 {
+		s = s[:157] + "..."
+	}
+	return s
+}
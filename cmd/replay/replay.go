@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/config"
+	_ "dubbo.apache.org/dubbo-go/v3/imports"
+	hessian "github.com/apache/dubbo-go-hessian2"
+
+	"dubbo-demo/api"
+	_ "dubbo-demo/internal/deadline"
+	"dubbo-demo/internal/failure"
+	"dubbo-demo/internal/loadgen"
+	_ "dubbo-demo/internal/localregistry"
+	_ "dubbo-demo/internal/metrics" // keeps the metrics reporter off :9090
+	"dubbo-demo/internal/record"
+	"dubbo-demo/internal/reqlog"
+)
+
+var (
+	input = flag.String("f", "requests.jsonl", "recording written by cmd/client -record")
+	speed = flag.Float64("speed", 1, "replay speed-up over the recorded pacing, 0 sends back to back")
+)
+
+// export DUBBO_GO_CONFIG_PATH=dubbo-client.yaml
+func main() {
+	flag.Parse()
+	entries, err := record.ReadFile(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(entries) == 0 {
+		log.Fatalf("%s: no recorded calls", *input)
+	}
+
+	config.SetConsumerService(dubboDemoImpl)
+	hessian.RegisterPOJO(&api.DubboRequest{})
+	hessian.RegisterPOJO(&api.DubboResponse{})
+
+	if err := config.Load(); err != nil {
+		panic(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("replay: %d calls from %s at speed %v\n", len(entries), *input, *speed)
+	stats := loadgen.NewStats(func(err error) string { return failure.Classify(err).String() })
+	replay(ctx, entries, stats)
+	stats.Stop()
+	stats.Report(os.Stdout)
+}
+
+var dubboDemoImpl = new(api.DubboDemoProvider)
+
+// replayOfKey is the attachment holding the request ID of the recorded call
+// a replayed call repeats.
+const replayOfKey = "demo-replay-of"
+
+// replay fires every entry at its recorded offset from the first one, scaled
+// by speed. Calls run in their own goroutines so that overlapping calls in the
+// recording overlap again.
+func replay(ctx context.Context, entries []record.Entry, stats *loadgen.Stats) {
+	var wg sync.WaitGroup
+	origin := entries[0].Time
+	start := time.Now()
+	for i := range entries {
+		e := entries[i]
+		if *speed > 0 {
+			at := start.Add(time.Duration(float64(e.Time.Sub(origin)) / *speed))
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(at)):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the recorded request ID belongs to the original call; the
+			// reqlog filter gives the replayed one its own
+			attachments := make(map[string]interface{}, len(e.Attachments))
+			for k, v := range e.Attachments {
+				attachments[k] = v
+			}
+			origID, _ := attachments[reqlog.IDKey].(string)
+			delete(attachments, reqlog.IDKey)
+			if origID != "" {
+				attachments[replayOfKey] = origID
+			}
+			callCtx := context.WithValue(context.Background(), constant.AttachmentKey, attachments)
+
+			st := time.Now()
+			_, err := dubboDemoImpl.SayHello(callCtx, &api.DubboRequest{Request: e.Request})
+			stats.Observe(time.Since(st), err)
+			if err != nil {
+				log.Printf("replay call error [%s]: %s (recorded %s %s)\n",
+					failure.Classify(err), failure.Summary(err), e.Outcome, e.Class)
+				return
+			}
+			if e.Outcome != record.OutcomeOK {
+				log.Printf("replay call succeeded, recorded %s %s\n", e.Outcome, e.Class)
+			}
+		}()
+	}
+	wg.Wait()
+}
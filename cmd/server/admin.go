@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/config"
+	"dubbo.apache.org/dubbo-go/v3/registry"
+
+	"dubbo-demo/internal/flightrec"
+	"dubbo-demo/internal/metrics"
+	"dubbo-demo/internal/sessions"
+)
+
+// serviceStatus is one provider service and the URLs it is exported on.
+type serviceStatus struct {
+	Name     string   `json:"name"`
+	Exported bool     `json:"exported"`
+	URLs     []string `json:"urls"`
+}
+
+// registryStatus is one registry the provider registered with.
+type registryStatus struct {
+	URL       string `json:"url"`
+	Available bool   `json:"available"`
+}
+
+// serveAdmin starts the admin listener on addr. Every page is JSON:
+//
+//	/          everything below in one document
+//	/calls     in-flight SayHello calls and their age
+//	/sessions  getty sessions with their byte and packet counters
+//	/services  exported services and registry status
+//	/ready     200 once ready, 503 while starting or shutting down
+//	/metrics   Prometheus metrics, as on -metrics
+//
+// GET /flightrec?trace=3s dumps goroutines, heap, the last session log lines
+// and a runtime trace of the given length, and answers with the dump as a
+// tar.gz; see flightrec.
+//
+// POST /cmd runs a slow reader command from the body on the sessions from
+// ?remote=ADDR, or on every accepted session; see slowReaders.do.
+func serveAdmin(addr string, lc *lifecycle) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"stage":      lc.Stage().String(),
+			"uptime":     time.Since(lc.started).Round(time.Second).String(),
+			"goroutines": runtime.NumGoroutine(),
+			"calls":      lc.Calls(),
+			"sessions":   sessions.ServerStats(),
+			"slow_reads": slowReads.status(),
+			"services":   services(),
+			"registries": registries(),
+		})
+	})
+	mux.HandleFunc("/calls", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, lc.Calls())
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, sessions.ServerStats())
+	})
+	mux.HandleFunc("/cmd", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a command", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("admin: %s\n", strings.TrimSpace(string(body)))
+		result, err := slowReads.do(string(body), r.URL.Query().Get("remote"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]string{"result": result})
+	})
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/flightrec", serveFlightRecord)
+	mux.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"services":   services(),
+			"registries": registries(),
+		})
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if lc.Stage() != StageReady {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, map[string]string{"stage": lc.Stage().String()})
+	})
+
+	log.Printf("admin listening on %s\n", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("admin listener stopped: %v\n", err)
+		}
+	}()
+}
+
+func serveFlightRecord(w http.ResponseWriter, r *http.Request) {
+	traceFor := 3 * time.Second
+	if s := r.URL.Query().Get("trace"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		traceFor = d
+	}
+	dir := *flightDir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "flightrec")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	rec, err := flightrec.New(dir, traceFor, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin: flight record with %v of trace\n", traceFor)
+	dump, err := rec.Dump("admin", traceFor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(dump)+`.tar.gz"`)
+	if err := flightrec.WriteArchive(w, dump); err != nil {
+		log.Printf("admin write error: %v\n", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Printf("admin write error: %v\n", err)
+	}
+}
+
+func services() []serviceStatus {
+	var out []serviceStatus
+	provider := config.GetProviderConfig()
+	if provider == nil {
+		return out
+	}
+	for name, svc := range provider.Services {
+		st := serviceStatus{Name: name, Exported: svc.IsExport()}
+		for _, u := range svc.GetExportedUrls() {
+			st.URLs = append(st.URLs, u.String())
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// registries lists the registries dubbo-go still holds. They are dropped on
+// deregistration, so the list is empty once shutdown has begun.
+func registries() []registryStatus {
+	out := []registryStatus{}
+	factory, ok := extension.GetProtocol(constant.RegistryProtocol).(registry.RegistryFactory)
+	if !ok {
+		return out
+	}
+	for _, reg := range factory.GetRegistries() {
+		out = append(out, registryStatus{URL: reg.GetURL().Protocol + "://" + reg.GetURL().Location, Available: reg.IsAvailable()})
+	}
+	return out
+}
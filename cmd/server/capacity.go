@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+
+	"dubbo-demo/internal/reqlog"
+	"dubbo-demo/internal/tracing"
+)
+
+// slots is the capacity -capacity gives the provider: how many SayHello calls
+// do their cost at once. The others queue for a slot, so a provider with less
+// capacity answers the same load more slowly, the way a smaller machine
+// would. nil slots never queue.
+type slots struct {
+	free   chan struct{}
+	queued atomic.Int64
+}
+
+func newSlots(capacity int) *slots {
+	if capacity <= 0 {
+		return nil
+	}
+	return &slots{free: make(chan struct{}, capacity)}
+}
+
+// Queued is how many calls are waiting for a slot.
+func (s *slots) Queued() int {
+	if s == nil {
+		return 0
+	}
+	return int(s.queued.Load())
+}
+
+// take waits for a slot, giving up once the consumer's deadline has passed
+// like sleep does, and returns the func that frees it. A wait is traced as a
+// "SayHello queue" span.
+func (s *slots) take(ctx context.Context) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release = func() { <-s.free }
+	select {
+	case s.free <- struct{}{}:
+		return release, nil
+	default:
+	}
+	s.queued.Add(1)
+	defer s.queued.Add(-1)
+	_, span := tracing.Start(ctx, "SayHello queue", attribute.Int("demo.capacity", cap(s.free)))
+	defer span.End()
+	select {
+	case s.free <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		reqlog.From(ctx).Warn("SayHello abandoned", zap.String("during", "queue"), zap.Error(ctx.Err()))
+		span.SetStatus(codes.Error, ctx.Err().Error())
+		return nil, fmt.Errorf("abandoned waiting for one of %d slots: %w", cap(s.free), ctx.Err())
+	}
+}
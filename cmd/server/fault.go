@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"github.com/apache/dubbo-go-hessian2/java_exception"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+
+	"dubbo-demo/internal/reqlog"
+	"dubbo-demo/internal/sessions"
+)
+
+// Request keys understood by SayHello besides cost. Each one is optional and
+// they combine, e.g. cost=1s plus stall=5s answers after six seconds.
+const (
+	keyError     = "error"     // fail with this message
+	keyException = "exception" // fail with this Java exception class, message from error
+	keyPanic     = "panic"     // panic in the handler, dubbo-go turns it into an error
+	keyCrash     = "crash"     // panic off the handler goroutine, killing the provider
+	keySize      = "size"      // pad the response body to this many bytes, e.g. 4mib
+	keyStall     = "stall"     // sleep this long after the response is built
+	keyClose     = "close"     // close the consumer's session instead of answering
+	keyPauseRead = "pauseread" // answer, then stop reading the consumer's session this long
+)
+
+// fault holds the fault keys of one request.
+type fault struct {
+	err   error
+	panic string
+	crash string
+	size  uint64
+	stall time.Duration
+	close bool
+	pause time.Duration
+}
+
+func parseFault(req map[string]interface{}) (*fault, error) {
+	f := &fault{}
+	msg, _ := req[keyError].(string)
+	if class, _ := req[keyException].(string); class != "" {
+		if msg == "" {
+			msg = "injected by request"
+		}
+		f.err = javaException(class, msg)
+	} else if msg != "" {
+		f.err = errors.New(msg)
+	}
+	f.panic, _ = req[keyPanic].(string)
+	f.crash, _ = req[keyCrash].(string)
+	if s, _ := req[keySize].(string); s != "" {
+		n, err := humanize.ParseBytes(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q: %w", keySize, s, err)
+		}
+		f.size = n
+	}
+	if s, _ := req[keyStall].(string); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q: %w", keyStall, s, err)
+		}
+		f.stall = d
+	}
+	if s, _ := req[keyPauseRead].(string); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q: %w", keyPauseRead, s, err)
+		}
+		f.pause = d
+	}
+	if s, _ := req[keyClose].(string); s != "" && s != "false" {
+		f.close = true
+	}
+	return f, nil
+}
+
+// javaException builds an exception the consumer decodes as the given Java
+// class. Common short names such as IllegalStateException are accepted.
+func javaException(class, msg string) error {
+	switch strings.TrimPrefix(class, "java.lang.") {
+	case "Exception":
+		return java_exception.NewException(msg)
+	case "RuntimeException":
+		return java_exception.NewRuntimeException(msg)
+	case "IllegalStateException":
+		return java_exception.NewIllegalStateException(msg)
+	case "IllegalArgumentException":
+		return java_exception.NewIllegalArgumentException(msg)
+	case "NullPointerException":
+		return java_exception.NewNullPointerException(msg)
+	case "UnsupportedOperationException":
+		return java_exception.NewUnsupportedOperationException(msg)
+	}
+	return java_exception.NewDubboGenericException(class, msg)
+}
+
+// apply runs the faults that replace a normal answer. It returns the error to
+// answer with, if any.
+func (f *fault) apply(ctx context.Context) error {
+	if f.crash != "" {
+		reqlog.From(ctx).Error("crash requested", zap.String("crash", f.crash))
+		go func() { panic("injected crash: " + f.crash) }()
+		select {}
+	}
+	if f.panic != "" {
+		panic("injected panic: " + f.panic)
+	}
+	if f.close {
+		remote := remoteAddr(ctx)
+		s := sessions.ServerByRemote(remote)
+		if s == nil {
+			return fmt.Errorf("no session from %q to close", remote)
+		}
+		reqlog.From(ctx).Warn("closing session", zap.String("session", s.Stat()))
+		s.Close()
+		return errors.New("session closed by request")
+	}
+	if f.pause > 0 {
+		// the pause starts now, but the response is written on another
+		// goroutine and is not held up by it
+		if _, err := slowReads.do("pause "+f.pause.String(), remoteAddr(ctx)); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+// body pads msg with dots up to the requested size.
+func (f *fault) body(msg string) []byte {
+	if uint64(len(msg)) >= f.size {
+		return []byte(msg)
+	}
+	b := make([]byte, f.size)
+	copy(b, msg)
+	for i := len(msg); i < len(b); i++ {
+		b[i] = '.'
+	}
+	return b
+}
+
+func remoteAddr(ctx context.Context) string {
+	attachments, _ := ctx.Value(constant.AttachmentKey).(map[string]interface{})
+	addr, _ := attachments[constant.RemoteAddr].(string)
+	return addr
+}
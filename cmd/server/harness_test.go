@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common"
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/config"
+	"dubbo.apache.org/dubbo-go/v3/registry"
+	hessian "github.com/apache/dubbo-go-hessian2"
+
+	"dubbo-demo/api"
+	"dubbo-demo/internal/failure"
+	"dubbo-demo/internal/tracing"
+)
+
+// requestTimeout is the consumer's request-timeout in the harness. It is
+// short so timeout scenarios finish quickly, but well above what a call
+// costs on a loaded CI machine.
+const requestTimeout = time.Second
+
+// harnessConfig is a provider and a consumer of DubboDemoProvider in one
+// process. They find each other through the memory registry, so nothing
+// outside the test binary is needed.
+const harnessConfig = `dubbo:
+  application:
+    name: dubbo-demo-e2e
+  logger:
+    level: warn
+  registries:
+    local:
+      protocol: memory
+      address: %s
+      registry-type: interface
+      use-as-meta-report: false
+      use-as-config-center: false
+  shutdown:
+    internal-signal: false
+    timeout: 10s
+    step-timeout: 100ms
+    consumer-update-wait-time: 200ms
+  protocols:
+    dubbo:
+      name: dubbo
+      ip: 127.0.0.1
+      port: %d
+  provider:
+    filter: sessions-provider,echo,tracing-provider,otelServerTrace,reqlog-provider,metrics,padasvc,token,accesslog,tps,generic_service,execute,pshutdown,deadline-provider
+    services:
+      DubboDemoProvider:
+        interface: org.apache.dubbo.DubboDemoProvider.Test
+  consumer:
+    filter: otelClientTrace,reqlog-consumer,deadline-consumer
+    filter-conf:
+      breaker: # for references listing sentinel-consumer,breaker, see TestBreaker
+        SayHello:
+          strategy: error-count
+          threshold: 3
+          min-requests: 3
+          window: 10s
+          open-for: 500ms
+    request-timeout: %v
+    check: false
+    references:
+      DubboDemoProvider:
+        protocol: dubbo
+        interface: org.apache.dubbo.DubboDemoProvider.Test
+        retries: 0
+`
+
+// spawnedConfig is a provider on its own, without a registry, for
+// spawnProvider.
+const spawnedConfig = `dubbo:
+  application:
+    name: dubbo-demo-e2e-spawned
+  logger:
+    level: warn
+  shutdown:
+    internal-signal: false
+    timeout: 10s
+    step-timeout: 100ms
+    consumer-update-wait-time: 0s
+  protocols:
+    dubbo:
+      name: dubbo
+      ip: 127.0.0.1
+      port: %d
+  provider:
+    filter: sessions-provider,echo,tracing-provider,otelServerTrace,reqlog-provider,metrics,padasvc,token,accesslog,tps,generic_service,execute,pshutdown,deadline-provider
+    services:
+      DubboDemoProvider:
+        interface: org.apache.dubbo.DubboDemoProvider.Test
+`
+
+// providerEnv set makes the test binary run cmd/server's main instead of
+// the tests; see spawnProvider.
+const providerEnv = "DUBBO_DEMO_E2E_PROVIDER"
+
+// harness is the provider/consumer pair every scenario runs against.
+// dubbo-go's config is global and loads once, so there is one harness per
+// test binary, started by TestMain.
+type harness struct {
+	lc       *lifecycle
+	provider *DubboDemoProvider
+	consumer *api.DubboDemoProvider
+	trace    *tracing.Provider // every call is traced
+
+	mu      sync.Mutex
+	service *config.ServiceConfig // the current export
+}
+
+var h *harness
+
+func TestMain(m *testing.M) {
+	if os.Getenv(providerEnv) != "" {
+		main()
+		return
+	}
+	dir, err := os.MkdirTemp("", "dubbo-demo-e2e")
+	if err != nil {
+		log.Fatal(err)
+	}
+	h, err = startHarness(dir)
+	if err != nil {
+		log.Fatalf("harness: %v", err)
+	}
+	code := m.Run()
+	h.lc.Stop()
+	h.trace.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startHarness writes the harness config into dir and loads it, exporting
+// the provider and referring the consumer.
+func startHarness(dir string) (*harness, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	namespace := "e2e-" + strconv.Itoa(os.Getpid())
+	path := filepath.Join(dir, "dubbogo.yaml")
+	yaml := fmt.Sprintf(harnessConfig, namespace, port, requestTimeout)
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		return nil, err
+	}
+	os.Setenv(constant.ConfigFileEnvKey, path)
+	tp, err := tracing.Setup(filepath.Join(dir, "trace.jsonl"), "dubbo-demo-e2e", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &harness{
+		lc:       newLifecycle(),
+		consumer: &api.DubboDemoProvider{},
+		trace:    tp,
+	}
+	h.provider = &DubboDemoProvider{lc: h.lc}
+	config.SetProviderService(h.provider)
+	config.SetConsumerService(h.consumer)
+	hessian.RegisterPOJO(&api.DubboRequest{})
+	hessian.RegisterPOJO(&api.DubboResponse{})
+	if err := h.lc.Start(0); err != nil {
+		return nil, err
+	}
+	h.service = config.GetProviderConfig().Services["DubboDemoProvider"]
+
+	// the consumer subscribes before the provider registers; wait until the
+	// two have found each other
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// freePort returns a TCP port nothing is listening on right now.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// call makes one SayHello call that costs the provider cost, plus any
+// fault keys from cmd/server's fault.go.
+func (h *harness) call(ctx context.Context, cost time.Duration, keys ...string) (*api.DubboResponse, error) {
+	req := map[string]interface{}{"cost": cost.String()}
+	for i := 0; i+1 < len(keys); i += 2 {
+		req[keys[i]] = keys[i+1]
+	}
+	return h.consumer.SayHello(ctx, &api.DubboRequest{Request: req})
+}
+
+// waitReady calls until a call succeeds or ctx is done.
+func (h *harness) waitReady(ctx context.Context) error {
+	for {
+		_, err := h.call(ctx, 0)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("consumer never reached the provider, last error: %w", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// ready fails the test unless the consumer can reach the provider within
+// five seconds.
+func (h *harness) ready(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.waitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stopProvider runs the provider's shutdown sequence: deregister, drain,
+// close the dubbo protocol. It reports whether the drain finished.
+func (h *harness) stopProvider() bool {
+	drained := h.lc.Stop()
+	// the registry protocol drops its cached exporter step-timeout after the
+	// shutdown started; exporting again before then would reuse the dead one
+	time.Sleep(config.GetShutDown().GetStepTimeout() + 100*time.Millisecond)
+	return drained
+}
+
+// startProvider exports and registers the provider again on the same
+// address, the way a restarted process would. A ServiceConfig exports only
+// once, so this builds a new one.
+func (h *harness) startProvider() error {
+	sc := config.NewServiceConfigBuilder().
+		SetInterface("org.apache.dubbo.DubboDemoProvider.Test").
+		SetServiceID("DubboDemoProvider").
+		Build()
+	if err := sc.Init(config.GetRootConfig()); err != nil {
+		return err
+	}
+	sc.Implement(h.provider)
+	config.GetShutDown().RejectRequest.Store(false)
+	if err := sc.Export(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.service = sc
+	h.mu.Unlock()
+	h.lc.set(StageReady)
+	return nil
+}
+
+// spawnProvider starts a second provider in a process of its own, this test
+// binary running cmd/server's main with args, and returns its address once
+// it listens. dubbo-go keeps one exporter per service in a process, so a
+// provider that behaves differently cannot share the harness's. The
+// provider is interrupted when the test ends, and its output logged if the
+// test failed.
+func spawnProvider(t *testing.T, args ...string) string {
+	t.Helper()
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dubbogo.yaml")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(spawnedConfig, port)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), providerEnv+"=1", constant.ConfigFileEnvKey+"="+path)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case <-done:
+		case <-time.After(15 * time.Second):
+			cmd.Process.Kill()
+			<-done
+		}
+		if t.Failed() {
+			t.Logf("provider on %s:\n%s", addr, out.String())
+		}
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			c.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("provider on %s not listening after 10s: %v", addr, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// refer builds the reference b describes to DubboDemoProvider, with no
+// retries, and returns a consumer of it. The reference is destroyed when
+// the test ends.
+func refer(t *testing.T, b *config.ReferenceConfigBuilder) *api.DubboDemoProvider {
+	t.Helper()
+	rc := b.SetInterface("org.apache.dubbo.DubboDemoProvider.Test").
+		SetProtocol("dubbo").
+		SetRetries("0").
+		Build()
+	if err := rc.Init(config.GetRootConfig()); err != nil {
+		t.Fatal(err)
+	}
+	consumer := &api.DubboDemoProvider{}
+	rc.Refer(consumer)
+	rc.Implement(consumer)
+	t.Cleanup(func() { rc.GetInvoker().Destroy() })
+	return consumer
+}
+
+// providerURL is the URL the provider registered, as the registry sees it.
+func (h *harness) providerURL() *common.URL {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	urls := h.service.GetExportedUrls()
+	if len(urls) == 0 {
+		return nil
+	}
+	return urls[0].Clone()
+}
+
+// registry returns a handle on the registry the pair share, for changing
+// what the consumer sees without touching the provider.
+func (h *harness) registry(t *testing.T) registry.Registry {
+	t.Helper()
+	reg, err := config.GetRootConfig().Registries["local"].GetInstance(common.PROVIDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+// outcome is how one call ended.
+type outcome struct {
+	took time.Duration
+	err  error
+}
+
+func (o outcome) String() string {
+	if o.err == nil {
+		return fmt.Sprintf("ok in %v", o.took.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s after %v: %v", failure.Classify(o.err), o.took.Round(time.Millisecond), o.err)
+}
+
+// timed makes a call and records how long it took.
+func (h *harness) timed(ctx context.Context, cost time.Duration, keys ...string) outcome {
+	start := time.Now()
+	_, err := h.call(ctx, cost, keys...)
+	return outcome{took: time.Since(start), err: err}
+}
+
+// waitIdle waits until the provider has no call in flight, or fails the
+// test after within.
+func (h *harness) waitIdle(t *testing.T, within time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for h.lc.InFlight() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("provider still has %d calls in flight after %v: %+v", h.lc.InFlight(), within, h.lc.Calls())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// span is what the scenarios read back from the harness's trace file.
+type span struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+}
+
+// spans flushes the trace file and returns the spans of trace id in it.
+func (h *harness) spans(t *testing.T, id string) []span {
+	t.Helper()
+	if err := h.trace.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(os.Getenv(constant.ConfigFileEnvKey)), "trace.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []span
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var td struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(line, &td); err != nil {
+			t.Fatalf("trace file: %v", err)
+		}
+		for _, rs := range td.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					if s.TraceID == id {
+						out = append(out, s)
+					}
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/config"
+
+	"dubbo-demo/internal/flightrec"
+)
+
+// Stage is where the provider is in its lifecycle.
+type Stage int32
+
+const (
+	StageStarting     Stage = iota // warming up, not exported or registered yet
+	StageReady                     // exported, registered and serving
+	StageDeregistered              // gone from the registries, still serving stragglers
+	StageDraining                  // rejecting new calls, waiting for in-flight ones
+	StageStopped                   // protocols closed
+)
+
+var stageNames = [...]string{"starting", "ready", "deregistered", "draining", "stopped"}
+
+func (s Stage) String() string {
+	if s < 0 || int(s) >= len(stageNames) {
+		return "unknown"
+	}
+	return stageNames[s]
+}
+
+// lifecycle replaces dubbo-go's internal signal handling for the provider, so
+// each shutdown step is logged and the exit code says whether the in-flight
+// calls were drained. dubbo.shutdown.internal-signal must be false.
+type lifecycle struct {
+	stage   atomic.Int32
+	started time.Time
+
+	mu     sync.Mutex
+	nextID uint64
+	calls  map[uint64]*call
+}
+
+// call is a SayHello call in flight.
+type call struct {
+	ID      uint64                 `json:"id"`
+	Remote  string                 `json:"remote"`
+	Start   time.Time              `json:"start"`
+	Age     string                 `json:"age"`
+	Request map[string]interface{} `json:"request"`
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{started: time.Now(), calls: make(map[uint64]*call)}
+}
+
+func (l *lifecycle) Stage() Stage { return Stage(l.stage.Load()) }
+
+func (l *lifecycle) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.calls)
+}
+
+// Calls returns the calls in flight, oldest first, with their age filled in.
+func (l *lifecycle) Calls() []call {
+	now := time.Now()
+	l.mu.Lock()
+	out := make([]call, 0, len(l.calls))
+	for _, c := range l.calls {
+		cc := *c
+		cc.Age = now.Sub(c.Start).Round(time.Millisecond).String()
+		out = append(out, cc)
+	}
+	l.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (l *lifecycle) set(s Stage) {
+	l.stage.Store(int32(s))
+	log.Printf("lifecycle: %s after %v, in-flight=%d\n", s, time.Since(l.started).Round(time.Millisecond), l.InFlight())
+}
+
+// track records a call as in flight until the returned func is called.
+func (l *lifecycle) track(remote string, req map[string]interface{}) func() {
+	l.mu.Lock()
+	l.nextID++
+	id := l.nextID
+	l.calls[id] = &call{ID: id, Remote: remote, Start: time.Now(), Request: req}
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		delete(l.calls, id)
+		l.mu.Unlock()
+	}
+}
+
+// Start holds off exporting, and so registering, until warmup has passed,
+// then loads the dubbo config. Consumers only learn about the provider once
+// it is ready to serve.
+func (l *lifecycle) Start(warmup time.Duration) error {
+	l.set(StageStarting)
+	if warmup > 0 {
+		log.Printf("lifecycle: warming up for %v before registering\n", warmup)
+		time.Sleep(warmup)
+	}
+	if err := config.Load(); err != nil {
+		return err
+	}
+	// config.Load replaced the loggers the admin flight recorder reads
+	flightrec.CaptureLogs()
+	if config.GetShutDown().GetInternalSignal() {
+		log.Printf("lifecycle: dubbo.shutdown.internal-signal is on, dubbo-go may exit before the drain completes\n")
+	}
+	l.set(StageReady)
+	return nil
+}
+
+// Stop shuts the provider down within the dubbo.shutdown window and reports
+// whether every in-flight call finished. The steps are: deregister, keep
+// serving for consumer-update-wait-time while consumers drop this provider,
+// reject new calls, drain in-flight calls, then close the protocols.
+func (l *lifecycle) Stop() bool {
+	sc := config.GetShutDown()
+	deadline := time.Now().Add(sc.GetTimeout())
+	log.Printf("lifecycle: shutting down, timeout=%v consumer-update-wait-time=%v\n", sc.GetTimeout(), sc.GetConsumerUpdateWaitTime())
+
+	extension.GetProtocol(constant.RegistryProtocol).Destroy()
+	l.set(StageDeregistered)
+
+	if wait := sc.GetConsumerUpdateWaitTime(); wait > 0 {
+		log.Printf("lifecycle: serving for %v while consumers update\n", wait)
+		time.Sleep(wait)
+	}
+
+	sc.RejectRequest.Store(true)
+	l.set(StageDraining)
+	drained := l.drain(deadline)
+	if drained {
+		log.Printf("lifecycle: drained\n")
+	} else {
+		log.Printf("lifecycle: drain window over with %d calls still in flight\n", l.InFlight())
+	}
+
+	for _, p := range config.GetRootConfig().Protocols {
+		extension.GetProtocol(p.Name).Destroy()
+	}
+	l.set(StageStopped)
+	return drained
+}
+
+func (l *lifecycle) drain(deadline time.Time) bool {
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	report := time.Now()
+	for l.InFlight() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		if time.Since(report) >= time.Second {
+			log.Printf("lifecycle: waiting for %d in-flight calls, %v left\n", l.InFlight(), time.Until(deadline).Round(time.Millisecond))
+			report = time.Now()
+		}
+		<-tick.C
+	}
+	return true
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/config"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"dubbo-demo/api"
+	"dubbo-demo/internal/breaker"
+	"dubbo-demo/internal/failure"
+	"dubbo-demo/internal/flightrec"
+	"dubbo-demo/internal/hedge"
+	"dubbo-demo/internal/sessions"
+	"dubbo-demo/internal/tracing"
+)
+
+// slack is how far past requestTimeout a timed-out call may return.
+const slack = 500 * time.Millisecond
+
+// timedOut reports whether o ended because its time ran out. The consumer's
+// request timeout and the provider giving up under the deadline filter fire
+// together, so either may be what the consumer sees.
+func timedOut(o outcome) bool {
+	if o.err == nil {
+		return false
+	}
+	switch failure.Classify(o.err) {
+	case failure.ReadTimeout:
+		return true
+	case failure.Remote:
+		return strings.Contains(o.err.Error(), context.DeadlineExceeded.Error())
+	}
+	return false
+}
+
+func TestSayHello(t *testing.T) {
+	h.ready(t)
+	resp, err := h.call(context.Background(), 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(resp.Reponse), "Hello, this request cost 20ms"; got != want {
+		t.Fatalf("response %q, want %q", got, want)
+	}
+}
+
+func TestSayHelloConcurrent(t *testing.T) {
+	h.ready(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := h.call(context.Background(), 50*time.Millisecond); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestCapacity gives the provider one slot: of two calls that arrive
+// together, the second waits for the first to finish its cost.
+func TestCapacity(t *testing.T) {
+	h.ready(t)
+	h.provider.slots = newSlots(1)
+	defer func() { h.provider.slots = nil }()
+
+	const cost = 300 * time.Millisecond
+	outcomes := make(chan outcome, 2)
+	for i := 0; i < cap(outcomes); i++ {
+		go func() { outcomes <- h.timed(context.Background(), cost) }()
+	}
+	var slowest time.Duration
+	for i := 0; i < cap(outcomes); i++ {
+		o := <-outcomes
+		if o.err != nil {
+			t.Fatal(o)
+		}
+		if o.took > slowest {
+			slowest = o.took
+		}
+	}
+	if slowest < 2*cost-50*time.Millisecond {
+		t.Fatalf("slower call took %v, want about %v behind the other", slowest, 2*cost)
+	}
+}
+
+func TestProviderError(t *testing.T) {
+	h.ready(t)
+	_, err := h.call(context.Background(), 0, keyError, "boom")
+	if err == nil {
+		t.Fatal("call succeeded, want the injected error")
+	}
+	if c := failure.Classify(err); c != failure.Remote {
+		t.Fatalf("error class %s, want %s: %v", c, failure.Remote, err)
+	}
+	if !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("error %q does not carry the provider's message", err)
+	}
+}
+
+// TestCostUnderTimeout guards against the request timeout firing early: a
+// call well inside it must succeed.
+func TestCostUnderTimeout(t *testing.T) {
+	h.ready(t)
+	o := h.timed(context.Background(), requestTimeout/2)
+	if o.err != nil {
+		t.Fatalf("call costing %v with a %v timeout: %v", requestTimeout/2, requestTimeout, o)
+	}
+}
+
+// TestCostOverTimeout checks both ends of a call that outlives the consumer's
+// request-timeout: the consumer's call fails on time, and the provider, told
+// the deadline by the deadline filters, stops working on it.
+func TestCostOverTimeout(t *testing.T) {
+	h.ready(t)
+	o := h.timed(context.Background(), 3*requestTimeout)
+	if !timedOut(o) {
+		t.Fatalf("call costing %v with a %v timeout: got %s, want a timeout", 3*requestTimeout, requestTimeout, o)
+	}
+	if o.took < requestTimeout-slack || o.took > requestTimeout+slack {
+		t.Fatalf("got %s, want the timeout after %v", o, requestTimeout)
+	}
+	// the provider learnt of the deadline as the call arrived, so it should
+	// abandon the call at about the time the consumer gave up
+	h.waitIdle(t, slack)
+}
+
+// TestStallOverTimeout is a call whose work fits the timeout but whose answer
+// is held back past it; the consumer must still time out on schedule.
+func TestStallOverTimeout(t *testing.T) {
+	h.ready(t)
+	o := h.timed(context.Background(), 0, keyStall, (3 * requestTimeout).String())
+	if !timedOut(o) {
+		t.Fatalf("got %s, want a timeout", o)
+	}
+	if o.took > requestTimeout+slack {
+		t.Fatalf("got %s, want the timeout after %v", o, requestTimeout)
+	}
+	h.waitIdle(t, slack)
+}
+
+// TestClientSessions checks that the consumer's sessions and pending
+// requests, which dubbo-go keeps unexported, can still be read, and that a
+// session answers a heartbeat.
+func TestClientSessions(t *testing.T) {
+	h.ready(t)
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.call(context.Background(), requestTimeout/2)
+		done <- err
+	}()
+	time.Sleep(requestTimeout / 10)
+	if p := sessions.Pending(); p.Count == 0 {
+		t.Errorf("no pending requests with a call in flight")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	clients := sessions.ClientStats()
+	if len(clients) != 1 || len(clients[0].Sessions) == 0 {
+		t.Fatalf("got clients %+v, want one with sessions", clients)
+	}
+	st := clients[0].Sessions[0]
+	if st.Requests == 0 || st.WritePkgs == 0 {
+		t.Errorf("session %+v has seen no calls", st)
+	}
+	s := sessions.ClientByID(st.ID)
+	if s == nil {
+		t.Fatalf("no session with ID %d", st.ID)
+	}
+	rtt, err := sessions.Ping(s, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("heartbeat rtt %v", rtt)
+}
+
+// TestContextDeadline checks that a caller's deadline shorter than the
+// request-timeout is the one that applies.
+func TestContextDeadline(t *testing.T) {
+	h.ready(t)
+	budget := requestTimeout / 4
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+	o := h.timed(ctx, 3*requestTimeout)
+	if !timedOut(o) {
+		t.Fatalf("call costing %v with a %v deadline: got %s, want a timeout", 3*requestTimeout, budget, o)
+	}
+	if o.took > budget+slack {
+		t.Fatalf("got %s, want the timeout after %v", o, budget)
+	}
+	h.waitIdle(t, budget+slack)
+}
+
+// TestProviderRestart stops the provider with its own shutdown sequence
+// while a call is in flight, checks that the call is drained and that calls
+// fail fast while it is down, then starts it again on the same address.
+func TestProviderRestart(t *testing.T) {
+	h.ready(t)
+
+	inflight := make(chan outcome, 1)
+	go func() { inflight <- h.timed(context.Background(), 300*time.Millisecond) }()
+	for h.lc.InFlight() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !h.stopProvider() {
+		t.Fatal("provider did not drain its in-flight call")
+	}
+	if o := <-inflight; o.err != nil {
+		t.Fatalf("call in flight during the shutdown: %s", o)
+	}
+
+	o := h.timed(context.Background(), 0)
+	if o.err == nil {
+		t.Fatal("call succeeded with the provider stopped")
+	}
+	if o.took > requestTimeout {
+		t.Fatalf("call with the provider stopped: %s, want it to fail without waiting for the timeout", o)
+	}
+
+	if err := h.startProvider(); err != nil {
+		t.Fatal(err)
+	}
+	h.ready(t)
+	for i := 0; i < 10; i++ {
+		if _, err := h.call(context.Background(), 0); err != nil {
+			t.Fatalf("call %d after the restart: %v", i, err)
+		}
+	}
+}
+
+// TestRegistryChurn deregisters and re-registers the running provider over
+// and over while callers keep going. Calls may find no provider while it is
+// deregistered, but none may hang past the timeout, and once the registry
+// settles every call must succeed again.
+func TestRegistryChurn(t *testing.T) {
+	h.ready(t)
+	reg := h.registry(t)
+	real := h.providerURL()
+	if real == nil {
+		t.Fatal("provider is not exported")
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		outcomes []outcome
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				o := h.timed(context.Background(), 10*time.Millisecond)
+				mu.Lock()
+				outcomes = append(outcomes, o)
+				mu.Unlock()
+				if o.err != nil {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := reg.UnRegister(real); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(30 * time.Millisecond)
+		if err := reg.Register(real); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	stop()
+	wg.Wait()
+
+	failed := map[failure.Class]int{}
+	for _, o := range outcomes {
+		if o.took > requestTimeout+slack {
+			t.Errorf("call hung during churn: %s", o)
+		}
+		if o.err == nil {
+			continue
+		}
+		c := failure.Classify(o.err)
+		if c != failure.NoProvider {
+			t.Errorf("call failed during churn: %s", o)
+		}
+		failed[c]++
+	}
+	t.Logf("%d calls during churn, failed: %v", len(outcomes), failed)
+
+	h.ready(t)
+	for i := 0; i < 20; i++ {
+		if o := h.timed(context.Background(), 0); o.err != nil {
+			t.Fatalf("call %d after churn: %s", i, o)
+		}
+	}
+}
+
+// TestRegistryDeadInstance registers an instance nobody listens on next to
+// the real one. Calls must keep reaching the real provider. The consumer
+// connects to a new instance inside the registry notification, so until the
+// connect gives up it sees no other registry change; the test waits that
+// out and reports how long it took.
+func TestRegistryDeadInstance(t *testing.T) {
+	h.ready(t)
+	reg := h.registry(t)
+	real := h.providerURL()
+	if real == nil {
+		t.Fatal("provider is not exported")
+	}
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := real.Clone()
+	dead.Port = strconv.Itoa(port)
+	dead.Location = net.JoinHostPort(dead.Ip, dead.Port)
+
+	start := time.Now()
+	if err := reg.Register(dead); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if o := h.timed(context.Background(), 0); o.err != nil {
+			t.Fatalf("call %d with a dead instance registered: %s", i, o)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := reg.UnRegister(dead); err != nil {
+		t.Fatal(err)
+	}
+
+	// take the real provider away too; the first call finding no provider
+	// shows the consumer has caught up with the registry
+	if err := reg.UnRegister(real); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := reg.Register(real); err != nil {
+			t.Fatal(err)
+		}
+		h.ready(t)
+	}()
+	for {
+		o := h.timed(context.Background(), 0)
+		if o.err != nil {
+			if c := failure.Classify(o.err); c != failure.NoProvider {
+				t.Fatalf("got %s, want %s", o, failure.NoProvider)
+			}
+			break
+		}
+		if time.Since(start) > 15*time.Second {
+			t.Fatalf("consumer still calls a deregistered provider after %v", time.Since(start))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Logf("consumer caught up with the registry after %v", time.Since(start).Round(time.Millisecond))
+}
+
+// TestSlowReader has the provider stop reading the consumer's session after
+// answering. The next call sits unread in the socket, so the consumer times
+// out although the session stays open; once reading resumes, calls succeed
+// on the same session again.
+func TestSlowReader(t *testing.T) {
+	h.ready(t)
+	if o := h.timed(context.Background(), 0, keyPauseRead, (3 * requestTimeout).String()); o.err != nil {
+		t.Fatalf("call pausing the reads: %s", o)
+	}
+	defer func() {
+		if _, err := slowReads.do("clear", ""); err != nil {
+			t.Fatal(err)
+		}
+		h.ready(t)
+	}()
+	if st := slowReads.status(); len(st) == 0 || st[0].PausedUntil.IsZero() {
+		t.Fatalf("slow reads %+v, want a paused session", st)
+	}
+
+	o := h.timed(context.Background(), 0)
+	if !timedOut(o) {
+		t.Fatalf("call with the provider not reading: got %s, want a timeout", o)
+	}
+	if o.took > requestTimeout+slack {
+		t.Fatalf("got %s, want the timeout after %v", o, requestTimeout)
+	}
+	if n := len(sessions.Server()); n == 0 {
+		t.Fatal("provider closed the session it stopped reading")
+	}
+
+	if _, err := slowReads.do("resume", ""); err != nil {
+		t.Fatal(err)
+	}
+	if o := h.timed(context.Background(), 0); o.err != nil {
+		t.Fatalf("call after resuming: %s", o)
+	}
+}
+
+// TestHedge calls the harness's provider and one that stalls every call
+// through the hedged cluster. A call whose first attempt goes to the
+// stalling provider is sent again to the other one after the hedge delay,
+// and returns then with the second attempt's response.
+func TestHedge(t *testing.T) {
+	h.ready(t)
+	const delay = 200 * time.Millisecond
+	stalling := spawnProvider(t, "-stall-rate", "1", "-stall-for", (10 * requestTimeout).String())
+	consumer := refer(t, config.NewReferenceConfigBuilder().
+		SetURL("dubbo://"+h.providerURL().Location+";dubbo://"+stalling).
+		SetCluster(hedge.ClusterKey).
+		SetLoadbalance("random").
+		SetParams(map[string]string{hedge.DelayKey: delay.String()}))
+
+	// the first attempt goes to either provider at random
+	for i := 1; ; i++ {
+		var attempt int
+		ctx := hedge.WithAttempt(context.Background(), &attempt)
+		start := time.Now()
+		resp, err := consumer.SayHello(ctx, &api.DubboRequest{Request: map[string]interface{}{"cost": "0s"}})
+		took := time.Since(start)
+		if err != nil {
+			t.Fatalf("call %d: %v after %v", i, err, took)
+		}
+		if resp == nil || string(resp.Reponse) != "Hello, this request cost 0s" {
+			t.Fatalf("call %d: got %+v, want the provider's greeting", i, resp)
+		}
+		if took > delay+slack {
+			t.Fatalf("call %d took %v, want it back by the hedge delay of %v", i, took, delay)
+		}
+		switch attempt {
+		case 1:
+		case 2:
+			if took < delay {
+				t.Fatalf("call %d won by the hedge after %v, before the hedge delay of %v", i, took, delay)
+			}
+			return
+		default:
+			t.Fatalf("call %d: attempt %d, want 1 or 2", i, attempt)
+		}
+		if i == 20 {
+			t.Fatalf("none of %d calls went to the stalling provider first", i)
+		}
+	}
+}
+
+// breakerOpenFor is how long the breaker of TestBreaker stays open, as set
+// under consumer.filter-conf.breaker in harnessConfig.
+const breakerOpenFor = 500 * time.Millisecond
+
+// TestBreaker fails calls through a reference with sentinel-consumer and the
+// breaker filter until the error-count rule from filter-conf opens the
+// breaker. Calls are then turned away unsent with an *breaker.OpenError
+// until the probe after open-for succeeds and closes the breaker again.
+func TestBreaker(t *testing.T) {
+	h.ready(t)
+	consumer := refer(t, config.NewReferenceConfigBuilder().
+		SetURL("dubbo://"+h.providerURL().Location).
+		SetFilter("sentinel-consumer,"+breaker.FilterKey))
+	call := func(keys ...string) (outcome, error) {
+		req := map[string]interface{}{"cost": "0s"}
+		for i := 0; i+1 < len(keys); i += 2 {
+			req[keys[i]] = keys[i+1]
+		}
+		start := time.Now()
+		_, err := consumer.SayHello(context.Background(), &api.DubboRequest{Request: req})
+		return outcome{took: time.Since(start), err: err}, err
+	}
+
+	var open *breaker.OpenError
+	for i := 1; ; i++ {
+		o, err := call(keyError, "boom")
+		if err == nil {
+			t.Fatalf("call %d succeeded, want the injected error", i)
+		}
+		if errors.As(err, &open) {
+			if c := failure.Classify(err); c != failure.CircuitOpen {
+				t.Fatalf("call %d: %s, want %s", i, o, failure.CircuitOpen)
+			}
+			if o.took > slack {
+				t.Fatalf("call %d: %s, want it turned away without being sent", i, o)
+			}
+			break
+		}
+		if c := failure.Classify(err); c != failure.Remote {
+			t.Fatalf("call %d: %s, want the injected error", i, o)
+		}
+		// the rule needs 3 errors, and loads on the first call
+		if i == 5 {
+			t.Fatalf("breaker still closed after %d failed calls", i)
+		}
+	}
+	if open.State != "open" {
+		t.Fatalf("breaker %s, want open: %v", open.State, open)
+	}
+	if wait := time.Until(open.RetryAt); wait <= 0 || wait > breakerOpenFor {
+		t.Fatalf("next probe in %v, want within the %v open-for", wait, breakerOpenFor)
+	}
+	if s := breakerState(t, "SayHello"); s != "open" {
+		t.Fatalf("breaker_state metric says %s, want open", s)
+	}
+
+	// the first call after open-for is the probe; it succeeds, the breaker
+	// closes and lets the calls after it through
+	time.Sleep(time.Until(open.RetryAt) + 50*time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		if o, err := call(); err != nil {
+			t.Fatalf("call %d after open-for: %s, want the breaker to close", i, o)
+		}
+	}
+	if s := breakerState(t, "SayHello"); s != "closed" {
+		t.Fatalf("breaker_state metric says %s, want closed", s)
+	}
+}
+
+// breakerState returns the state demo_consumer_breaker_state has at 1 for
+// method.
+func breakerState(t *testing.T, method string) string {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "demo_consumer_breaker_state" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["method"] == method && m.GetGauge().GetValue() == 1 {
+				return labels["state"]
+			}
+		}
+	}
+	return "unknown"
+}
+
+// TestTrace follows one call through the trace file. The consumer's call
+// span, the codec spans on both sides, the provider's span and its sleep must
+// all be in the caller's trace and hang off the right parents.
+func TestTrace(t *testing.T) {
+	h.ready(t)
+	ctx, root := tracing.Start(context.Background(), "test")
+	if _, err := h.call(ctx, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	byName := map[string]span{}
+	for _, s := range h.spans(t, root.SpanContext().TraceID().String()) {
+		name := s.Name
+		switch s.Kind {
+		case 2:
+			name += " (server)"
+		case 3:
+			name += " (client)"
+		}
+		byName[name] = s
+	}
+	parents := map[string]string{
+		"SayHello (client)":     "test",
+		"dubbo.encode request":  "SayHello (client)",
+		"dubbo.decode request":  "SayHello (client)",
+		"SayHello (server)":     "SayHello (client)",
+		"SayHello cost":         "SayHello (server)",
+		"dubbo.encode response": "SayHello (client)",
+		"dubbo.decode response": "SayHello (client)",
+	}
+	for name, parent := range parents {
+		s, ok := byName[name]
+		if !ok {
+			t.Errorf("no %q span in the trace, got %v", name, byName)
+			continue
+		}
+		if p, ok := byName[parent]; ok && s.ParentSpanID != p.SpanID {
+			t.Errorf("%q span has parent %s, want %q (%s)", name, s.ParentSpanID, parent, p.SpanID)
+		}
+	}
+}
+
+// TestFlightRecord fetches a dump from the admin page while a call is stuck in
+// the provider. The archive must hold every file, with the stuck handler in
+// the goroutine stacks.
+func TestFlightRecord(t *testing.T) {
+	h.ready(t)
+	done := make(chan outcome, 1)
+	go func() { done <- h.timed(context.Background(), 0, keyStall, (3 * requestTimeout).String()) }()
+	defer func() {
+		<-done
+		h.waitIdle(t, slack)
+	}()
+	for start := time.Now(); h.lc.InFlight() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > requestTimeout {
+			t.Fatal("stalled call never reached the provider")
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	serveFlightRecord(rec, httptest.NewRequest(http.MethodGet, "/flightrec?trace=100ms", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /flightrec: %d %s", rec.Code, rec.Body)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[path.Base(hdr.Name)] = string(b)
+	}
+	for _, name := range []string{flightrec.ReasonFile, flightrec.GoroutinesFile, flightrec.MemStatsFile, flightrec.HeapFile, flightrec.SessionsFile, flightrec.TraceFile} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("dump has no %s", name)
+		}
+	}
+	if !strings.Contains(files[flightrec.GoroutinesFile], "(*DubboDemoProvider).SayHello") {
+		t.Errorf("%s does not show the stalled SayHello", flightrec.GoroutinesFile)
+	}
+	if len(files[flightrec.TraceFile]) == 0 {
+		t.Errorf("%s is empty", flightrec.TraceFile)
+	}
+}
@@ -3,35 +3,97 @@ package main
 import (
 	"context"
 	"dubbo-demo/api"
+	_ "dubbo-demo/internal/deadline"
+	_ "dubbo-demo/internal/localregistry"
+	"dubbo-demo/internal/metrics"
+	"dubbo-demo/internal/reqlog"
+	"dubbo-demo/internal/tracing"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"dubbo.apache.org/dubbo-go/v3/config"
 	_ "dubbo.apache.org/dubbo-go/v3/imports"
 	hessian "github.com/apache/dubbo-go-hessian2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+var (
+	warmup      = flag.Duration("warmup", 0, "wait this long before exporting and registering the services")
+	adminAddr   = flag.String("admin", "", "serve the admin pages on this address, e.g. :20080, empty to disable")
+	metricsAddr = flag.String("metrics", "", "serve Prometheus metrics on this address at /metrics, e.g. :9090, empty to disable")
+	traceFile   = flag.String("trace", "", "append the spans of traced calls to this OTLP-JSON file, empty to disable")
+	flightDir   = flag.String("flightrec", "", "keep the dumps served on the admin /flightrec page in this directory, empty to discard them")
+	capacity    = flag.Int("capacity", 0, "work on the cost of at most this many SayHello calls at once, queueing the others; 0 for no limit")
+	stallRate   = flag.Float64("stall-rate", 0, "share of SayHello calls, 0 to 1, that stall for -stall-for on top of what they ask for")
+	stallFor    = flag.Duration("stall-for", time.Second, "how long a call picked by -stall-rate stalls")
 )
 
 // export DUBBO_GO_CONFIG_PATH= PATH_TO_SAMPLES/direct/go-server/conf/dubbogo.yml
 func main() {
-	config.SetProviderService(&DubboDemoProvider{})
+	flag.Parse()
+	var tp *tracing.Provider
+	if *traceFile != "" {
+		var err error
+		// the consumer decides which calls are traced
+		if tp, err = tracing.Setup(*traceFile, "dubbo-demo-provider", 0); err != nil {
+			log.Fatal(err)
+		}
+	}
+	lc := newLifecycle()
+	provider := &DubboDemoProvider{lc: lc, slots: newSlots(*capacity), stalls: stalls{rate: *stallRate, d: *stallFor}}
+	config.SetProviderService(provider)
 	hessian.RegisterPOJO(&api.DubboRequest{})
 	hessian.RegisterPOJO(&api.DubboResponse{})
 
-	if err := config.Load(); err != nil {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	metrics.InFlight(lc.InFlight)
+	metrics.Queued(provider.slots.Queued)
+	if *adminAddr != "" {
+		serveAdmin(*adminAddr, lc)
+	}
+	if *metricsAddr != "" {
+		metrics.Serve(*metricsAddr)
+	}
+	if err := lc.Start(*warmup); err != nil {
 		panic(err)
 	}
-	select {}
+
+	sig := <-signals
+	log.Printf("got signal %v\n", sig)
+	go func() {
+		sig := <-signals
+		log.Printf("got signal %v again, exiting now\n", sig)
+		os.Exit(2)
+	}()
+	drained := lc.Stop()
+	if tp != nil {
+		if err := tp.Close(); err != nil {
+			log.Printf("trace: %v\n", err)
+		}
+	}
+	if !drained {
+		os.Exit(1)
+	}
 }
 
-type DubboDemoProvider struct{}
+type DubboDemoProvider struct {
+	lc     *lifecycle
+	slots  *slots // nil without -capacity
+	stalls stalls // zero without -stall-rate
+}
 
 func (d *DubboDemoProvider) SayHello(ctx context.Context, req *api.DubboRequest) (resp *api.DubboResponse, err error) {
-	st := time.Now()
-
-	defer func() {
-		log.Printf("SayHello cost:%dms\n", time.Since(st).Milliseconds())
-	}()
+	// the reqlog-provider filter logs the call's cost and outcome
+	defer d.lc.track(remoteAddr(ctx), req.Request)()
 
 	cost, _ := req.Request["cost"].(string)
 
@@ -40,9 +102,54 @@ func (d *DubboDemoProvider) SayHello(ctx context.Context, req *api.DubboRequest)
 		return nil, err
 	}
 
-	time.Sleep(t)
+	f, err := parseFault(req.Request)
+	if err != nil {
+		return nil, err
+	}
+	f.stall += d.stalls.draw()
+
+	release, err := d.slots.take(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = sleep(ctx, "cost", t)
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.apply(ctx); err != nil {
+		return nil, err
+	}
 
 	msg := fmt.Sprintf("Hello, this request cost %v", t)
+	resp = &api.DubboResponse{Reponse: f.body(msg)}
+	metrics.ObserveResponse(len(resp.Reponse))
+
+	if err := sleep(ctx, "stall", f.stall); err != nil {
+		return nil, err
+	}
 
-	return &api.DubboResponse{Reponse: []byte(msg)}, nil
+	return resp, nil
+}
+
+// sleep simulates d of work, giving up early once the consumer's deadline,
+// carried in by the deadline-provider filter, has passed. The sleep is traced
+// as a "SayHello what" span.
+func sleep(ctx context.Context, what string, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	_, span := tracing.Start(ctx, "SayHello "+what, attribute.String("demo.duration", d.String()))
+	defer span.End()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reqlog.From(ctx).Warn("SayHello abandoned", zap.String("during", what), zap.Error(ctx.Err()))
+		span.SetStatus(codes.Error, ctx.Err().Error())
+		return fmt.Errorf("abandoned before %v of work was done: %w", d, ctx.Err())
+	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/dustin/go-humanize"
+
+	"dubbo-demo/internal/chaos"
+	"dubbo-demo/internal/sessions"
+)
+
+// slowReads makes the provider a slow reader of chosen consumer sessions:
+// it stops reading or reads at a limited rate while the session stays open.
+// The consumer's socket send buffer then fills up and its writes time out
+// after tcp-write-timeout, as if the provider were overloaded.
+var slowReads = &slowReaders{dirs: map[uint32]*chaos.Direction{}}
+
+type slowReaders struct {
+	mu   sync.Mutex
+	dirs map[uint32]*chaos.Direction // by getty session ID
+}
+
+// of returns the read faults of s, gating the reads of s with them the
+// first time.
+func (r *slowReaders) of(s getty.Session) (*chaos.Direction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d, ok := r.dirs[s.ID()]; ok {
+		return d, nil
+	}
+	d := chaos.NewDirection()
+	if err := sessions.GateReads(s, d); err != nil {
+		return nil, fmt.Errorf("session %d from %s: %w", s.ID(), s.RemoteAddr(), err)
+	}
+	r.dirs[s.ID()] = d
+	return d, nil
+}
+
+// do runs a command on the accepted sessions from remote, or on all of them
+// when remote is empty:
+//
+//	pause [DURATION]   stop reading, until resume without a duration
+//	bandwidth RATE     read at most RATE bytes per second, e.g. 8KiB
+//	resume             read again
+//	clear              lift the pause and the rate limit
+//
+// Sessions accepted later are not affected, nor, when remote is empty, the
+// ones no request has been read from yet.
+func (r *slowReaders) do(cmd, remote string) (string, error) {
+	f := strings.Fields(cmd)
+	if len(f) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	var apply func(*chaos.Direction)
+	switch verb, args := f[0], f[1:]; {
+	case verb == "pause" && len(args) <= 1:
+		var dur time.Duration
+		if len(args) == 1 {
+			var err error
+			if dur, err = time.ParseDuration(args[0]); err != nil {
+				return "", err
+			}
+		}
+		apply = func(d *chaos.Direction) { d.Pause(dur) }
+	case verb == "bandwidth" && len(args) == 1:
+		rate, err := humanize.ParseBytes(args[0])
+		if err != nil {
+			return "", fmt.Errorf("bandwidth %q: %w", args[0], err)
+		}
+		apply = func(d *chaos.Direction) { d.SetRate(int64(rate)) }
+	case verb == "resume" && len(args) == 0:
+		apply = func(d *chaos.Direction) { d.Resume() }
+	case verb == "clear" && len(args) == 0:
+		apply = func(d *chaos.Direction) { d.Apply(chaos.Settings{}) }
+	case verb == "pause" || verb == "bandwidth" || verb == "resume" || verb == "clear":
+		return "", fmt.Errorf("%s: unexpected %q", verb, strings.Join(args, " "))
+	default:
+		return "", fmt.Errorf("unknown command %q", verb)
+	}
+
+	n := 0
+	for _, s := range sessions.Server() {
+		if remote != "" && s.RemoteAddr() != remote {
+			continue
+		}
+		d, err := r.of(s)
+		if remote == "" && errors.Is(err, sessions.ErrUnread) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		apply(d)
+		n++
+	}
+	if n == 0 && remote != "" {
+		return "", fmt.Errorf("no session from %q", remote)
+	}
+	return fmt.Sprintf("%s on %d sessions", strings.Join(f, " "), n), nil
+}
+
+// slowRead is the read faults of one session, for the admin pages.
+type slowRead struct {
+	Session     uint32    `json:"session"`
+	Remote      string    `json:"remote"`
+	Rate        string    `json:"rate,omitempty"`
+	PausedUntil time.Time `json:"paused_until,omitempty"`
+}
+
+// status lists the open sessions that have read faults, and forgets the
+// closed ones.
+func (r *slowReaders) status() []slowRead {
+	open := map[uint32]getty.Session{}
+	for _, s := range sessions.Server() {
+		open[s.ID()] = s
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := []slowRead{}
+	for id, d := range r.dirs {
+		s, ok := open[id]
+		if !ok {
+			delete(r.dirs, id)
+			continue
+		}
+		st := d.Settings()
+		sr := slowRead{Session: id, Remote: s.RemoteAddr()}
+		if st.Rate > 0 {
+			sr.Rate = humanize.IBytes(uint64(st.Rate)) + "/s"
+		}
+		if st.Paused(time.Now()) {
+			sr.PausedUntil = st.PausedUntil
+		}
+		out = append(out, sr)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Session < out[j].Session })
+	return out
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// stalls is the random stall -stall-rate and -stall-for give the provider:
+// that share of SayHello calls answers that much later, the way a provider
+// caught in a GC pause or by a noisy neighbour does. The zero stalls never
+// stall.
+type stalls struct {
+	rate float64 // 0 to 1
+	d    time.Duration
+}
+
+// draw returns how long one call stalls, 0 for most.
+func (s stalls) draw() time.Duration {
+	if s.rate <= 0 || rand.Float64() >= s.rate {
+		return 0
+	}
+	return s.d
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dubbo-demo/internal/failure"
+	"dubbo-demo/internal/record"
+)
+
+// result is what one combination measured. metrics is nil when the run
+// produced no recording; note says why.
+type result struct {
+	values  []string
+	load    string
+	metrics *metrics
+	note    string
+}
+
+type metrics struct {
+	calls, ok, failed int
+	timeouts          int // read and write timeouts
+	errors            map[string]int
+	p50, p90, p99     float64 // ms
+	max               float64
+	throughput        float64 // calls per second
+	spread            string  // each provider's share of the calls
+}
+
+func (m *metrics) failureRate() float64 {
+	if m.calls == 0 {
+		return 0
+	}
+	return float64(m.failed) / float64(m.calls)
+}
+
+// measure reads a consumer recording, leaving out calls that started in the
+// first warmup of the run.
+func measure(path string, warmup time.Duration, providers []provider) (*metrics, error) {
+	entries, err := record.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no calls recorded")
+	}
+	first := entries[0].Time
+	for _, e := range entries {
+		if e.Time.Before(first) {
+			first = e.Time
+		}
+	}
+	m := &metrics{errors: map[string]int{}}
+	var latencies []float64
+	var from, to time.Time
+	served := map[string]int{}
+	for _, e := range entries {
+		if e.Time.Before(first.Add(warmup)) {
+			continue
+		}
+		if from.IsZero() || e.Time.Before(from) {
+			from = e.Time
+		}
+		if end := e.Time.Add(time.Duration(e.LatencyMs * float64(time.Millisecond))); end.After(to) {
+			to = end
+		}
+		m.calls++
+		latencies = append(latencies, e.LatencyMs)
+		served[e.Provider]++
+		if e.Outcome == record.OutcomeOK {
+			m.ok++
+			continue
+		}
+		m.failed++
+		m.errors[e.Class]++
+		if e.Class == failure.ReadTimeout.String() || e.Class == failure.WriteTimeout.String() {
+			m.timeouts++
+		}
+	}
+	if m.calls == 0 {
+		return nil, fmt.Errorf("no calls after the %v warmup", warmup)
+	}
+	sort.Float64s(latencies)
+	m.p50, m.p90, m.p99 = percentile(latencies, 0.50), percentile(latencies, 0.90), percentile(latencies, 0.99)
+	m.max = latencies[len(latencies)-1]
+	if span := to.Sub(from); span > 0 {
+		m.throughput = float64(m.calls) / span.Seconds()
+	}
+	m.spread = spread(served, providers, m.calls)
+	return m, nil
+}
+
+// provider is one of the providers of a run.
+type provider struct {
+	addr  string
+	label string
+}
+
+// spread lists each provider's share of the calls, then the share of calls
+// that never reached one.
+func spread(served map[string]int, providers []provider, calls int) string {
+	share := func(n int) float64 { return 100 * float64(n) / float64(calls) }
+	var parts []string
+	for _, p := range providers {
+		parts = append(parts, fmt.Sprintf("%s=%.1f%%", p.label, share(served[p.addr])))
+	}
+	if n := served[""]; n > 0 {
+		parts = append(parts, fmt.Sprintf("none=%.1f%%", share(n)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// percentile picks from sorted the same way loadgen.Stats does, so the
+// table agrees with the client's own report.
+func percentile(sorted []float64, q float64) float64 {
+	i := int(q*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func (r result) summary() string {
+	m := r.metrics
+	if m == nil {
+		return "no result: " + r.note
+	}
+	s := fmt.Sprintf("calls=%d failed=%d (%.2f%%) timeouts=%d p50=%.1fms p99=%.1fms max=%.1fms",
+		m.calls, m.failed, 100*m.failureRate(), m.timeouts, m.p50, m.p99, m.max)
+	if r.note != "" {
+		s += " note: " + r.note
+	}
+	return s
+}
+
+func header(dims []dimension) []string {
+	var h []string
+	for _, d := range dims {
+		h = append(h, d.name)
+	}
+	return append(h, "load", "calls", "ok", "failed", "failure_rate", "timeouts",
+		"p50_ms", "p90_ms", "p99_ms", "max_ms", "calls_per_s", "errors", "spread", "note")
+}
+
+func row(r result) []string {
+	cells := append(append([]string(nil), r.values...), r.load)
+	m := r.metrics
+	if m == nil {
+		cells = append(cells, "", "", "", "", "", "", "", "", "", "", "", "")
+		return append(cells, r.note)
+	}
+	var errs []string
+	for class, n := range m.errors {
+		errs = append(errs, fmt.Sprintf("%s=%d", class, n))
+	}
+	sort.Strings(errs)
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) }
+	return append(cells,
+		strconv.Itoa(m.calls),
+		strconv.Itoa(m.ok),
+		strconv.Itoa(m.failed),
+		strconv.FormatFloat(m.failureRate(), 'f', 4, 64),
+		strconv.Itoa(m.timeouts),
+		ms(m.p50), ms(m.p90), ms(m.p99), ms(m.max),
+		strconv.FormatFloat(m.throughput, 'f', 1, 64),
+		strings.Join(errs, " "),
+		m.spread,
+		r.note,
+	)
+}
+
+// writeResults writes base.csv and base.md.
+func writeResults(base string, dims []dimension, results []result) error {
+	f, err := os.Create(base + ".csv")
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(header(dims))
+	for _, r := range results {
+		w.Write(row(r))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	f, err = os.Create(base + ".md")
+	if err != nil {
+		return err
+	}
+	writeMarkdown(f, dims, results)
+	return f.Close()
+}
+
+func writeMarkdown(w io.Writer, dims []dimension, results []result) {
+	h := header(dims)
+	fmt.Fprintf(w, "| %s |\n", strings.Join(h, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(h)))
+	for _, r := range results {
+		cells := row(r)
+		for i, c := range cells {
+			cells[i] = strings.ReplaceAll(c, "|", `\|`)
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runOne starts the providers and a consumer configured for c in dir, drives
+// the consumer at c's load and measures what it recorded.
+func runOne(dir string, dims []dimension, c combination) result {
+	r := result{values: c.values, load: c.load}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		r.note = err.Error()
+		return r
+	}
+	ports := make([]int, len(providers))
+	running := make([]provider, len(providers))
+	for i := range providers {
+		port, err := freePort()
+		if err != nil {
+			r.note = err.Error()
+			return r
+		}
+		ports[i] = port
+		running[i] = provider{addr: fmt.Sprintf("127.0.0.1:%d", port), label: label(providers, i)}
+	}
+	clientYAML := filepath.Join(dir, "client.yaml")
+	if err := writeConfig(*clientConfig, clientYAML, "client", ports, dims, c); err != nil {
+		r.note = err.Error()
+		return r
+	}
+	for i, port := range ports {
+		// a lone provider keeps the names of the runs before -providers
+		name := "server"
+		if len(ports) > 1 {
+			name = fmt.Sprintf("server%d", i+1)
+		}
+		serverYAML := filepath.Join(dir, name+".yaml")
+		if err := writeConfig(*serverConfig, serverYAML, "server", []int{port}, dims, c); err != nil {
+			r.note = err.Error()
+			return r
+		}
+		var args []string
+		if providers[i] > 0 {
+			args = []string{"-capacity", strconv.Itoa(providers[i])}
+		}
+		if i == 0 {
+			args = append(args, strings.Fields(*firstServer)...)
+		}
+		server, err := start(dir, name, *serverBin, serverYAML, args...)
+		if err != nil {
+			r.note = err.Error()
+			return r
+		}
+		defer server.stop()
+		if err := waitListening(port, 30*time.Second, server); err != nil {
+			r.note = name + ": " + err.Error()
+			return r
+		}
+	}
+
+	recPath := filepath.Join(dir, "record.jsonl")
+	args := append([]string{
+		"-d", duration.String(),
+		"-record", recPath,
+		// every attempt is recorded; retries would count some failures twice
+		"-on-error", "write_timeout=continue,no_provider=continue",
+	}, strings.Fields(c.load)...)
+	client, err := start(dir, "client", *clientBin, clientYAML, args...)
+	if err != nil {
+		r.note = err.Error()
+		return r
+	}
+	// the client stops after -d, plus its config load and the calls still
+	// in flight, which can take up to request-timeout
+	if err := client.wait(*duration + *requestTimeout + 30*time.Second); err != nil {
+		r.note = "client: " + err.Error()
+	}
+	if m, err := measure(recPath, *warmup, running); err != nil {
+		r.note = strings.TrimPrefix(r.note+"; ", "; ") + err.Error()
+	} else {
+		r.metrics = m
+	}
+	return r
+}
+
+// writeConfig writes base to path with the provider's port, or the ports of
+// every provider for the client, the request timeout and side's values of c.
+func writeConfig(base, path, side string, ports []int, dims []dimension, c combination) error {
+	b, err := os.ReadFile(base)
+	if err != nil {
+		return err
+	}
+	var conf map[string]interface{}
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		return fmt.Errorf("%s: %v", base, err)
+	}
+	root := child(conf, "dubbo")
+	dubbo := child(child(root, "protocols"), "dubbo")
+	dubbo["name"] = "dubbo"
+	if side == "server" {
+		dubbo["port"] = ports[0]
+		// nobody else is calling it; don't wait for consumers on shutdown
+		shutdown := child(root, "shutdown")
+		shutdown["consumer-update-wait-time"] = "0s"
+		shutdown["timeout"] = "5s"
+	} else {
+		consumer := child(root, "consumer")
+		consumer["request-timeout"] = requestTimeout.String()
+		urls := make([]string, len(ports))
+		for i, port := range ports {
+			urls[i] = fmt.Sprintf("dubbo://127.0.0.1:%d", port)
+		}
+		for _, ref := range child(consumer, "references") {
+			if ref, ok := ref.(map[string]interface{}); ok {
+				ref["url"] = strings.Join(urls, ";")
+			}
+		}
+	}
+	params := child(dubbo, "params")
+	for i, d := range dims {
+		if d.side != side && d.side != "both" {
+			continue
+		}
+		if d.apply != nil {
+			d.apply(root, c.values[i])
+			continue
+		}
+		m := params
+		for _, key := range d.path[:len(d.path)-1] {
+			m = child(m, key)
+		}
+		m[d.path[len(d.path)-1]] = scalar(c.values[i])
+	}
+	if len(params) == 0 {
+		delete(dubbo, "params")
+	}
+	b, err = yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// child returns m[key] as a map, creating it if it is missing.
+func child(m map[string]interface{}, key string) map[string]interface{} {
+	if c, ok := m[key].(map[string]interface{}); ok {
+		return c
+	}
+	c := map[string]interface{}{}
+	m[key] = c
+	return c
+}
+
+// scalar types v the way it would be in a hand-written yaml, so that getty
+// reads sizes as ints and durations as strings.
+func scalar(v string) interface{} {
+	if i, err := strconv.Atoi(v); err == nil {
+		return i
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	return v
+}
+
+// proc is a running provider or consumer.
+type proc struct {
+	name string
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error // set when done is closed
+}
+
+// start runs bin with its output in dir/name.log.
+func start(dir, name, bin, config string, args ...string) (*proc, error) {
+	out, err := os.Create(filepath.Join(dir, name+".log"))
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "DUBBO_GO_CONFIG_PATH="+config)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	p := &proc{name: name, cmd: cmd, done: make(chan struct{})}
+	go func() {
+		p.err = cmd.Wait()
+		out.Close()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// wait waits for p to exit, killing it after limit.
+func (p *proc) wait(limit time.Duration) error {
+	select {
+	case <-p.done:
+	case <-time.After(limit):
+		log.Printf("%s still running after %v, killing it\n", p.name, limit)
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+	return p.err
+}
+
+// stop sends p SIGTERM so the provider runs its shutdown sequence.
+func (p *proc) stop() {
+	p.cmd.Process.Signal(syscall.SIGTERM)
+	p.wait(15 * time.Second)
+}
+
+func waitListening(port int, within time.Duration, p *proc) error {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	deadline := time.After(within)
+	for {
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-p.done:
+			return fmt.Errorf("exited: %v", p.err)
+		case <-deadline:
+			return fmt.Errorf("not listening on %s after %v", addr, within)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	duration       = flag.Duration("d", 20*time.Second, "how long the client runs for each combination")
+	warmup         = flag.Duration("warmup", 2*time.Second, "leave calls that started this early in a run out of the results")
+	requestTimeout = flag.Duration("request-timeout", 3*time.Second, "consumer request-timeout")
+	out            = flag.String("o", "sweep", "write the results to OUT.csv and OUT.md")
+	workDir        = flag.String("work", "", "keep configs, logs and recordings of every run here; a temp dir if empty")
+	serverBin      = flag.String("server-bin", "", "cmd/server binary, built from ./cmd/server if empty")
+	clientBin      = flag.String("client-bin", "", "cmd/client binary, built from ./cmd/client if empty")
+	serverConfig   = flag.String("server-config", "dubbo-server-direct.yaml", "provider config every run starts from")
+	clientConfig   = flag.String("client-config", "dubbo-client-direct.yaml", "consumer config every run starts from")
+	balance        = flag.String("balance", "", "consumer load balancing to compare, e.g. random,adaptivesvc,hedged; adaptivesvc is the adaptivesvc cluster with p2c, hedged the hedged cluster with random, the others failover with that loadbalance")
+	firstServer    = flag.String("first-server", "", "extra cmd/server flags for the first provider only, e.g. '-stall-rate 0.05 -stall-for 1s'")
+	dims           dimensions
+	loads          loadLevels
+	providers      = capacities{0}
+)
+
+func init() {
+	flag.Var(&dims, "vary", "getty setting and its values, e.g. client.getty-session-param.tcp-read-timeout=1s,5s; repeatable")
+	flag.Var(&loads, "load", "cmd/client flags for one load level, e.g. '-c 16 -qps 200 -cost fixed:10ms'; repeatable")
+	flag.Var(&providers, "providers", "cmd/server -capacity of each provider a run starts, e.g. 2,8,32 for three; 0 for no limit")
+}
+
+// dimension is one getty setting to vary. side is client, server or both;
+// path is its key under protocols.dubbo.params, e.g.
+// getty-session-param.tcp-read-timeout. Dimensions that are not getty
+// settings have apply set the value in the config instead.
+type dimension struct {
+	name   string // as given, the column header
+	side   string
+	path   []string
+	values []string
+	apply  func(root map[string]interface{}, value string)
+}
+
+type dimensions []dimension
+
+func (d *dimensions) String() string {
+	var parts []string
+	for _, dim := range *d {
+		parts = append(parts, dim.name+"="+strings.Join(dim.values, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (d *dimensions) Set(v string) error {
+	key, values, ok := strings.Cut(v, "=")
+	if !ok || values == "" {
+		return fmt.Errorf("want SIDE.KEY=V1,V2,..., got %q", v)
+	}
+	side, path, ok := strings.Cut(key, ".")
+	if !ok || (side != "client" && side != "server" && side != "both") {
+		return fmt.Errorf("%q: key must start with client., server. or both.", key)
+	}
+	*d = append(*d, dimension{name: key, side: side, path: strings.Split(path, "."), values: strings.Split(values, ",")})
+	return nil
+}
+
+type loadLevels []string
+
+func (l *loadLevels) String() string { return strings.Join(*l, "; ") }
+
+func (l *loadLevels) Set(v string) error {
+	*l = append(*l, strings.TrimSpace(v))
+	return nil
+}
+
+// balanceDimension compares the consumer load balancing given as -balance.
+func balanceDimension(values string) dimension {
+	return dimension{name: "balance", side: "client", values: strings.Split(values, ","), apply: setBalance}
+}
+
+// setBalance points every reference at the adaptivesvc cluster, registered
+// as adaptiveService, with the p2c loadbalance it needs for adaptivesvc, at
+// the hedged cluster with random for hedged, and at the failover cluster
+// with the loadbalance named otherwise.
+func setBalance(root map[string]interface{}, value string) {
+	cluster, lb := "failover", value
+	switch value {
+	case "adaptivesvc":
+		cluster, lb = "adaptiveService", "p2c"
+	case "hedged":
+		cluster, lb = "hedged", "random"
+	}
+	for _, ref := range child(child(root, "consumer"), "references") {
+		if ref, ok := ref.(map[string]interface{}); ok {
+			ref["cluster"], ref["loadbalance"] = cluster, lb
+		}
+	}
+}
+
+// capacities are the -capacity of the providers of a run.
+type capacities []int
+
+func (c *capacities) String() string {
+	parts := make([]string, len(*c))
+	for i, n := range *c {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c *capacities) Set(v string) error {
+	var caps capacities
+	for _, s := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 {
+			return fmt.Errorf("want a capacity of 0 or more, got %q", s)
+		}
+		caps = append(caps, n)
+	}
+	*c = caps
+	return nil
+}
+
+// label names provider i of caps in the results by its capacity, and by
+// its place too when another provider has the same capacity.
+func label(caps capacities, i int) string {
+	l := "cap" + strconv.Itoa(caps[i])
+	if caps[i] == 0 {
+		l = "nocap"
+	}
+	for j, n := range caps {
+		if j != i && n == caps[i] {
+			return fmt.Sprintf("%s#%d", l, i+1)
+		}
+	}
+	return l
+}
+
+// combination is one cell of the matrix: a value for every dimension and a
+// load level.
+type combination struct {
+	values []string // parallel to dims
+	load   string
+}
+
+// matrix is every combination of dimension values and load levels, the
+// last dimension varying fastest.
+func matrix(dims []dimension, loads []string) []combination {
+	combos := []combination{{}}
+	for _, d := range dims {
+		var next []combination
+		for _, c := range combos {
+			for _, v := range d.values {
+				next = append(next, combination{values: append(append([]string(nil), c.values...), v)})
+			}
+		}
+		combos = next
+	}
+	var all []combination
+	for _, c := range combos {
+		for _, l := range loads {
+			all = append(all, combination{values: c.values, load: l})
+		}
+	}
+	return all
+}
+
+// Usage: sweep [-vary SIDE.KEY=V1,V2]... [-load 'CLIENT FLAGS']... [-providers 0] [-first-server 'SERVER FLAGS'] [-balance LB1,LB2] [-d 20s] [-warmup 2s] [-o sweep] [-work DIR]
+func main() {
+	flag.Parse()
+	if *balance != "" {
+		dims = append(dims, balanceDimension(*balance))
+	}
+	if len(loads) == 0 {
+		loads = loadLevels{"-c 8 -cost fixed:10ms"}
+	}
+	combos := matrix(dims, loads)
+
+	dir := *workDir
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "sweep"); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	// the runs start in their own directories
+	for _, path := range []*string{&dir, serverBin, clientBin, serverConfig, clientConfig} {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*path = abs
+	}
+	bins := map[string]*string{"server": serverBin, "client": clientBin}
+	for name, bin := range bins {
+		if *bin != "" {
+			continue
+		}
+		*bin = filepath.Join(dir, name)
+		log.Printf("building ./cmd/%s\n", name)
+		build := exec.Command("go", "build", "-o", *bin, "./cmd/"+name)
+		build.Stdout, build.Stderr = os.Stderr, os.Stderr
+		if err := build.Run(); err != nil {
+			log.Fatalf("build %s: %v", name, err)
+		}
+	}
+
+	log.Printf("sweep: %d combinations of %v x %d load levels, %v each, providers %v, runs in %s\n",
+		len(combos), &dims, len(loads), *duration, &providers, dir)
+	var results []result
+	for i, c := range combos {
+		runDir := filepath.Join(dir, fmt.Sprintf("run%03d", i+1))
+		log.Printf("run %d/%d: %s\n", i+1, len(combos), describe(dims, c))
+		r := runOne(runDir, dims, c)
+		log.Printf("run %d/%d: %s\n", i+1, len(combos), r.summary())
+		results = append(results, r)
+		// write as we go so an interrupted sweep keeps what it measured
+		if err := writeResults(*out, dims, results); err != nil {
+			log.Fatal(err)
+		}
+	}
+	writeMarkdown(os.Stdout, dims, results)
+	log.Printf("results in %s.csv and %s.md\n", *out, *out)
+}
+
+func describe(dims []dimension, c combination) string {
+	var parts []string
+	for i, d := range dims {
+		parts = append(parts, d.name+"="+c.values[i])
+	}
+	return strings.Join(append(parts, "load="+c.load), " ")
+}
@@ -0,0 +1,286 @@
+// Package breaker puts a circuit breaker on consumer methods, using the
+// vendored sentinel-consumer filter and sentinel's circuit breakers. The
+// thresholds are set per method under consumer.filter-conf.breaker; calls the
+// breaker turns away fail at once with an *OpenError instead of waiting out
+// the request timeout on a provider that is stuck.
+//
+// The vendored filter keeps its sentinel entries in the context it passes
+// down, and dubbo-go hands the filter's OnResponse the context from above,
+// so the entries would never be exited and the breakers would never see a
+// call end. The breaker filter, listed right after sentinel-consumer, exits
+// them instead.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/config"
+	"dubbo.apache.org/dubbo-go/v3/filter"
+	sentinelfilter "dubbo.apache.org/dubbo-go/v3/filter/sentinel"
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+	sentinel "github.com/alibaba/sentinel-golang/api"
+	"github.com/alibaba/sentinel-golang/core/base"
+	"github.com/alibaba/sentinel-golang/core/circuitbreaker"
+	"gopkg.in/yaml.v3"
+
+	"dubbo-demo/internal/metrics"
+)
+
+// FilterKey names the filter that goes right after sentinel-consumer in
+// consumer.filter.
+const FilterKey = "breaker"
+
+// confKey is the key of the breaker settings in consumer.filter-conf.
+const confKey = "breaker"
+
+func init() {
+	extension.SetFilter(FilterKey, func() filter.Filter { return breakerFilter{} })
+	sentinelfilter.SetDubboConsumerFallback(fallback)
+	circuitbreaker.RegisterStateChangeListeners(listener{})
+}
+
+// MethodConfig is the breaker of one method, from
+// consumer.filter-conf.breaker.<method>.
+type MethodConfig struct {
+	// Strategy is what opens the breaker: error-ratio, error-count or
+	// slow-ratio.
+	Strategy string `yaml:"strategy"`
+	// Threshold is the share of failed calls, the number of failed calls,
+	// or the share of slow calls in a window that opens the breaker.
+	Threshold float64 `yaml:"threshold"`
+	// Slow is how long a call may take before slow-ratio counts it as slow.
+	Slow time.Duration `yaml:"slow"`
+	// MinRequests is how many calls a window needs before it can open the
+	// breaker.
+	MinRequests uint64 `yaml:"min-requests"`
+	// Window is the statistic window.
+	Window time.Duration `yaml:"window"`
+	// OpenFor is how long the breaker stays open before it lets a probe
+	// through, half-open.
+	OpenFor time.Duration `yaml:"open-for"`
+}
+
+var strategies = map[string]circuitbreaker.Strategy{
+	"error-ratio": circuitbreaker.ErrorRatio,
+	"error-count": circuitbreaker.ErrorCount,
+	"slow-ratio":  circuitbreaker.SlowRequestRatio,
+}
+
+func (c MethodConfig) rule(resource string) (*circuitbreaker.Rule, error) {
+	strategy, ok := strategies[c.Strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q, want error-ratio, error-count or slow-ratio", c.Strategy)
+	}
+	r := &circuitbreaker.Rule{
+		Resource:         resource,
+		Strategy:         strategy,
+		RetryTimeoutMs:   uint32(c.OpenFor.Milliseconds()),
+		MinRequestAmount: c.MinRequests,
+		StatIntervalMs:   uint32(c.Window.Milliseconds()),
+		MaxAllowedRtMs:   uint64(c.Slow.Milliseconds()),
+		Threshold:        c.Threshold,
+	}
+	if err := circuitbreaker.IsValidRule(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+var (
+	confOnce sync.Once
+	conf     map[string]MethodConfig
+)
+
+// methodConfig returns the breaker settings of method. They are read on the
+// first call, once the config is loaded.
+func methodConfig(method string) (MethodConfig, bool) {
+	confOnce.Do(func() {
+		raw, ok := config.GetConsumerConfig().FilterConf.(map[string]interface{})
+		if !ok || raw[confKey] == nil {
+			return
+		}
+		b, err := yaml.Marshal(raw[confKey])
+		if err == nil {
+			err = yaml.Unmarshal(b, &conf)
+		}
+		if err != nil {
+			log.Printf("breaker: consumer.filter-conf.%s: %v, no method has a breaker\n", confKey, err)
+		}
+	})
+	c, ok := conf[method]
+	return c, ok
+}
+
+// breaker is what the listener knows of the breaker of one resource.
+type breaker struct {
+	method string
+	state  circuitbreaker.State
+	retry  time.Time // when an open breaker lets a probe through
+}
+
+var (
+	mu       sync.Mutex
+	breakers = map[string]*breaker{} // by sentinel resource; nil for methods without one
+)
+
+// ensure loads the rule of the method behind resource on its first call.
+// That first call goes through unguarded.
+func ensure(resource, method string) {
+	mu.Lock()
+	_, seen := breakers[resource]
+	if !seen {
+		breakers[resource] = nil
+	}
+	mu.Unlock()
+	if seen {
+		return
+	}
+	c, ok := methodConfig(method)
+	if !ok {
+		return
+	}
+	rule, err := c.rule(resource)
+	if err != nil {
+		log.Printf("breaker: %s: %v, calls are not guarded\n", method, err)
+		return
+	}
+	mu.Lock()
+	breakers[resource] = &breaker{method: method, state: circuitbreaker.Closed}
+	mu.Unlock()
+	if _, err := circuitbreaker.LoadRulesOfResource(resource, []*circuitbreaker.Rule{rule}); err != nil {
+		log.Printf("breaker: %s: %v, calls are not guarded\n", method, err)
+		return
+	}
+	metrics.BreakerState(method, stateName(circuitbreaker.Closed))
+	log.Printf("breaker: %s closed, %s threshold=%v min-requests=%d window=%v open-for=%v\n",
+		method, c.Strategy, c.Threshold, c.MinRequests, c.Window, c.OpenFor)
+}
+
+// OpenError is the error of a call the circuit breaker turned away. The call
+// was never sent.
+type OpenError struct {
+	Method string
+	// State is "open", or "half-open" while the probe is out.
+	State string
+	// RetryAt is when the breaker lets the next probe through, as far as
+	// known; a half-open breaker decides when its probe returns.
+	RetryAt time.Time
+}
+
+func (e *OpenError) Error() string {
+	if e.State == stateName(circuitbreaker.HalfOpen) {
+		return fmt.Sprintf("circuit breaker for %s is half-open, waiting for its probe", e.Method)
+	}
+	return fmt.Sprintf("circuit breaker for %s is open, next probe in %v", e.Method, time.Until(e.RetryAt).Round(time.Millisecond))
+}
+
+// fallback answers the calls sentinel blocks.
+func fallback(_ context.Context, _ protocol.Invoker, inv protocol.Invocation, b *base.BlockError) protocol.Result {
+	if b.BlockType() != base.BlockTypeCircuitBreaking {
+		return &protocol.RPCResult{Err: b}
+	}
+	e := &OpenError{Method: inv.MethodName(), State: stateName(circuitbreaker.Open)}
+	mu.Lock()
+	for _, br := range breakers {
+		if br != nil && br.method == e.Method {
+			e.State, e.RetryAt = stateName(br.state), br.retry
+			break
+		}
+	}
+	mu.Unlock()
+	return &protocol.RPCResult{Err: e}
+}
+
+type breakerFilter struct{}
+
+// misplaced logs a filter list without sentinel-consumer before breaker once.
+var misplaced sync.Once
+
+// Invoke loads the method's rule on its first call and exits the entries
+// sentinel-consumer made once the call is over, recording its error.
+func (breakerFilter) Invoke(ctx context.Context, invoker protocol.Invoker, inv protocol.Invocation) protocol.Result {
+	methodEntry, _ := ctx.Value(sentinelfilter.MethodEntryKey).(*base.SentinelEntry)
+	if methodEntry == nil {
+		misplaced.Do(func() {
+			log.Printf("breaker: no sentinel entry on %s, list %s right after sentinel-consumer\n", inv.MethodName(), FilterKey)
+		})
+		return invoker.Invoke(ctx, inv)
+	}
+	ensure(methodEntry.Resource().Name(), inv.MethodName())
+
+	result := invoker.Invoke(ctx, inv)
+	for _, key := range []interface{}{sentinelfilter.MethodEntryKey, sentinelfilter.InterfaceEntryKey} {
+		if e, ok := ctx.Value(key).(*base.SentinelEntry); ok {
+			if err := result.Error(); err != nil {
+				sentinel.TraceError(e, err)
+			}
+			e.Exit()
+		}
+	}
+	return result
+}
+
+func (breakerFilter) OnResponse(_ context.Context, result protocol.Result, _ protocol.Invoker, _ protocol.Invocation) protocol.Result {
+	return result
+}
+
+// IsOpen reports whether err, or an error it wraps, is an *OpenError.
+func IsOpen(err error) bool {
+	var e *OpenError
+	return errors.As(err, &e)
+}
+
+// stateName is the lower-case, dashed form of s, as in logs and metrics.
+func stateName(s circuitbreaker.State) string {
+	switch s {
+	case circuitbreaker.Closed:
+		return "closed"
+	case circuitbreaker.HalfOpen:
+		return "half-open"
+	case circuitbreaker.Open:
+		return "open"
+	}
+	return strings.ToLower((&s).String())
+}
+
+// listener logs and counts the transitions of the breakers loaded here.
+type listener struct{}
+
+func (listener) transition(resource string, prev, to circuitbreaker.State, detail string) {
+	mu.Lock()
+	br := breakers[resource]
+	if br != nil {
+		br.state = to
+	}
+	mu.Unlock()
+	if br == nil {
+		return
+	}
+	metrics.BreakerTransition(br.method, stateName(prev), stateName(to))
+	log.Printf("breaker: %s %s -> %s%s\n", br.method, stateName(prev), stateName(to), detail)
+}
+
+func (l listener) OnTransformToClosed(prev circuitbreaker.State, rule circuitbreaker.Rule) {
+	l.transition(rule.Resource, prev, circuitbreaker.Closed, "")
+}
+
+func (l listener) OnTransformToOpen(prev circuitbreaker.State, rule circuitbreaker.Rule, snapshot interface{}) {
+	openFor := time.Duration(rule.RetryTimeoutMs) * time.Millisecond
+	mu.Lock()
+	if br := breakers[rule.Resource]; br != nil {
+		br.retry = time.Now().Add(openFor)
+	}
+	mu.Unlock()
+	l.transition(rule.Resource, prev, circuitbreaker.Open, fmt.Sprintf(" at %s %v, probing in %v", rule.Strategy, snapshot, openFor))
+}
+
+func (l listener) OnTransformToHalfOpen(prev circuitbreaker.State, rule circuitbreaker.Rule) {
+	l.transition(rule.Resource, prev, circuitbreaker.HalfOpen, ", probing")
+}
@@ -0,0 +1,173 @@
+// Package capacity follows how the consumer's calls spread over the providers
+// and how much capacity each has left. Its consumer filter counts the calls
+// that went to every provider, and keeps the remaining capacity and calls in
+// flight that the provider's adaptivesvc filter sends back with each
+// response: what the adaptivesvc cluster's p2c load balancing picks
+// providers by.
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/filter"
+	"dubbo.apache.org/dubbo-go/v3/filter/adaptivesvc"
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+
+	"dubbo-demo/internal/metrics"
+)
+
+// FilterKey names the filter that counts the calls of every provider, for
+// consumer.filter or a reference's filter.
+const FilterKey = "capacity"
+
+func init() {
+	extension.SetFilter(FilterKey, func() filter.Filter { return capacityFilter{} })
+}
+
+// Provider is what the consumer knows of one provider.
+type Provider struct {
+	Address string
+	// Calls counts the calls that went to the provider; Failed those that
+	// failed, Rejected those among them its limiter turned away.
+	Calls, Failed, Rejected uint64
+	// Remaining and Inflight are what the provider's limiter reported with
+	// its last response; Reported is false until it has.
+	Remaining, Inflight uint64
+	Reported            bool
+}
+
+var (
+	mu        sync.Mutex
+	providers = map[string]*Provider{}
+)
+
+// Snapshot returns the providers called so far, by address.
+func Snapshot() []Provider {
+	mu.Lock()
+	out := make([]Provider, 0, len(providers))
+	for _, p := range providers {
+		out = append(out, *p)
+	}
+	mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// Report writes the calls and last capacity of every provider.
+func Report(w io.Writer) {
+	ps := Snapshot()
+	var total uint64
+	for _, p := range ps {
+		total += p.Calls
+	}
+	for _, p := range ps {
+		fmt.Fprintf(w, "provider[%s]: calls=%d (%.1f%%) failed=%d rejected=%d %s\n",
+			p.Address, p.Calls, percent(p.Calls, total), p.Failed, p.Rejected, p.Capacity())
+	}
+}
+
+// Capacity describes the provider's last reported capacity.
+func (p Provider) Capacity() string {
+	if !p.Reported {
+		return "remaining=? inflight=?"
+	}
+	return fmt.Sprintf("remaining=%d inflight=%d", p.Remaining, p.Inflight)
+}
+
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// IsRejected reports whether err is a provider's adaptivesvc limiter turning
+// the call away.
+func IsRejected(err error) bool {
+	return err != nil && strings.Contains(err.Error(), adaptivesvc.ErrAdaptiveSvcInterrupted.Error())
+}
+
+type ctxKey struct{}
+
+// WithProvider returns ctx in which the filter writes the address of the
+// provider that served the call to *addr.
+func WithProvider(ctx context.Context, addr *string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, addr)
+}
+
+// ProviderOut returns the address WithProvider put in ctx, nil if none. A
+// cluster that calls several providers for one call, like the hedged one,
+// writes the provider that answered to it.
+func ProviderOut(ctx context.Context) *string {
+	p, _ := ctx.Value(ctxKey{}).(*string)
+	return p
+}
+
+type capacityFilter struct{}
+
+// Invoke counts the call under its provider and keeps the capacity the
+// provider reported with the response.
+func (capacityFilter) Invoke(ctx context.Context, invoker protocol.Invoker, inv protocol.Invocation) protocol.Result {
+	result := invoker.Invoke(ctx, inv)
+	addr := invoker.GetURL().Location
+	if p := ProviderOut(ctx); p != nil {
+		*p = addr
+	}
+	remaining, ok := attachment(result, constant.AdaptiveServiceRemainingKey)
+	inflight, _ := attachment(result, constant.AdaptiveServiceInflightKey)
+
+	outcome := "ok"
+	mu.Lock()
+	p := providers[addr]
+	if p == nil {
+		p = &Provider{Address: addr}
+		providers[addr] = p
+	}
+	p.Calls++
+	if err := result.Error(); err != nil {
+		outcome = "error"
+		p.Failed++
+		if IsRejected(err) {
+			outcome = "rejected"
+			p.Rejected++
+		}
+	}
+	if ok {
+		p.Remaining, p.Inflight, p.Reported = remaining, inflight, true
+	}
+	mu.Unlock()
+
+	metrics.ProviderCall(addr, outcome)
+	if ok {
+		metrics.ProviderCapacity(addr, remaining, inflight)
+	}
+	return result
+}
+
+func (capacityFilter) OnResponse(_ context.Context, result protocol.Result, _ protocol.Invoker, _ protocol.Invocation) protocol.Result {
+	return result
+}
+
+// attachment reads a number from the attachments of a response, a string
+// over dubbo and a []string over triple.
+func attachment(result protocol.Result, key string) (uint64, bool) {
+	var s string
+	switch v := result.Attachment(key, nil).(type) {
+	case string:
+		s = v
+	case []string:
+		if len(v) > 0 {
+			s = v[0]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,163 @@
+// Package chaos shapes one direction of a byte stream: it adds latency,
+// limits bandwidth and pauses reading so the sender's TCP window fills up.
+// cmd/chaosproxy applies it to both directions of every proxied connection.
+package chaos
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// forever stands in for "until resumed".
+const forever = 100 * 365 * 24 * time.Hour
+
+// Settings is a snapshot of a Direction.
+type Settings struct {
+	Latency time.Duration `json:"latency"`
+	// Rate is the bandwidth limit in bytes per second, 0 for none.
+	Rate        int64     `json:"rate"`
+	PausedUntil time.Time `json:"paused_until,omitempty"`
+}
+
+// Paused reports whether reading is paused at t.
+func (s Settings) Paused(t time.Time) bool { return t.Before(s.PausedUntil) }
+
+// Direction holds the faults for one direction. It is safe for concurrent
+// use; changes take effect on the next read or write.
+type Direction struct {
+	mu      sync.Mutex
+	s       Settings
+	next    time.Time     // when the rate limiter next has budget
+	changed chan struct{} // closed and replaced on every change
+}
+
+// NewDirection returns a Direction with no faults.
+func NewDirection() *Direction {
+	return &Direction{changed: make(chan struct{})}
+}
+
+// Settings returns the current settings.
+func (d *Direction) Settings() Settings {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.s
+}
+
+// Apply replaces all settings at once.
+func (d *Direction) Apply(s Settings) {
+	d.update(func(cur *Settings) { *cur = s })
+}
+
+// SetLatency delays everything written from now on by l.
+func (d *Direction) SetLatency(l time.Duration) {
+	d.update(func(s *Settings) { s.Latency = l })
+}
+
+// SetRate limits throughput to rate bytes per second, 0 to lift the limit.
+func (d *Direction) SetRate(rate int64) {
+	d.update(func(s *Settings) { s.Rate = rate })
+}
+
+// Pause stops reading for dur, or until Resume when dur is 0.
+func (d *Direction) Pause(dur time.Duration) {
+	if dur <= 0 {
+		dur = forever
+	}
+	d.update(func(s *Settings) { s.PausedUntil = time.Now().Add(dur) })
+}
+
+// Resume ends a pause.
+func (d *Direction) Resume() {
+	d.update(func(s *Settings) { s.PausedUntil = time.Time{} })
+}
+
+func (d *Direction) update(fn func(*Settings)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn(&d.s)
+	if d.s.Rate <= 0 {
+		d.next = time.Time{}
+	}
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Wait blocks while reading is paused. It returns false if done is closed
+// first.
+func (d *Direction) Wait(done <-chan struct{}) bool {
+	for {
+		d.mu.Lock()
+		until, changed := d.s.PausedUntil, d.changed
+		d.mu.Unlock()
+		left := time.Until(until)
+		if left <= 0 {
+			return true
+		}
+		t := time.NewTimer(left)
+		select {
+		case <-t.C:
+		case <-changed:
+			t.Stop()
+		case <-done:
+			t.Stop()
+			return false
+		}
+	}
+}
+
+// Chunk caps a read of max bytes so a rate limit is applied smoothly rather
+// than in bursts of a whole buffer.
+func (d *Direction) Chunk(max int) int {
+	d.mu.Lock()
+	rate := d.s.Rate
+	d.mu.Unlock()
+	if rate <= 0 {
+		return max
+	}
+	c := int(rate / 20)
+	if c < 512 {
+		c = 512
+	}
+	if c > max {
+		c = max
+	}
+	return c
+}
+
+// Pace reserves n bytes of bandwidth and returns how long to wait before
+// moving them.
+func (d *Direction) Pace(n int) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.s.Rate <= 0 || n <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if d.next.Before(now) {
+		d.next = now
+	}
+	wait := d.next.Sub(now)
+	d.next = d.next.Add(time.Duration(int64(n) * int64(time.Second) / d.s.Rate))
+	return wait
+}
+
+// Reader returns r with the pause and the rate limit of d applied to every
+// Read. Latency is left to the caller, which knows when bytes are due.
+func (d *Direction) Reader(r io.Reader) io.Reader {
+	return &reader{r: r, d: d}
+}
+
+type reader struct {
+	r io.Reader
+	d *Direction
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	r.d.Wait(nil)
+	n, err := r.r.Read(p[:r.d.Chunk(len(p))])
+	// pacing after the read keeps the socket from being drained faster than
+	// the rate; the next Read is what waits
+	time.Sleep(r.d.Pace(n))
+	return n, err
+}
@@ -0,0 +1,107 @@
+// Package deadline carries a consumer's remaining time budget to the
+// provider. The consumer filter sends the budget as an attachment, and the
+// provider filter turns it back into a context deadline, so handlers can stop
+// work nobody is waiting for any more.
+package deadline
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/config"
+	"dubbo.apache.org/dubbo-go/v3/filter"
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+)
+
+const (
+	// ConsumerFilterKey names the filter that sends the budget, for
+	// consumer.filter or a reference's filter.
+	ConsumerFilterKey = "deadline-consumer"
+	// ProviderFilterKey names the filter that applies it, for
+	// provider.filter or a service's filter.
+	ProviderFilterKey = "deadline-provider"
+
+	// BudgetKey is the attachment holding the remaining budget in
+	// milliseconds.
+	BudgetKey = "deadline-budget"
+)
+
+func init() {
+	extension.SetFilter(ConsumerFilterKey, func() filter.Filter { return consumerFilter{} })
+	extension.SetFilter(ProviderFilterKey, func() filter.Filter { return providerFilter{} })
+}
+
+type consumerFilter struct{}
+
+// Invoke attaches the smaller of the configured request timeout and the time
+// left on ctx. A call whose ctx has already expired is not sent at all.
+func (consumerFilter) Invoke(ctx context.Context, invoker protocol.Invoker, inv protocol.Invocation) protocol.Result {
+	budget := timeout(invoker, inv)
+	if d, ok := ctx.Deadline(); ok {
+		left := time.Until(d)
+		if left <= 0 {
+			return &protocol.RPCResult{Err: context.DeadlineExceeded}
+		}
+		if budget <= 0 || left < budget {
+			budget = left
+		}
+	}
+	if budget > 0 {
+		inv.SetAttachment(BudgetKey, strconv.FormatInt(budget.Milliseconds(), 10))
+	}
+	return invoker.Invoke(ctx, inv)
+}
+
+func (consumerFilter) OnResponse(_ context.Context, result protocol.Result, _ protocol.Invoker, _ protocol.Invocation) protocol.Result {
+	return result
+}
+
+// timeout is the request timeout the dubbo invoker will apply to inv.
+func timeout(invoker protocol.Invoker, inv protocol.Invocation) time.Duration {
+	url := invoker.GetURL()
+	def := config.GetConsumerConfig().RequestTimeout
+	method := strings.Join([]string{constant.MethodKeys, inv.MethodName(), constant.TimeoutKey}, ".")
+	if s := url.GetParam(method, ""); s != "" {
+		def = s
+	}
+	return url.GetParamDuration(constant.TimeoutKey, def)
+}
+
+type providerFilter struct{}
+
+// Invoke runs the call under the budget the consumer sent. Without one it
+// falls back to the request timeout dubbo consumers attach, and without that
+// the call runs unbounded as before.
+func (providerFilter) Invoke(ctx context.Context, invoker protocol.Invoker, inv protocol.Invocation) protocol.Result {
+	budget, ok := Budget(inv)
+	if !ok {
+		return invoker.Invoke(ctx, inv)
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	return invoker.Invoke(ctx, inv)
+}
+
+func (providerFilter) OnResponse(_ context.Context, result protocol.Result, _ protocol.Invoker, _ protocol.Invocation) protocol.Result {
+	return result
+}
+
+// Budget returns the time budget attached to inv.
+func Budget(inv protocol.Invocation) (time.Duration, bool) {
+	for _, key := range []string{BudgetKey, constant.TimeoutKey} {
+		s, ok := inv.GetAttachment(key)
+		if !ok {
+			continue
+		}
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || ms <= 0 {
+			continue
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	return 0, false
+}
@@ -0,0 +1,241 @@
+// Package dubboframe decodes dubbo protocol frames for inspection. Complete
+// frames go through dubbo-go's protocol/dubbo/impl codec. Frames cut short,
+// as log dumps and packet captures often are, are decoded field by field as
+// far as their bytes go.
+package dubboframe
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+
+	"dubbo.apache.org/dubbo-go/v3/protocol/dubbo/impl"
+	hessian "github.com/apache/dubbo-go-hessian2"
+
+	"dubbo-demo/internal/hessianjson"
+)
+
+// HeaderLen is the fixed length of a dubbo frame header.
+const HeaderLen = impl.HEADER_LENGTH
+
+// ErrNotFrame is returned when bytes do not start with the dubbo magic.
+var ErrNotFrame = errors.New("dubboframe: no dubbo magic")
+
+// Header is the fixed 16 byte frame header.
+type Header struct {
+	Magic    string `json:"magic"`
+	Request  bool   `json:"request"`
+	TwoWay   bool   `json:"two_way,omitempty"`
+	Event    bool   `json:"event,omitempty"`
+	SerialID byte   `json:"serialization_id"`
+	Status   byte   `json:"status,omitempty"`
+	ID       int64  `json:"request_id"`
+	BodyLen  int    `json:"body_length"`
+}
+
+// Request is the hessian body of a request frame.
+type Request struct {
+	DubboVersion   string                 `json:"dubbo_version"`
+	Path           string                 `json:"path"`
+	Version        string                 `json:"version"`
+	Method         string                 `json:"method"`
+	ParameterTypes string                 `json:"parameter_types"`
+	Arguments      []interface{}          `json:"arguments"`
+	Attachments    map[string]interface{} `json:"attachments,omitempty"`
+}
+
+// Response is the hessian body of a response frame.
+type Response struct {
+	Kind        string                 `json:"kind"` // value, null or exception
+	Value       interface{}            `json:"value,omitempty"`
+	Exception   interface{}            `json:"exception,omitempty"`
+	Attachments map[string]interface{} `json:"attachments,omitempty"`
+}
+
+// Frame is one frame decoded as far as its bytes allow.
+type Frame struct {
+	Header   Header      `json:"header"`
+	Request  *Request    `json:"request,omitempty"`
+	Response *Response   `json:"response,omitempty"`
+	Event    interface{} `json:"event,omitempty"`
+	// Have is how many of the frame's HeaderLen+BodyLen bytes were present.
+	Have      int    `json:"have_bytes"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Len returns the total length of the frame at the start of b, as declared
+// by its header. b must hold at least HeaderLen bytes.
+func Len(b []byte) (int, error) {
+	h, err := ParseHeader(b)
+	if err != nil {
+		return 0, err
+	}
+	return HeaderLen + h.BodyLen, nil
+}
+
+// ParseHeader reads the header at the start of b with the impl codec.
+func ParseHeader(b []byte) (Header, error) {
+	if len(b) < 2 || b[0] != impl.MAGIC_HIGH || b[1] != impl.MAGIC_LOW {
+		return Header{}, ErrNotFrame
+	}
+	if len(b) < HeaderLen {
+		return Header{}, fmt.Errorf("dubboframe: header needs %d bytes, have %d", HeaderLen, len(b))
+	}
+	var dh impl.DubboHeader
+	codec := impl.NewDubboCodec(bufio.NewReaderSize(bytes.NewReader(b), len(b)))
+	if err := codec.ReadHeader(&dh); err != nil && !errors.Is(err, hessian.ErrBodyNotEnough) {
+		return Header{}, fmt.Errorf("dubboframe: %w", err)
+	}
+	return Header{
+		Magic:    fmt.Sprintf("0x%02x%02x", b[0], b[1]),
+		Request:  b[2]&impl.FLAG_REQUEST != 0,
+		TwoWay:   b[2]&impl.FLAG_TWOWAY != 0,
+		Event:    b[2]&impl.FLAG_EVENT != 0,
+		SerialID: dh.SerialID,
+		Status:   dh.ResponseStatus,
+		ID:       dh.ID,
+		BodyLen:  dh.BodyLen,
+	}, nil
+}
+
+// Decode decodes the frame at the start of b. n is the frame length the
+// header declares, which is more than len(b) when the frame is truncated. An
+// error means not even the header could be read; body problems are reported
+// in Frame.Error.
+func Decode(b []byte) (f *Frame, n int, err error) {
+	h, err := ParseHeader(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	n = HeaderLen + h.BodyLen
+	f = &Frame{Header: h, Have: n}
+	// hessian and the impl codec assert types freely; garbage in a dump
+	// should not take the caller down.
+	defer func() {
+		if r := recover(); r != nil {
+			f.Error = fmt.Sprintf("decode panic: %v", r)
+		}
+	}()
+	body := b[HeaderLen:]
+	if len(b) < n {
+		f.Have = len(b)
+		f.Truncated = true
+	} else {
+		body = body[:h.BodyLen]
+	}
+
+	switch {
+	case h.Event:
+		f.Event, err = hessian.NewDecoder(body).Decode()
+		if err == nil {
+			f.Event = hessianjson.Value(f.Event)
+		}
+	case h.Request:
+		f.Request, err = decodeRequest(body, h, f.Truncated)
+	default:
+		f.Response, err = decodeResponse(body, h)
+	}
+	if err != nil {
+		f.Error = err.Error()
+	}
+	return f, n, nil
+}
+
+// decodeRequest uses the impl serializer for complete bodies and falls back
+// to reading the fields one by one, keeping what decodes before the cut.
+func decodeRequest(body []byte, h Header, truncated bool) (*Request, error) {
+	if !truncated {
+		pkg := &impl.DubboPackage{Header: impl.DubboHeader{Type: impl.PackageRequest, SerialID: h.SerialID, ID: h.ID}}
+		if err := (impl.HessianSerializer{}).Unmarshal(body, pkg); err == nil {
+			m, _ := pkg.Body.(map[string]interface{})
+			req := &Request{
+				Path:    pkg.Service.Path,
+				Version: pkg.Service.Version,
+				Method:  pkg.Service.Method,
+			}
+			req.DubboVersion, _ = m["dubboVersion"].(string)
+			req.ParameterTypes, _ = m["argsTypes"].(string)
+			args, _ := m["args"].([]interface{})
+			req.Arguments, _ = hessianjson.Value(args).([]interface{})
+			req.Attachments, _ = m["attachments"].(map[string]interface{})
+			hessianjson.Value(req.Attachments)
+			return req, nil
+		}
+	}
+
+	req := &Request{}
+	dec := hessian.NewDecoder(body)
+	for _, dst := range []*string{&req.DubboVersion, &req.Path, &req.Version, &req.Method, &req.ParameterTypes} {
+		v, err := dec.Decode()
+		if err != nil {
+			return req, err
+		}
+		*dst, _ = v.(string)
+	}
+	for range hessian.DescRegex.FindAllString(req.ParameterTypes, -1) {
+		v, err := dec.Decode()
+		if err != nil {
+			return req, err
+		}
+		req.Arguments = append(req.Arguments, hessianjson.Value(v))
+	}
+	v, err := dec.Decode()
+	if err != nil {
+		return req, err
+	}
+	req.Attachments, _ = hessianjson.Value(v).(map[string]interface{})
+	return req, nil
+}
+
+// decodeResponse reads a response body. The impl serializer needs the
+// pending call's reply object to decode into, which a dump does not have, so
+// this reads the same fields itself.
+func decodeResponse(body []byte, h Header) (*Response, error) {
+	dec := hessian.NewDecoder(body)
+	if h.Status != impl.Response_OK {
+		v, err := dec.Decode()
+		return &Response{Kind: "exception", Exception: hessianjson.Value(v)}, err
+	}
+
+	resp := &Response{}
+	v, err := dec.Decode()
+	if err != nil {
+		return resp, err
+	}
+	kind, ok := v.(int32)
+	if !ok {
+		return resp, fmt.Errorf("unknown response type %v", v)
+	}
+	var attachments bool
+	switch kind {
+	case impl.RESPONSE_WITH_EXCEPTION, impl.RESPONSE_WITH_EXCEPTION_WITH_ATTACHMENTS:
+		resp.Kind = "exception"
+		if resp.Exception, err = dec.Decode(); err != nil {
+			return resp, err
+		}
+		resp.Exception = hessianjson.Value(resp.Exception)
+		attachments = kind == impl.RESPONSE_WITH_EXCEPTION_WITH_ATTACHMENTS
+	case impl.RESPONSE_VALUE, impl.RESPONSE_VALUE_WITH_ATTACHMENTS:
+		resp.Kind = "value"
+		if resp.Value, err = dec.Decode(); err != nil {
+			return resp, err
+		}
+		resp.Value = hessianjson.Value(resp.Value)
+		attachments = kind == impl.RESPONSE_VALUE_WITH_ATTACHMENTS
+	case impl.RESPONSE_NULL_VALUE, impl.RESPONSE_NULL_VALUE_WITH_ATTACHMENTS:
+		resp.Kind = "null"
+		attachments = kind == impl.RESPONSE_NULL_VALUE_WITH_ATTACHMENTS
+	default:
+		return resp, fmt.Errorf("unknown response type %v", v)
+	}
+	if attachments {
+		v, err := dec.Decode()
+		if err != nil {
+			return resp, err
+		}
+		resp.Attachments, _ = hessianjson.Value(v).(map[string]interface{})
+	}
+	return resp, nil
+}
@@ -0,0 +1,155 @@
+// Package failure maps consumer-side errors onto a small taxonomy so that the
+// client can decide per class whether to retry, continue or stop.
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+	getty "github.com/apache/dubbo-getty"
+	"github.com/apache/dubbo-go-hessian2/java_exception"
+	perrors "github.com/pkg/errors"
+
+	"dubbo-demo/internal/breaker"
+	"dubbo-demo/internal/capacity"
+)
+
+// Class is the kind of a consumer error.
+type Class string
+
+const (
+	// WriteTimeout: the request could not be written to the getty session
+	// in time, e.g. "[session.WritePkg] ... i/o timeout".
+	WriteTimeout Class = "write_timeout"
+	// ReadTimeout: the request was written but no response arrived within
+	// the request timeout.
+	ReadTimeout Class = "read_timeout"
+	// NoProvider: there was no provider or no usable connection to one.
+	NoProvider Class = "no_provider"
+	// Remote: the provider ran the call and returned an error.
+	Remote Class = "remote"
+	// Decode: the request or response could not be (de)serialized.
+	Decode Class = "decode"
+	// CircuitOpen: the consumer's circuit breaker turned the call away
+	// without sending it.
+	CircuitOpen Class = "circuit_open"
+	// Overloaded: the provider's adaptivesvc limiter turned the call away
+	// without running it.
+	Overloaded Class = "overloaded"
+	// Unknown: anything not matched above.
+	Unknown Class = "unknown"
+)
+
+// Classes lists every class in report order.
+var Classes = []Class{WriteTimeout, ReadTimeout, NoProvider, Remote, Decode, CircuitOpen, Overloaded, Unknown}
+
+// ParseClass is the inverse of Class.String.
+func ParseClass(s string) (Class, error) {
+	for _, c := range Classes {
+		if string(c) == s {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown error class %q", s)
+}
+
+func (c Class) String() string { return string(c) }
+
+// Classify returns the class of err; err must not be nil.
+func Classify(err error) Class {
+	cause := perrors.Cause(err)
+
+	if breaker.IsOpen(err) {
+		return CircuitOpen
+	}
+	if capacity.IsRejected(err) {
+		return Overloaded
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Timeout() {
+		if opErr.Op == "write" {
+			return WriteTimeout
+		}
+		return ReadTimeout
+	}
+	if _, ok := cause.(java_exception.Throwabler); ok {
+		return Remote
+	}
+	switch cause {
+	case protocol.ErrClientClosed, protocol.ErrDestroyedInvoker, getty.ErrSessionClosed:
+		return NoProvider
+	}
+
+	// everything else is only distinguishable by the message that getty,
+	// the exchange client and the cluster invokers put on it
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "WritePkg") && strings.Contains(msg, "timeout"),
+		strings.Contains(msg, "write tcp") && strings.Contains(msg, "i/o timeout"):
+		return WriteTimeout
+	case strings.Contains(msg, "maybe the client read timeout"),
+		strings.Contains(msg, "read tcp") && strings.Contains(msg, "i/o timeout"),
+		strings.Contains(msg, "context deadline exceeded"),
+		strings.Contains(msg, "request timeout"):
+		return ReadTimeout
+	case strings.Contains(msg, "No provider available"),
+		strings.Contains(msg, "No provider is available"),
+		strings.Contains(msg, "no provider available"),
+		strings.Contains(msg, "Failed to connect server"),
+		strings.Contains(msg, "session not exist"),
+		strings.Contains(msg, "client have been closed"),
+		strings.Contains(msg, "connection refused"),
+		strings.Contains(msg, "connection reset"),
+		strings.Contains(msg, "broken pipe"):
+		return NoProvider
+	case strings.Contains(msg, "java exception"),
+		strings.Contains(msg, "got exception"),
+		strings.Contains(msg, "don't have this exporter"),
+		strings.Contains(msg, "don't have the invoker"):
+		return Remote
+	case strings.Contains(msg, "hessian"),
+		strings.Contains(msg, "decode"),
+		strings.Contains(msg, "Decode"),
+		strings.Contains(msg, "unknown type"),
+		strings.Contains(msg, "illegal"),
+		// hessian's decoder names the tag it choked on, e.g.
+		// "decInt32 integer wrong tag:0x74"
+		strings.Contains(msg, "wrong tag"),
+		strings.Contains(msg, "unknown string tag"),
+		strings.Contains(msg, "has not being registered"):
+		return Decode
+	}
+	return Unknown
+}
+
+// ClassifyResult classifies the error of an invocation result, returning
+// false when the result carries no error.
+func ClassifyResult(res protocol.Result) (Class, bool) {
+	if res == nil || res.Error() == nil {
+		return "", false
+	}
+	return Classify(res.Error()), true
+}
+
+// Summary shortens err to its first line and caps it, since getty errors can
+// embed a full hex dump of the package that failed to write.
+func Summary(err error) string {
+	msg := err.Error()
+	if i := strings.Index(msg, "[]byte{"); i >= 0 {
+		if j := strings.Index(msg[i:], "}"); j >= 0 {
+			msg = msg[:i] + "[]byte{...}" + msg[i+j+1:]
+		}
+	}
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	const max = 256
+	if len(msg) > max {
+		msg = msg[:max] + "..."
+	}
+	return msg
+}
@@ -0,0 +1,110 @@
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/filter/adaptivesvc"
+	"dubbo.apache.org/dubbo-go/v3/filter/adaptivesvc/limiter"
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+	getty "github.com/apache/dubbo-getty"
+	hessian "github.com/apache/dubbo-go-hessian2"
+	"github.com/apache/dubbo-go-hessian2/java_exception"
+	perrors "github.com/pkg/errors"
+
+	"dubbo-demo/internal/breaker"
+)
+
+// failover wraps err the way the failover cluster does once it runs out of
+// retries.
+func failover(err error) error {
+	return perrors.Wrap(err, fmt.Sprintf("Failed to invoke the method SayHello in the service org.apache.dubbo.DubboDemoProvider. "+
+		"Tried 1 times of the providers [dubbo://192.168.123.192:20000] (1/1)from the registry nacos://127.0.0.1:8848 on the consumer 192.168.123.192 using the dubbo version 3.0.4. "+
+		"Last error is %+v.", err.Error()))
+}
+
+// opErr is a socket timeout like the ones getty's connection returns.
+func opErr(op string) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "tcp",
+		Source: &net.TCPAddr{IP: net.IPv4(192, 168, 123, 192), Port: 17947},
+		Addr:   &net.TCPAddr{IP: net.IPv4(192, 168, 123, 192), Port: 20000},
+		Err:    os.ErrDeadlineExceeded,
+	}
+}
+
+// hessianErr is what hessian reports for b.
+func hessianErr(t *testing.T, b []byte) error {
+	t.Helper()
+	_, err := hessian.NewDecoder(b).Decode()
+	if err == nil {
+		t.Fatalf("hessian decoded %q", b)
+	}
+	return perrors.WithStack(err)
+}
+
+func TestClassify(t *testing.T) {
+	// adaptivesvc's filter turns the limiter's error into this, and the
+	// provider sends it back as a throwable
+	rejected := fmt.Errorf("%w: %v", adaptivesvc.ErrAdaptiveSvcInterrupted, limiter.ErrReachLimitation)
+	open := &breaker.OpenError{Method: "SayHello", State: "open", RetryAt: time.Now().Add(10 * time.Second)}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want Class
+	}{
+		{"write timeout", opErr("write"), WriteTimeout},
+		{"read timeout", opErr("read"), ReadTimeout},
+		// session.WritePkg and the getty client each add a stack
+		{"getty write timeout", failover(perrors.WithStack(perrors.WithStack(opErr("write")))), WriteTimeout},
+		{"write timeout as text", errors.New("Last error is write tcp 192.168.123.192:17947->192.168.123.192:20000: i/o timeout."), WriteTimeout},
+		{"non-timeout op error", &net.OpError{Op: "write", Net: "tcp", Err: errors.New("broken pipe")}, NoProvider},
+		{"client read timeout", failover(perrors.New("maybe the client read timeout or fail to decode tcp stream in Writer.Write")), ReadTimeout},
+		{"deadline", fmt.Errorf("call: %w", errors.New("context deadline exceeded")), ReadTimeout},
+
+		{"no provider", perrors.Errorf("Failed to invoke the method SayHello. No provider available for the service org.apache.dubbo.DubboDemoProvider from registry nacos://127.0.0.1:8848 on the consumer 192.168.123.192 using the dubbo version 3.0.4 .Please check if the providers have been started and registered."), NoProvider},
+		{"client closed", perrors.WithStack(protocol.ErrClientClosed), NoProvider},
+		{"destroyed invoker", protocol.ErrDestroyedInvoker, NoProvider},
+		{"session closed", perrors.WithStack(getty.ErrSessionClosed), NoProvider},
+		{"connection refused", failover(errors.New("dial tcp 127.0.0.1:20000: connect: connection refused")), NoProvider},
+
+		{"throwable", java_exception.NewThrowable("injected by request"), Remote},
+		{"java exception", java_exception.NewIllegalStateException("injected by request"), Remote},
+		{"wrapped throwable", failover(perrors.WithStack(java_exception.NewDubboGenericException("com.example.Boom", "boom"))), Remote},
+		{"provider error", perrors.Errorf("got exception: %+v", "abandoned before 1s of work was done"), Remote},
+
+		{"hessian wrong tag", hessianErr(t, []byte("Mt")), Decode},
+		{"hessian unknown string tag", failover(hessianErr(t, []byte("Cxx"))), Decode},
+		{"hessian unregistered", errors.New("non-pojo obj main.Reply has not being registered before!"), Decode},
+		{"illegal package", perrors.New("illegal package!"), Decode},
+
+		{"breaker open", open, CircuitOpen},
+		{"breaker half-open", failover(&breaker.OpenError{Method: "SayHello", State: "half-open"}), CircuitOpen},
+
+		{"adaptivesvc rejection", rejected, Overloaded},
+		{"adaptivesvc rejection from the provider", failover(java_exception.NewThrowable(rejected.Error())), Overloaded},
+
+		{"anything else", errors.New("something odd"), Unknown},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Classify(tc.err); got != tc.want {
+				t.Errorf("Classify(%v) = %s, want %s", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClassifyResult(t *testing.T) {
+	if c, ok := ClassifyResult(&protocol.RPCResult{}); ok {
+		t.Errorf("ClassifyResult of a result without error = %s, true", c)
+	}
+	if c, ok := ClassifyResult(&protocol.RPCResult{Err: opErr("read")}); !ok || c != ReadTimeout {
+		t.Errorf("ClassifyResult of a read timeout = %s, %v; want %s, true", c, ok, ReadTimeout)
+	}
+}
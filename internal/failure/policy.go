@@ -0,0 +1,190 @@
+package failure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action is what the client does after a failed call.
+type Action string
+
+const (
+	Continue Action = "continue"
+	Retry    Action = "retry"
+	Abort    Action = "abort"
+)
+
+// Policy is the reaction to one error class.
+type Policy struct {
+	Action  Action
+	Retries int
+	Backoff time.Duration
+}
+
+func (p Policy) String() string {
+	if p.Action != Retry {
+		return string(p.Action)
+	}
+	return fmt.Sprintf("%s:%d:%v", p.Action, p.Retries, p.Backoff)
+}
+
+// Policies holds a Policy per class. It implements flag.Value with specs like
+// "write_timeout=retry:2:500ms,decode=abort"; classes not mentioned keep their
+// default.
+type Policies map[Class]Policy
+
+// DefaultPolicies retries transport failures that may not have reached the
+// provider and carries on through everything else.
+func DefaultPolicies() Policies {
+	return Policies{
+		WriteTimeout: {Action: Retry, Retries: 1, Backoff: 100 * time.Millisecond},
+		ReadTimeout:  {Action: Continue},
+		NoProvider:   {Action: Retry, Retries: 3, Backoff: time.Second},
+		Remote:       {Action: Continue},
+		Decode:       {Action: Continue},
+		CircuitOpen:  {Action: Continue},
+		Overloaded:   {Action: Continue},
+		Unknown:      {Action: Continue},
+	}
+}
+
+func (p Policies) String() string {
+	parts := make([]string, 0, len(p))
+	for _, c := range Classes {
+		if policy, ok := p[c]; ok {
+			parts = append(parts, string(c)+"="+policy.String())
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p Policies) Set(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return fmt.Errorf("error policy %q: want class=action", item)
+		}
+		class, err := ParseClass(name)
+		if err != nil {
+			return err
+		}
+		policy, err := parsePolicy(value)
+		if err != nil {
+			return fmt.Errorf("error policy %q: %w", item, err)
+		}
+		p[class] = policy
+	}
+	return nil
+}
+
+func parsePolicy(s string) (Policy, error) {
+	fields := strings.Split(s, ":")
+	policy := Policy{Action: Action(fields[0])}
+	switch policy.Action {
+	case Continue, Abort:
+		if len(fields) != 1 {
+			return policy, fmt.Errorf("%s takes no arguments", policy.Action)
+		}
+	case Retry:
+		policy.Retries = 1
+		if len(fields) > 1 {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 0 {
+				return policy, fmt.Errorf("bad retry count %q", fields[1])
+			}
+			policy.Retries = n
+		}
+		if len(fields) > 2 {
+			d, err := time.ParseDuration(fields[2])
+			if err != nil {
+				return policy, err
+			}
+			policy.Backoff = d
+		}
+	default:
+		return policy, fmt.Errorf("unknown action %q", fields[0])
+	}
+	return policy, nil
+}
+
+// Guard runs calls under a set of policies and counts what happened.
+type Guard struct {
+	Policies Policies
+
+	mu      sync.Mutex
+	failed  map[Class]int
+	retried map[Class]int
+	aborted map[Class]int
+}
+
+// NewGuard returns a Guard applying p.
+func NewGuard(p Policies) *Guard {
+	return &Guard{
+		Policies: p,
+		failed:   make(map[Class]int),
+		retried:  make(map[Class]int),
+		aborted:  make(map[Class]int),
+	}
+}
+
+// Do runs call until it succeeds or the policy for its error class gives up.
+// onError sees every failed attempt. abort reports that the policy asks the
+// whole run to stop. Once ctx is done there are no more retries, and a
+// backoff under way is cut short.
+func (g *Guard) Do(ctx context.Context, call func() error, onError func(Class, error)) (abort bool, err error) {
+	for attempt := 0; ; attempt++ {
+		if err = call(); err == nil {
+			return false, nil
+		}
+		class := Classify(err)
+		if onError != nil {
+			onError(class, err)
+		}
+		policy := g.Policies[class]
+		retry := policy.Action == Retry && attempt < policy.Retries && ctx.Err() == nil
+
+		g.mu.Lock()
+		g.failed[class]++
+		switch {
+		case policy.Action == Abort:
+			g.aborted[class]++
+		case retry:
+			g.retried[class]++
+		}
+		g.mu.Unlock()
+
+		switch {
+		case policy.Action == Abort:
+			return true, err
+		case !retry:
+			return false, err
+		}
+		select {
+		case <-time.After(policy.Backoff):
+		case <-ctx.Done():
+			return false, err
+		}
+	}
+}
+
+// Report writes per-class attempt counters to w.
+func (g *Guard) Report(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	classes := make([]string, 0, len(g.failed))
+	for c := range g.failed {
+		classes = append(classes, string(c))
+	}
+	sort.Strings(classes)
+	for _, name := range classes {
+		c := Class(name)
+		fmt.Fprintf(w, "attempts[%s]: failed=%d retried=%d aborted=%d policy=%v\n",
+			c, g.failed[c], g.retried[c], g.aborted[c], g.Policies[c])
+	}
+}
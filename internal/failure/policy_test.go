@@ -0,0 +1,126 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errNoProvider = errors.New("No provider available in the cluster")
+
+// TestDoStopsOnDone checks that a run ending cuts a backoff short and stops
+// further retries.
+func TestDoStopsOnDone(t *testing.T) {
+	const backoff = 10 * time.Second
+	for _, tc := range []struct {
+		name string
+		// cancelAfter is when ctx is cancelled, from the first failure;
+		// negative cancels it before Do is called.
+		cancelAfter time.Duration
+	}{
+		{"cancelled during backoff", 50 * time.Millisecond},
+		{"cancelled before the call", -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancelAfter < 0 {
+				cancel()
+			}
+			g := NewGuard(Policies{NoProvider: {Action: Retry, Retries: 3, Backoff: backoff}})
+			calls := 0
+			st := time.Now()
+			abort, err := g.Do(ctx, func() error {
+				calls++
+				return errNoProvider
+			}, func(Class, error) {
+				if tc.cancelAfter >= 0 {
+					time.AfterFunc(tc.cancelAfter, cancel)
+				}
+			})
+			if took := time.Since(st); took > backoff/2 {
+				t.Errorf("Do took %v, want it back once ctx is done", took)
+			}
+			if err != errNoProvider || abort {
+				t.Errorf("Do = %v, %v; want false, %v", abort, err, errNoProvider)
+			}
+			if calls != 1 {
+				t.Errorf("call ran %d times, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestPoliciesSet(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		// want lists the policies the spec changes; the rest must keep
+		// their defaults
+		want Policies
+		err  string
+	}{
+		{spec: "decode=abort", want: Policies{Decode: {Action: Abort}}},
+		{spec: "write_timeout=retry:2:500ms,decode=abort", want: Policies{
+			WriteTimeout: {Action: Retry, Retries: 2, Backoff: 500 * time.Millisecond},
+			Decode:       {Action: Abort},
+		}},
+		{spec: "read_timeout=retry", want: Policies{ReadTimeout: {Action: Retry, Retries: 1}}},
+		{spec: "no_provider=retry:0", want: Policies{NoProvider: {Action: Retry}}},
+		{spec: "no_provider=continue, remote=abort", want: Policies{
+			NoProvider: {Action: Continue},
+			Remote:     {Action: Abort},
+		}},
+		{spec: "circuit_open=abort,circuit_open=continue", want: Policies{CircuitOpen: {Action: Continue}}},
+
+		{spec: "decode", err: "want class=action"},
+		{spec: "timeout=abort", err: `unknown error class "timeout"`},
+		{spec: "remote =abort", err: `unknown error class "remote "`},
+		{spec: "remote=explode", err: `unknown action "explode"`},
+		{spec: "remote=continue:1", err: "continue takes no arguments"},
+		{spec: "remote=abort:1", err: "abort takes no arguments"},
+		{spec: "remote=retry:x", err: `bad retry count "x"`},
+		{spec: "remote=retry:-1", err: `bad retry count "-1"`},
+		{spec: "remote=retry:1:soon", err: `invalid duration "soon"`},
+		{spec: "decode=abort,", err: "want class=action"},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			p := DefaultPolicies()
+			err := p.Set(tc.spec)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Set(%q) = %v, want an error containing %q", tc.spec, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Set(%q) = %v", tc.spec, err)
+			}
+			for c, def := range DefaultPolicies() {
+				want, ok := tc.want[c]
+				if !ok {
+					want = def
+				}
+				if p[c] != want {
+					t.Errorf("Set(%q): %s=%v, want %v", tc.spec, c, p[c], want)
+				}
+			}
+		})
+	}
+}
+
+// TestPoliciesString checks that String gives back a spec Set accepts.
+func TestPoliciesString(t *testing.T) {
+	p := DefaultPolicies()
+	if err := p.Set("write_timeout=retry:2:500ms,decode=abort"); err != nil {
+		t.Fatal(err)
+	}
+	q := Policies{}
+	if err := q.Set(p.String()); err != nil {
+		t.Fatalf("Set(%q) = %v", p.String(), err)
+	}
+	if q.String() != p.String() {
+		t.Errorf("round trip gave %q, want %q", q.String(), p.String())
+	}
+}
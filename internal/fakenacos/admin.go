@@ -0,0 +1,256 @@
+package fakenacos
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Do runs a command that changes how the server behaves and returns what it
+// did:
+//
+//	push-delay DURATION  hold every push to subscribers this long, 0 to stop
+//	drop [FILTER]        forget matching instances; subscribers are told, the
+//	                     owner is not and keeps believing it is registered
+//	expire [FILTER]      let the leases behind matching instances run out:
+//	                     their gRPC connections are ejected, losing every
+//	                     instance until the client has reconnected, and
+//	                     HTTP instances turn unhealthy and are removed one
+//	                     TTL later unless they beat
+//	disconnect [FILTER]  close the gRPC connections owning matching instances,
+//	                     or every connection without a filter; clients
+//	                     reconnect and register again straight away
+//	clear                stop delaying pushes
+//
+// FILTER is any of a service name (with or without its group@@), an IP, or
+// IP:PORT; empty or "all" matches everything.
+func (s *Server) Do(cmd string) (string, error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	verb, args := fields[0], fields[1:]
+	switch verb {
+	case "push-delay":
+		if len(args) != 1 {
+			return "", fmt.Errorf("usage: push-delay DURATION")
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return "", err
+		}
+		s.mu.Lock()
+		s.pushDelay = d
+		s.mu.Unlock()
+		return "push delay " + d.String(), nil
+	case "clear":
+		s.mu.Lock()
+		s.pushDelay = 0
+		s.mu.Unlock()
+		return "cleared", nil
+	case "drop", "expire", "disconnect":
+	default:
+		return "", fmt.Errorf("unknown command %q", verb)
+	}
+
+	f := parseFilter(args)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owners := map[*conn]bool{}
+	n := 0
+	now := time.Now()
+	for k, svc := range s.services {
+		changed := false
+		for key, in := range svc.instances {
+			if !f.match(k, in) {
+				continue
+			}
+			n++
+			switch {
+			case verb == "drop":
+				delete(svc.instances, key)
+				changed = true
+			case in.owner != nil:
+				owners[in.owner] = true
+			case verb == "expire":
+				in.Healthy = false
+				in.lastBeat = now.Add(-s.ttl)
+				changed = true
+			}
+		}
+		if changed {
+			s.changed(k, svc)
+		}
+	}
+	if verb == "disconnect" && f.all() {
+		for _, c := range s.conns {
+			owners[c] = true
+		}
+	}
+	for c := range owners {
+		if verb == "expire" {
+			s.expire(c)
+		} else {
+			c.close()
+		}
+	}
+	switch verb {
+	case "drop":
+		return fmt.Sprintf("dropped %d instances", n), nil
+	case "expire":
+		return fmt.Sprintf("expired %d instances, ejected %d connections", n, len(owners)), nil
+	}
+	return fmt.Sprintf("disconnected %d connections", len(owners)), nil
+}
+
+// filter picks instances for Do.
+type filter struct {
+	service, ip, port string
+}
+
+func parseFilter(args []string) filter {
+	var f filter
+	for _, a := range args {
+		if a == "all" {
+			continue
+		}
+		if net.ParseIP(a) != nil {
+			f.ip = a
+		} else if h, p, err := net.SplitHostPort(a); err == nil && (h == "" || net.ParseIP(h) != nil) {
+			f.ip, f.port = h, p
+		} else {
+			f.service = a
+		}
+	}
+	return f
+}
+
+func (f filter) all() bool {
+	return f == filter{}
+}
+
+func (f filter) match(k serviceKey, in *instance) bool {
+	if f.service != "" && f.service != k.name && f.service != k.groupedName() {
+		return false
+	}
+	if f.ip != "" && f.ip != in.Ip {
+		return false
+	}
+	return f.port == "" || f.port == strconv.FormatUint(in.Port, 10)
+}
+
+// Status is a snapshot of the server for the admin page.
+type Status struct {
+	HTTP      string          `json:"http"`
+	GRPC      string          `json:"grpc"`
+	TTL       string          `json:"ttl"`
+	PushDelay string          `json:"pushDelay,omitempty"`
+	Services  []ServiceStatus `json:"services"`
+	Conns     []ConnStatus    `json:"conns"`
+	Configs   int             `json:"configs"`
+}
+
+type ServiceStatus struct {
+	Namespace   string           `json:"namespace"`
+	Group       string           `json:"group"`
+	Name        string           `json:"name"`
+	Instances   []InstanceStatus `json:"instances"`
+	Subscribers []string         `json:"subscribers"` // connection IDs
+}
+
+type InstanceStatus struct {
+	Addr     string  `json:"addr"`
+	Cluster  string  `json:"cluster"`
+	Healthy  bool    `json:"healthy"`
+	Enabled  bool    `json:"enabled"`
+	Weight   float64 `json:"weight"`
+	Owner    string  `json:"owner"`              // connection ID, or "http"
+	LastBeat string  `json:"lastBeat,omitempty"` // HTTP instances: time since
+}
+
+type ConnStatus struct {
+	ID      string `json:"id"`
+	Client  string `json:"client"`
+	State   string `json:"state"`
+	Age     string `json:"age"`
+	Idle    string `json:"idle"`
+	Pushes  int64  `json:"pushes"`
+	Acks    int64  `json:"acks"`
+	Queued  int    `json:"queued"`
+	Dropped int64  `json:"dropped,omitempty"`
+}
+
+// Status reports services with their instances and subscribers, and the
+// client connections.
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	st := Status{
+		HTTP:     s.Addr(),
+		GRPC:     s.GRPCAddr(),
+		TTL:      s.ttl.String(),
+		Services: []ServiceStatus{},
+		Conns:    []ConnStatus{},
+		Configs:  len(s.configs),
+	}
+	if s.pushDelay > 0 {
+		st.PushDelay = s.pushDelay.String()
+	}
+	for k, svc := range s.services {
+		if len(svc.instances) == 0 && len(svc.subscribers) == 0 {
+			continue
+		}
+		ss := ServiceStatus{Namespace: k.namespace, Group: k.group, Name: k.name, Instances: []InstanceStatus{}, Subscribers: []string{}}
+		for _, in := range svc.instances {
+			is := InstanceStatus{
+				Addr:    net.JoinHostPort(in.Ip, strconv.FormatUint(in.Port, 10)),
+				Cluster: in.ClusterName,
+				Healthy: in.Healthy,
+				Enabled: in.Enable,
+				Weight:  in.Weight,
+				Owner:   "http",
+			}
+			if in.owner != nil {
+				is.Owner = in.owner.id
+			} else {
+				is.LastBeat = now.Sub(in.lastBeat).Round(time.Millisecond).String()
+			}
+			ss.Instances = append(ss.Instances, is)
+		}
+		sort.Slice(ss.Instances, func(i, j int) bool { return ss.Instances[i].Addr < ss.Instances[j].Addr })
+		for c := range svc.subscribers {
+			ss.Subscribers = append(ss.Subscribers, c.id)
+		}
+		sort.Strings(ss.Subscribers)
+		st.Services = append(st.Services, ss)
+	}
+	sort.Slice(st.Services, func(i, j int) bool {
+		a, b := st.Services[i], st.Services[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		return a.Name < b.Name
+	})
+	for _, c := range s.conns {
+		st.Conns = append(st.Conns, ConnStatus{
+			ID:      c.id,
+			Client:  c.clientIP,
+			State:   c.state.String(),
+			Age:     now.Sub(c.started).Round(time.Millisecond).String(),
+			Idle:    now.Sub(c.lastActive).Round(time.Millisecond).String(),
+			Pushes:  c.pushes.Load(),
+			Acks:    c.acks.Load(),
+			Queued:  len(c.queue),
+			Dropped: c.dropped.Load(),
+		})
+	}
+	sort.Slice(st.Conns, func(i, j int) bool { return st.Conns[i].ID < st.Conns[j].ID })
+	return st
+}
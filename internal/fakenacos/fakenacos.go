@@ -0,0 +1,439 @@
+// Package fakenacos is a stand-in for a Nacos server that keeps everything
+// in memory. It implements what dubbo-go's nacos registry, config center and
+// metadata report use: the naming and config requests of the Nacos 2.x gRPC
+// protocol with pushes to subscribers, and the v1 naming HTTP API with
+// heartbeats. It can misbehave on command (see Server.Do): slow pushes,
+// instances the server forgets, leases that run out.
+//
+// The clients find the gRPC port by adding 1000 to the HTTP one, so a server
+// is addressed by its HTTP address, the same as a real one:
+//
+//	registries:
+//	  nacos:
+//	    protocol: nacos
+//	    address: 127.0.0.1:8848
+package fakenacos
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/common/remote/rpc/rpc_request"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"google.golang.org/grpc"
+)
+
+const (
+	// GRPCPortOffset is how far above the HTTP port the clients look for gRPC.
+	GRPCPortOffset = 1000
+	// DefaultTTL matches Nacos: an HTTP instance is unhealthy after 15s
+	// without a beat and removed after 30s.
+	DefaultTTL = 15 * time.Second
+	// connIdleLimit is how long a gRPC connection may stay silent before it
+	// is ejected, as in Nacos. Idle clients health-check every 5s.
+	connIdleLimit = 20 * time.Second
+
+	defaultNamespace = "public"
+	defaultGroup     = "DEFAULT_GROUP"
+	defaultCluster   = "DEFAULT"
+
+	// cacheMillis is how often clients poll a service they got no push for.
+	cacheMillis = 10000
+)
+
+// Server is one fake Nacos server.
+type Server struct {
+	ttl      time.Duration
+	httpLn   net.Listener
+	grpcLn   net.Listener
+	http     *http.Server
+	grpc     *grpc.Server
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu        sync.Mutex
+	services  map[serviceKey]*service
+	conns     map[string]*conn // by remote address
+	configs   map[configKey]*configItem
+	listeners map[configKey]map[*conn]bool
+	pushDelay time.Duration
+	pushID    int64
+}
+
+// Listen starts a server with its HTTP API on addr and gRPC on the port
+// GRPCPortOffset above. With port 0 it picks a pair of free ports. ttl is
+// how long an HTTP instance lasts without a beat, DefaultTTL if zero.
+func Listen(addr string, ttl time.Duration) (*Server, error) {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	httpLn, grpcLn, err := listenPair(addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ttl:       ttl,
+		httpLn:    httpLn,
+		grpcLn:    grpcLn,
+		done:      make(chan struct{}),
+		services:  map[serviceKey]*service{},
+		conns:     map[string]*conn{},
+		configs:   map[configKey]*configItem{},
+		listeners: map[configKey]map[*conn]bool{},
+	}
+	s.http = &http.Server{Handler: s.routes()}
+	s.grpc = newGRPCServer(s)
+	go s.http.Serve(httpLn)
+	go s.grpc.Serve(grpcLn)
+	go s.reap()
+	return s, nil
+}
+
+// listenPair listens on addr and on the port GRPCPortOffset above it.
+func listenPair(addr string) (net.Listener, net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for tries := 0; ; tries++ {
+		httpLn, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		p := httpLn.Addr().(*net.TCPAddr).Port
+		grpcLn, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p+GRPCPortOffset)))
+		if err == nil {
+			return httpLn, grpcLn, nil
+		}
+		httpLn.Close()
+		if port != "0" || tries == 20 {
+			return nil, nil, fmt.Errorf("gRPC port: %w", err)
+		}
+	}
+}
+
+// Addr is the HTTP address, the one clients are configured with.
+func (s *Server) Addr() string {
+	return s.httpLn.Addr().String()
+}
+
+// GRPCAddr is the address of the gRPC API.
+func (s *Server) GRPCAddr() string {
+	return s.grpcLn.Addr().String()
+}
+
+// Close stops the server. Clients see their connections drop.
+func (s *Server) Close() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		for _, c := range s.conns {
+			c.close()
+		}
+		s.mu.Unlock()
+		s.grpc.Stop()
+		s.http.Close()
+	})
+}
+
+// serviceKey names a service. name is without the group.
+type serviceKey struct {
+	namespace, group, name string
+}
+
+func newServiceKey(namespace, group, name string) serviceKey {
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	if g, n, ok := strings.Cut(name, "@@"); ok {
+		group, name = g, n
+	}
+	if group == "" {
+		group = defaultGroup
+	}
+	return serviceKey{namespace: namespace, group: group, name: name}
+}
+
+// groupedName is the group@@name form Nacos uses in instances.
+func (k serviceKey) groupedName() string {
+	return k.group + "@@" + k.name
+}
+
+type service struct {
+	instances   map[string]*instance // by ip#port#cluster
+	subscribers map[*conn]string     // to the clusters they asked for
+	lastRef     uint64               // ms, strictly increasing on every change
+}
+
+// instance is a registered instance and who keeps it alive: a gRPC
+// connection, or for HTTP instances its own beats.
+type instance struct {
+	model.Instance
+	owner    *conn // nil for HTTP
+	lastBeat time.Time
+}
+
+func instanceKey(ip string, port uint64, cluster string) string {
+	return ip + "#" + strconv.FormatUint(port, 10) + "#" + cluster
+}
+
+// service returns the service for k, creating it. Called with s.mu held.
+func (s *Server) service(k serviceKey) *service {
+	svc := s.services[k]
+	if svc == nil {
+		svc = &service{instances: map[string]*instance{}, subscribers: map[*conn]string{}}
+		s.services[k] = svc
+	}
+	return svc
+}
+
+// register adds or replaces an instance. Called with s.mu held.
+func (s *Server) register(k serviceKey, in model.Instance, owner *conn) {
+	if in.ClusterName == "" {
+		in.ClusterName = defaultCluster
+	}
+	key := instanceKey(in.Ip, in.Port, in.ClusterName)
+	in.InstanceId = key + "#" + k.groupedName()
+	in.ServiceName = k.groupedName()
+	in.Healthy = true
+	if in.Metadata == nil {
+		in.Metadata = map[string]string{}
+	}
+	svc := s.service(k)
+	svc.instances[key] = &instance{Instance: in, owner: owner, lastBeat: time.Now()}
+	log.Printf("register %s %s:%d via %s\n", k.groupedName(), in.Ip, in.Port, owner.name())
+	s.changed(k, svc)
+}
+
+// deregister removes an instance, reporting whether it was there. Called
+// with s.mu held.
+func (s *Server) deregister(k serviceKey, ip string, port uint64, cluster string) bool {
+	if cluster == "" {
+		cluster = defaultCluster
+	}
+	svc := s.services[k]
+	if svc == nil || svc.instances[instanceKey(ip, port, cluster)] == nil {
+		return false
+	}
+	delete(svc.instances, instanceKey(ip, port, cluster))
+	log.Printf("deregister %s %s:%d\n", k.groupedName(), ip, port)
+	s.changed(k, svc)
+	return true
+}
+
+// changed pushes a service to its subscribers. Called with s.mu held.
+func (s *Server) changed(k serviceKey, svc *service) {
+	now := uint64(time.Now().UnixMilli())
+	if now <= svc.lastRef {
+		now = svc.lastRef + 1
+	}
+	svc.lastRef = now
+	for c, clusters := range svc.subscribers {
+		s.pushID++
+		req := &rpc_request.NotifySubscriberRequest{
+			NamingRequest: rpc_request.NewNamingRequest(k.namespace, k.name, k.group),
+			ServiceInfo:   s.serviceInfo(k, clusters, false),
+		}
+		req.RequestId = strconv.FormatInt(s.pushID, 10)
+		c.enqueue(req, s.pushDelay)
+	}
+}
+
+// serviceInfo is what the clients get for a service. Called with s.mu held.
+func (s *Server) serviceInfo(k serviceKey, clusters string, healthyOnly bool) model.Service {
+	info := model.Service{
+		CacheMillis: cacheMillis,
+		Hosts:       []model.Instance{},
+		Clusters:    clusters,
+		Name:        k.name,
+		GroupName:   k.group,
+		Valid:       true,
+	}
+	svc := s.services[k]
+	if svc == nil {
+		info.LastRefTime = uint64(time.Now().UnixMilli())
+		return info
+	}
+	info.LastRefTime = svc.lastRef
+	want := map[string]bool{}
+	for _, c := range strings.Split(clusters, ",") {
+		if c != "" {
+			want[c] = true
+		}
+	}
+	for _, in := range svc.instances {
+		if len(want) > 0 && !want[in.ClusterName] || healthyOnly && !in.Healthy {
+			continue
+		}
+		info.Hosts = append(info.Hosts, in.Instance)
+	}
+	sort.Slice(info.Hosts, func(i, j int) bool { return info.Hosts[i].InstanceId < info.Hosts[j].InstanceId })
+	sum := md5.New()
+	for _, h := range info.Hosts {
+		fmt.Fprintf(sum, "%s %v %v %v;", h.InstanceId, h.Healthy, h.Enable, h.Weight)
+	}
+	info.Checksum = hex.EncodeToString(sum.Sum(nil))
+	return info
+}
+
+// serviceNames lists the services of a namespace and group that have
+// instances. Called with s.mu held.
+func (s *Server) serviceNames(namespace, group string) []string {
+	k := newServiceKey(namespace, group, "")
+	names := []string{}
+	for sk, svc := range s.services {
+		if sk.namespace == k.namespace && sk.group == k.group && len(svc.instances) > 0 {
+			names = append(names, sk.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// page cuts names down to page pageNo (from 1) of pageSize.
+func page(names []string, pageNo, pageSize int) []string {
+	if pageSize <= 0 {
+		return names
+	}
+	if pageNo < 1 {
+		pageNo = 1
+	}
+	from := (pageNo - 1) * pageSize
+	if from >= len(names) {
+		return []string{}
+	}
+	to := from + pageSize
+	if to > len(names) {
+		to = len(names)
+	}
+	return names[from:to]
+}
+
+// subscribe adds or removes c as a subscriber, returning the service as it
+// is now. Called with s.mu held.
+func (s *Server) subscribe(c *conn, k serviceKey, clusters string, on bool) model.Service {
+	svc := s.service(k)
+	if on {
+		svc.subscribers[c] = clusters
+	} else {
+		delete(svc.subscribers, c)
+	}
+	return s.serviceInfo(k, clusters, false)
+}
+
+// forget drops everything a connection owns: its instances, pushed to the
+// remaining subscribers, its subscriptions and config listeners. Called
+// with s.mu held.
+func (s *Server) forget(c *conn) {
+	for k, svc := range s.services {
+		delete(svc.subscribers, c)
+		removed := false
+		for key, in := range svc.instances {
+			if in.owner == c {
+				delete(svc.instances, key)
+				removed = true
+			}
+		}
+		if removed {
+			s.changed(k, svc)
+		}
+	}
+	for _, ls := range s.listeners {
+		delete(ls, c)
+	}
+}
+
+// reap expires leases: HTTP instances without beats turn unhealthy after one
+// TTL and are removed after two, gRPC connections silent for connIdleLimit
+// are ejected.
+func (s *Server) reap() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+		}
+		s.mu.Lock()
+		now := time.Now()
+		for k, svc := range s.services {
+			changed := false
+			for key, in := range svc.instances {
+				if in.owner != nil || !in.Ephemeral {
+					continue
+				}
+				switch idle := now.Sub(in.lastBeat); {
+				case idle > 2*s.ttl:
+					log.Printf("%s %s:%d removed, no beat for %v\n", k.groupedName(), in.Ip, in.Port, idle.Round(time.Second))
+					delete(svc.instances, key)
+					changed = true
+				case idle > s.ttl && in.Healthy:
+					log.Printf("%s %s:%d unhealthy, no beat for %v\n", k.groupedName(), in.Ip, in.Port, idle.Round(time.Second))
+					in.Healthy = false
+					changed = true
+				}
+			}
+			if changed {
+				s.changed(k, svc)
+			}
+		}
+		for addr, c := range s.conns {
+			switch {
+			case c.state == connSetup && now.Sub(c.lastActive) > connIdleLimit:
+				log.Printf("conn %s expired, idle for %v\n", c.id, now.Sub(c.lastActive).Round(time.Second))
+				s.expire(c)
+			case c.state == connChecked && now.Sub(c.started) > connIdleLimit:
+				// checked the server but never opened its stream
+				delete(s.conns, addr)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// expire ejects a connection the way Nacos does one it thinks is gone: its
+// instances are removed and pushed to subscribers straight away, then the
+// stream is closed. A client that is in fact alive reconnects and registers
+// again. Called with s.mu held.
+func (s *Server) expire(c *conn) {
+	c.state = connExpired
+	s.forget(c)
+	c.close()
+}
+
+// beat refreshes an HTTP instance, reporting whether it is known. Called
+// with s.mu held.
+func (s *Server) beat(k serviceKey, ip string, port uint64, cluster string) bool {
+	if cluster == "" {
+		cluster = defaultCluster
+	}
+	svc := s.services[k]
+	if svc == nil {
+		return false
+	}
+	in := svc.instances[instanceKey(ip, port, cluster)]
+	if in == nil || in.owner != nil {
+		return false
+	}
+	in.lastBeat = time.Now()
+	if !in.Healthy {
+		in.Healthy = true
+		s.changed(k, svc)
+	}
+	return true
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
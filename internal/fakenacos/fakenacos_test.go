@@ -0,0 +1,166 @@
+package fakenacos
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients"
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+)
+
+const (
+	testGroup   = "myGroup"
+	testService = "providers:org.apache.dubbo.DubboDemoProvider.Test"
+)
+
+// newClient connects a real Nacos naming client to s.
+func newClient(t *testing.T, s *Server) naming_client.INamingClient {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.ParseUint(port, 10, 64)
+	dir := t.TempDir()
+	c, err := clients.NewNamingClient(vo.NacosClientParam{
+		ClientConfig: &constant.ClientConfig{
+			TimeoutMs:            3000,
+			NotLoadCacheAtStart:  true,
+			UpdateCacheWhenEmpty: true,
+			LogDir:               dir,
+			CacheDir:             dir,
+			LogLevel:             "error",
+		},
+		ServerConfigs: []constant.ServerConfig{{IpAddr: host, Port: p}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.CloseClient)
+	return c
+}
+
+func register(t *testing.T, c naming_client.INamingClient, port uint64) {
+	t.Helper()
+	ok, err := c.RegisterInstance(vo.RegisterInstanceParam{
+		Ip: "127.0.0.1", Port: port, Weight: 1, Enable: true, Healthy: true, Ephemeral: true,
+		ServiceName: testService, GroupName: testGroup,
+	})
+	if err != nil || !ok {
+		t.Fatalf("register %d: %v", port, err)
+	}
+}
+
+// subscribe returns a channel receiving the instance list on every push.
+func subscribe(t *testing.T, c naming_client.INamingClient) <-chan []model.Instance {
+	t.Helper()
+	ch := make(chan []model.Instance, 16)
+	err := c.Subscribe(&vo.SubscribeParam{
+		ServiceName: testService,
+		GroupName:   testGroup,
+		SubscribeCallback: func(instances []model.Instance, err error) {
+			ch <- instances
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+// waitFor waits until the subscriber sees want instances.
+func waitFor(t *testing.T, ch <-chan []model.Instance, want int, within time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	timeout := time.After(within)
+	for {
+		select {
+		case got := <-ch:
+			if len(got) == want {
+				return time.Since(start)
+			}
+		case <-timeout:
+			t.Fatalf("subscriber did not see %d instances within %v", want, within)
+		}
+	}
+}
+
+func listen(t *testing.T) *Server {
+	t.Helper()
+	s, err := Listen("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRegisterSubscribe(t *testing.T) {
+	s := listen(t)
+	provider, consumer := newClient(t, s), newClient(t, s)
+	register(t, provider, 20000)
+	ch := subscribe(t, consumer)
+	waitFor(t, ch, 1, 5*time.Second)
+
+	register(t, provider, 20001)
+	waitFor(t, ch, 2, 5*time.Second)
+	if _, err := provider.DeregisterInstance(vo.DeregisterInstanceParam{
+		Ip: "127.0.0.1", Port: 20001, ServiceName: testService, GroupName: testGroup, Ephemeral: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, 1, 5*time.Second)
+}
+
+func TestPushDelay(t *testing.T) {
+	s := listen(t)
+	provider, consumer := newClient(t, s), newClient(t, s)
+	ch := subscribe(t, consumer)
+	if _, err := s.Do("push-delay 1s"); err != nil {
+		t.Fatal(err)
+	}
+	register(t, provider, 20000)
+	if took := waitFor(t, ch, 1, 5*time.Second); took < time.Second {
+		t.Fatalf("push arrived after %v, want it held for 1s", took)
+	}
+}
+
+// TestDrop checks that a dropped instance stays gone: the owner is not told
+// and does not register it again.
+func TestDrop(t *testing.T) {
+	s := listen(t)
+	provider, consumer := newClient(t, s), newClient(t, s)
+	register(t, provider, 20000)
+	register(t, provider, 20001)
+	ch := subscribe(t, consumer)
+	waitFor(t, ch, 2, 5*time.Second)
+
+	if _, err := s.Do("drop 127.0.0.1:20001"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, 1, 5*time.Second)
+	time.Sleep(2 * time.Second)
+	if got := len(s.Status().Services[0].Instances); got != 1 {
+		t.Fatalf("%d instances after drop, want 1", got)
+	}
+}
+
+// TestExpire checks that an ejected provider loses its instance and gets it
+// back once its client has reconnected.
+func TestExpire(t *testing.T) {
+	s := listen(t)
+	expired, other, consumer := newClient(t, s), newClient(t, s), newClient(t, s)
+	register(t, expired, 20000)
+	register(t, other, 20001)
+	ch := subscribe(t, consumer)
+	waitFor(t, ch, 2, 5*time.Second)
+
+	if _, err := s.Do("expire :20000"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, 1, 5*time.Second)
+	took := waitFor(t, ch, 2, 10*time.Second)
+	t.Logf("provider registered again after %v", took.Round(time.Millisecond))
+}
@@ -0,0 +1,491 @@
+package fakenacos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/any"
+	nacos_grpc_service "github.com/nacos-group/nacos-sdk-go/v2/api/grpc"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/remote/rpc/rpc_request"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/remote/rpc/rpc_response"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/peer"
+)
+
+// Nacos error codes the clients act on.
+const (
+	codeUnregistered   = 301 // connection unknown: reconnect
+	codeConfigNotFound = 300
+	codeServerError    = 500
+	codeNotImplemented = 501
+)
+
+// connState is where a gRPC connection is in its life.
+type connState int
+
+const (
+	connChecked connState = iota // answered ServerCheckRequest, stream not open yet
+	connSetup                    // stream open, requests accepted
+	connExpired                  // ejected; requests fail until the stream closes
+)
+
+var connStateNames = [...]string{"checked", "setup", "expired"}
+
+func (s connState) String() string { return connStateNames[s] }
+
+// conn is one client connection. Nacos tells them apart by connection ID;
+// a client makes its requests and opens its stream on one HTTP/2
+// connection, so here the remote address is enough to find it.
+type conn struct {
+	id       string
+	addr     string
+	clientIP string
+	started  time.Time
+
+	// guarded by Server.mu
+	state      connState
+	lastActive time.Time
+
+	queue     chan push
+	pushes    atomic.Int64 // sent
+	acks      atomic.Int64 // answered by the client
+	dropped   atomic.Int64 // queue full
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// push is a request for the client waiting in its queue until due.
+type push struct {
+	req rpc_request.IRequest
+	due time.Time
+}
+
+// name is how logs show who owns an instance.
+func (c *conn) name() string {
+	if c == nil {
+		return "http"
+	}
+	return "conn " + c.id
+}
+
+// enqueue schedules a push. Pushes keep their order; each waits out the
+// delay that applied when it was queued.
+func (c *conn) enqueue(req rpc_request.IRequest, delay time.Duration) {
+	select {
+	case c.queue <- push{req: req, due: time.Now().Add(delay)}:
+	default:
+		c.dropped.Add(1)
+		log.Printf("conn %s: push queue full, dropped %s\n", c.id, req.GetRequestType())
+	}
+}
+
+// close ends the connection's stream, which makes the client reconnect.
+func (c *conn) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+func newGRPCServer(s *Server) *grpc.Server {
+	g := grpc.NewServer(
+		// the clients ping every minute; the default policy would take that
+		// as abuse and drop them
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 10 * time.Second, PermitWithoutStream: true}),
+		grpc.MaxRecvMsgSize(16<<20),
+	)
+	nacos_grpc_service.RegisterRequestServer(g, (*requestServer)(s))
+	nacos_grpc_service.RegisterBiRequestStreamServer(g, (*streamServer)(s))
+	return g
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// requestServer answers the unary requests.
+type requestServer Server
+
+func (rs *requestServer) Request(ctx context.Context, p *nacos_grpc_service.Payload) (*nacos_grpc_service.Payload, error) {
+	s := (*Server)(rs)
+	addr := peerAddr(ctx)
+	typ := p.GetMetadata().GetType()
+	body := p.GetBody().GetValue()
+
+	if typ == "ServerCheckRequest" {
+		c := s.accept(addr, p.GetMetadata().GetClientIp())
+		return reply(&rpc_response.ServerCheckResponse{Response: ok(requestID(body)), ConnectionId: c.id})
+	}
+	s.mu.Lock()
+	c := s.conns[addr]
+	live := c != nil && c.state == connSetup
+	if live {
+		c.lastActive = time.Now()
+	}
+	s.mu.Unlock()
+	if !live {
+		return reply(errorResponse(codeUnregistered, "connection is unregistered"))
+	}
+	resp, err := s.handle(c, typ, body)
+	if err != nil {
+		log.Printf("conn %s: %s: %v\n", c.id, typ, err)
+		return reply(errorResponse(codeServerError, err.Error()))
+	}
+	return reply(resp)
+}
+
+// accept returns the connection at addr, creating it on the client's
+// first ServerCheckRequest.
+func (s *Server) accept(addr, clientIP string) *conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.conns[addr]; c != nil {
+		return c
+	}
+	now := time.Now()
+	c := &conn{
+		id:         strconv.FormatInt(now.UnixMilli(), 10) + "_" + addr,
+		addr:       addr,
+		clientIP:   clientIP,
+		started:    now,
+		lastActive: now,
+		queue:      make(chan push, 1024),
+		closed:     make(chan struct{}),
+	}
+	s.conns[addr] = c
+	return c
+}
+
+// handle answers one request from an established connection.
+func (s *Server) handle(c *conn, typ string, body []byte) (rpc_response.IResponse, error) {
+	switch typ {
+	case "HealthCheckRequest":
+		return &rpc_response.HealthCheckResponse{Response: ok(requestID(body))}, nil
+
+	case "InstanceRequest":
+		var req rpc_request.InstanceRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		k := newServiceKey(req.Namespace, req.GroupName, req.ServiceName)
+		s.mu.Lock()
+		switch req.Type {
+		case "registerInstance":
+			s.register(k, req.Instance, c)
+		case "deregisterInstance":
+			s.deregister(k, req.Instance.Ip, req.Instance.Port, req.Instance.ClusterName)
+		default:
+			s.mu.Unlock()
+			return nil, fmt.Errorf("unknown instance request type %q", req.Type)
+		}
+		s.mu.Unlock()
+		return &rpc_response.InstanceResponse{Response: ok(req.RequestId)}, nil
+
+	case "BatchInstanceRequest":
+		var req rpc_request.BatchInstanceRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		k := newServiceKey(req.Namespace, req.GroupName, req.ServiceName)
+		s.mu.Lock()
+		// a batch replaces what the connection had registered for the service
+		svc := s.service(k)
+		for key, in := range svc.instances {
+			if in.owner == c {
+				delete(svc.instances, key)
+			}
+		}
+		for _, in := range req.Instances {
+			s.register(k, in, c)
+		}
+		if len(req.Instances) == 0 {
+			s.changed(k, svc)
+		}
+		s.mu.Unlock()
+		return &rpc_response.BatchInstanceResponse{Response: ok(req.RequestId)}, nil
+
+	case "SubscribeServiceRequest":
+		var req rpc_request.SubscribeServiceRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		k := newServiceKey(req.Namespace, req.GroupName, req.ServiceName)
+		s.mu.Lock()
+		info := s.subscribe(c, k, req.Clusters, req.Subscribe)
+		s.mu.Unlock()
+		return &rpc_response.SubscribeServiceResponse{Response: ok(req.RequestId), ServiceInfo: info}, nil
+
+	case "ServiceQueryRequest":
+		var req rpc_request.ServiceQueryRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		k := newServiceKey(req.Namespace, req.GroupName, req.ServiceName)
+		s.mu.Lock()
+		info := s.serviceInfo(k, req.Cluster, req.HealthyOnly)
+		s.mu.Unlock()
+		return &rpc_response.QueryServiceResponse{Response: ok(req.RequestId), ServiceInfo: info}, nil
+
+	case "ServiceListRequest":
+		var req rpc_request.ServiceListRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		names := s.serviceNames(req.Namespace, req.GroupName)
+		s.mu.Unlock()
+		return &rpc_response.ServiceListResponse{
+			Response:     ok(req.RequestId),
+			Count:        len(names),
+			ServiceNames: page(names, req.PageNo, req.PageSize),
+		}, nil
+
+	case "ConfigQueryRequest", "ConfigPublishRequest", "ConfigRemoveRequest", "ConfigBatchListenRequest":
+		return s.handleConfig(c, typ, body)
+	}
+	return errorResponse(codeNotImplemented, typ+" is not implemented"), nil
+}
+
+// RequestBiStream carries server pushes. The client opens it right after
+// its ServerCheckRequest and sends ConnectionSetupRequest on it; from then
+// on its requests are accepted until the stream ends.
+type streamServer Server
+
+func (ss *streamServer) RequestBiStream(stream nacos_grpc_service.BiRequestStream_RequestBiStreamServer) error {
+	s := (*Server)(ss)
+	addr := peerAddr(stream.Context())
+	s.mu.Lock()
+	c := s.conns[addr]
+	s.mu.Unlock()
+	if c == nil {
+		return errors.New("no ServerCheckRequest on this connection")
+	}
+
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		for {
+			p, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			switch typ := p.GetMetadata().GetType(); typ {
+			case "ConnectionSetupRequest":
+				s.mu.Lock()
+				if c.state == connChecked {
+					c.state = connSetup
+					c.lastActive = time.Now()
+				}
+				s.mu.Unlock()
+				log.Printf("conn %s: set up from %s\n", c.id, c.clientIP)
+			default:
+				c.acks.Add(1)
+			}
+		}
+	}()
+
+	err := s.pushLoop(c, stream, recvDone)
+	s.mu.Lock()
+	if s.conns[addr] == c {
+		delete(s.conns, addr)
+	}
+	s.forget(c)
+	s.mu.Unlock()
+	c.close()
+	log.Printf("conn %s: closed after %v\n", c.id, time.Since(c.started).Round(time.Millisecond))
+	return err
+}
+
+// pushLoop sends queued pushes until the client goes away or the
+// connection is closed.
+func (s *Server) pushLoop(c *conn, stream nacos_grpc_service.BiRequestStream_RequestBiStreamServer, recvDone <-chan struct{}) error {
+	for {
+		var p push
+		select {
+		case p = <-c.queue:
+		case <-recvDone:
+			return nil
+		case <-c.closed:
+			return nil
+		}
+		if wait := time.Until(p.due); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-recvDone:
+				return nil
+			case <-c.closed:
+				return nil
+			}
+		}
+		payload, err := payloadOf(p.req.GetRequestType(), p.req)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(payload); err != nil {
+			return err
+		}
+		c.pushes.Add(1)
+	}
+}
+
+func ok(requestID string) *rpc_response.Response {
+	return &rpc_response.Response{ResultCode: 200, Success: true, RequestId: requestID}
+}
+
+func errorResponse(code int, msg string) *rpc_response.ErrorResponse {
+	return &rpc_response.ErrorResponse{Response: &rpc_response.Response{ResultCode: codeServerError, ErrorCode: code, Message: msg}}
+}
+
+// requestID pulls the request ID out of a body that is not decoded anyway.
+func requestID(body []byte) string {
+	var r struct {
+		RequestID string `json:"requestId"`
+	}
+	json.Unmarshal(body, &r)
+	return r.RequestID
+}
+
+func decode(body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("bad body: %w", err)
+	}
+	return nil
+}
+
+// reply wraps a response. The whole struct is marshalled: the SDK's own
+// GetBody only covers the embedded base.
+func reply(resp rpc_response.IResponse) (*nacos_grpc_service.Payload, error) {
+	return payloadOf(resp.GetResponseType(), resp)
+}
+
+func payloadOf(typ string, v interface{}) (*nacos_grpc_service.Payload, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &nacos_grpc_service.Payload{
+		Metadata: &nacos_grpc_service.Metadata{Type: typ, ClientIp: localIP},
+		Body:     &any.Any{Value: b},
+	}, nil
+}
+
+var localIP = func() string {
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			return n.IP.String()
+		}
+	}
+	return "127.0.0.1"
+}()
+
+// configKey names a config entry.
+type configKey struct {
+	tenant, group, dataID string
+}
+
+type configItem struct {
+	content  string
+	md5      string
+	modified time.Time
+}
+
+// handleConfig answers the config requests dubbo-go's config center and
+// metadata report make.
+func (s *Server) handleConfig(c *conn, typ string, body []byte) (rpc_response.IResponse, error) {
+	switch typ {
+	case "ConfigQueryRequest":
+		var req rpc_request.ConfigQueryRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		item := s.configs[configKey{req.Tenant, req.Group, req.DataId}]
+		s.mu.Unlock()
+		if item == nil {
+			resp := errorResponse(codeConfigNotFound, "config data not exist").Response
+			resp.RequestId = req.RequestId
+			return &rpc_response.ConfigQueryResponse{Response: resp}, nil
+		}
+		return &rpc_response.ConfigQueryResponse{
+			Response:     ok(req.RequestId),
+			Content:      item.content,
+			Md5:          item.md5,
+			ContentType:  "text",
+			LastModified: item.modified.UnixMilli(),
+		}, nil
+
+	case "ConfigPublishRequest":
+		var req rpc_request.ConfigPublishRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		k := configKey{req.Tenant, req.Group, req.DataId}
+		s.mu.Lock()
+		s.configs[k] = &configItem{content: req.Content, md5: md5Hex(req.Content), modified: time.Now()}
+		s.configChanged(k)
+		s.mu.Unlock()
+		return &rpc_response.ConfigPublishResponse{Response: ok(req.RequestId)}, nil
+
+	case "ConfigRemoveRequest":
+		var req rpc_request.ConfigRemoveRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		k := configKey{req.Tenant, req.Group, req.DataId}
+		s.mu.Lock()
+		delete(s.configs, k)
+		s.configChanged(k)
+		s.mu.Unlock()
+		return &rpc_response.ConfigRemoveResponse{Response: ok(req.RequestId)}, nil
+
+	default: // ConfigBatchListenRequest
+		var req rpc_request.ConfigBatchListenRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		changed := []model.ConfigContext{}
+		s.mu.Lock()
+		for _, l := range req.ConfigListenContexts {
+			k := configKey{l.Tenant, l.Group, l.DataId}
+			if !req.Listen {
+				delete(s.listeners[k], c)
+				continue
+			}
+			if s.listeners[k] == nil {
+				s.listeners[k] = map[*conn]bool{}
+			}
+			s.listeners[k][c] = true
+			md5 := ""
+			if item := s.configs[k]; item != nil {
+				md5 = item.md5
+			}
+			if md5 != l.Md5 {
+				changed = append(changed, model.ConfigContext{Group: l.Group, DataId: l.DataId, Tenant: l.Tenant})
+			}
+		}
+		s.mu.Unlock()
+		return &rpc_response.ConfigChangeBatchListenResponse{Response: ok(req.RequestId), ChangedConfigs: changed}, nil
+	}
+}
+
+// configChanged tells the listeners of a config entry to fetch it again.
+// Called with s.mu held.
+func (s *Server) configChanged(k configKey) {
+	for c := range s.listeners[k] {
+		s.pushID++
+		req := rpc_request.NewConfigChangeNotifyRequest(k.group, k.dataID, k.tenant)
+		req.RequestId = strconv.FormatInt(s.pushID, 10)
+		c.enqueue(req, s.pushDelay)
+	}
+}
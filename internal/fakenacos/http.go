@@ -0,0 +1,196 @@
+package fakenacos
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+)
+
+// Nacos v1 beat result codes.
+const (
+	beatOK          = 10200
+	beatNotFound    = 20404
+	beatIntervalMin = time.Second
+)
+
+// routes serves the v1 naming API the clients fall back to for persistent
+// instances and health, and the fake's own admin API:
+//
+//	GET  /fake/          services, instances, connections and failure modes as JSON
+//	POST /fake/cmd BODY  run the command in BODY, see Server.Do
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nacos/v1/ns/instance", s.httpInstance)
+	mux.HandleFunc("/nacos/v1/ns/instance/beat", s.httpBeat)
+	mux.HandleFunc("/nacos/v1/ns/instance/list", s.httpInstanceList)
+	mux.HandleFunc("/nacos/v1/ns/service/list", s.httpServiceList)
+	mux.HandleFunc("/nacos/v1/ns/operator/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "UP"})
+	})
+	mux.HandleFunc("/fake/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fake/" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, s.Status())
+	})
+	mux.HandleFunc("/fake/cmd", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a command", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("admin: %s\n", strings.TrimSpace(string(body)))
+		result, err := s.Do(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]string{"result": result})
+	})
+	return mux
+}
+
+// formKey reads the service named by a v1 request. serviceName may carry
+// the group as group@@name.
+func formKey(r *http.Request) serviceKey {
+	return newServiceKey(r.Form.Get("namespaceId"), r.Form.Get("groupName"), r.Form.Get("serviceName"))
+}
+
+func formBool(r *http.Request, key string, def bool) bool {
+	if b, err := strconv.ParseBool(r.Form.Get(key)); err == nil {
+		return b
+	}
+	return def
+}
+
+// httpInstance registers (POST, PUT) or deregisters (DELETE) an instance.
+// Ephemeral ones must beat to stay; persistent ones stay until deleted.
+func (s *Server) httpInstance(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	k := formKey(r)
+	ip := r.Form.Get("ip")
+	port, err := strconv.ParseUint(r.Form.Get("port"), 10, 64)
+	if k.name == "" || ip == "" || err != nil {
+		http.Error(w, "serviceName, ip and port are required", http.StatusBadRequest)
+		return
+	}
+	cluster := r.Form.Get("clusterName")
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		in := model.Instance{
+			Ip:          ip,
+			Port:        port,
+			Weight:      1,
+			Enable:      formBool(r, "enable", true),
+			Ephemeral:   formBool(r, "ephemeral", true),
+			ClusterName: cluster,
+		}
+		if wt, err := strconv.ParseFloat(r.Form.Get("weight"), 64); err == nil {
+			in.Weight = wt
+		}
+		if md := r.Form.Get("metadata"); md != "" {
+			if err := json.Unmarshal([]byte(md), &in.Metadata); err != nil {
+				http.Error(w, "metadata: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		s.mu.Lock()
+		s.register(k, in, nil)
+		s.mu.Unlock()
+	case http.MethodDelete:
+		s.mu.Lock()
+		s.deregister(k, ip, port, cluster)
+		s.mu.Unlock()
+	default:
+		http.Error(w, "POST, PUT or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	io.WriteString(w, "ok")
+}
+
+// httpBeat refreshes an ephemeral HTTP instance. An unknown one gets
+// beatNotFound, which makes the client register it again.
+func (s *Server) httpBeat(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	k := formKey(r)
+	var beat model.BeatInfo
+	if b := r.Form.Get("beat"); b != "" {
+		if err := json.Unmarshal([]byte(b), &beat); err != nil {
+			http.Error(w, "beat: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		beat.Ip = r.Form.Get("ip")
+		beat.Port, _ = strconv.ParseUint(r.Form.Get("port"), 10, 64)
+		beat.Cluster = r.Form.Get("clusterName")
+	}
+	s.mu.Lock()
+	known := s.beat(k, beat.Ip, beat.Port, beat.Cluster)
+	interval := s.ttl / 3
+	s.mu.Unlock()
+	if !known {
+		writeJSON(w, map[string]int{"code": beatNotFound})
+		return
+	}
+	if interval < beatIntervalMin {
+		interval = beatIntervalMin
+	}
+	writeJSON(w, map[string]interface{}{
+		"code":               beatOK,
+		"clientBeatInterval": interval.Milliseconds(),
+		"lightBeatEnabled":   true,
+	})
+}
+
+func (s *Server) httpInstanceList(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	k := formKey(r)
+	s.mu.Lock()
+	info := s.serviceInfo(k, r.Form.Get("clusters"), formBool(r, "healthyOnly", false))
+	s.mu.Unlock()
+	writeJSON(w, info)
+}
+
+func (s *Server) httpServiceList(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pageNo, _ := strconv.Atoi(r.Form.Get("pageNo"))
+	pageSize, _ := strconv.Atoi(r.Form.Get("pageSize"))
+	s.mu.Lock()
+	names := s.serviceNames(r.Form.Get("namespaceId"), r.Form.Get("groupName"))
+	s.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"count": len(names), "doms": page(names, pageNo, pageSize)})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Printf("admin write error: %v\n", err)
+	}
+}
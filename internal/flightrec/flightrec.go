@@ -0,0 +1,217 @@
+// Package flightrec dumps what a process was doing when a call went wrong: a
+// goroutine profile, heap stats, the last getty session log lines and a few
+// seconds of runtime/trace, into a directory of their own. The consumer
+// triggers it on transport timeouts; the provider serves it on demand. The
+// timeouts in errror.log come and go, and are over before a profiler can be
+// attached.
+package flightrec
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"time"
+
+	"dubbo-demo/internal/failure"
+)
+
+// Files of a dump.
+const (
+	ReasonFile     = "reason.txt"
+	GoroutinesFile = "goroutines.txt" // every goroutine's stack, as pprof's debug=2
+	MemStatsFile   = "memstats.json"  // runtime.MemStats
+	HeapFile       = "heap.pprof"     // heap profile, for go tool pprof
+	SessionsFile   = "sessions.log"   // the last getty session lines, as logscan reads them
+	TraceFile      = "trace.out"      // runtime/trace from the trigger on, for go tool trace
+)
+
+// Recorder writes dumps into subdirectories of a directory.
+type Recorder struct {
+	dir      string
+	traceFor time.Duration
+	gap      time.Duration
+
+	// mu is held for the whole of a dump
+	mu      sync.Mutex
+	last    time.Time
+	skipped int
+}
+
+// New returns a Recorder dumping into dir, which it creates. Each dump
+// traces the runtime for traceFor, and Trigger dumps at most once per gap.
+func New(dir string, traceFor, gap time.Duration) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir, traceFor: traceFor, gap: gap}, nil
+}
+
+// Trigger dumps in the background for a call that failed with err, unless a
+// dump is running or the last one started less than the gap ago. reason names
+// the dump. It reports whether it started one.
+func (r *Recorder) Trigger(reason string, err error) bool {
+	if !r.mu.TryLock() {
+		return false
+	}
+	if !r.last.IsZero() && time.Since(r.last) < r.gap {
+		r.skipped++
+		r.mu.Unlock()
+		return false
+	}
+	go func() {
+		defer r.mu.Unlock()
+		if dir, err := r.dump(reason, failure.Summary(err), r.traceFor); err != nil {
+			log.Printf("flightrec: %s: %v\n", reason, err)
+		} else {
+			log.Printf("flightrec: %s, dumped to %s\n", reason, dir)
+		}
+	}()
+	return true
+}
+
+// Dump dumps now, tracing for traceFor, and returns the dump's directory.
+// It waits for a dump in progress.
+func (r *Recorder) Dump(reason string, traceFor time.Duration) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dump(reason, "", traceFor)
+}
+
+// tracing serializes the runtime traces of all recorders; the runtime has
+// one tracer.
+var tracing sync.Mutex
+
+var unsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+func (r *Recorder) dump(reason, detail string, traceFor time.Duration) (string, error) {
+	now := time.Now()
+	r.last = now
+	name := now.Format("20060102-150405.000") + "-" + unsafeChars.ReplaceAllString(reason, "_")
+	if len(name) > 80 {
+		name = name[:80]
+	}
+	dir := filepath.Join(r.dir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	// the stacks first, before the goroutines move on
+	if err := writeFile(dir, GoroutinesFile, func(w io.Writer) error {
+		return pprof.Lookup("goroutine").WriteTo(w, 2)
+	}); err != nil {
+		return dir, err
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if err := writeFile(dir, MemStatsFile, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ms)
+	}); err != nil {
+		return dir, err
+	}
+	if err := writeFile(dir, HeapFile, func(w io.Writer) error {
+		return pprof.Lookup("heap").WriteTo(w, 0)
+	}); err != nil {
+		return dir, err
+	}
+	if err := writeFile(dir, SessionsFile, func(w io.Writer) error {
+		for _, line := range recent.lines() {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return dir, err
+	}
+	if err := writeFile(dir, ReasonFile, func(w io.Writer) error {
+		fmt.Fprintf(w, "%s %s\n", now.Format(time.RFC3339Nano), reason)
+		if detail != "" {
+			fmt.Fprintln(w, detail)
+		}
+		_, err := fmt.Fprintf(w, "triggers skipped since the last dump: %d\n", r.skipped)
+		r.skipped = 0
+		return err
+	}); err != nil {
+		return dir, err
+	}
+	if traceFor > 0 {
+		if err := writeFile(dir, TraceFile, func(w io.Writer) error {
+			tracing.Lock()
+			defer tracing.Unlock()
+			if err := trace.Start(w); err != nil {
+				return err
+			}
+			time.Sleep(traceFor)
+			trace.Stop()
+			return nil
+		}); err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
+
+func writeFile(dir, name string, write func(io.Writer) error) error {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return f.Close()
+}
+
+// WriteArchive writes the files of the dump in dir to w as a tar.gz, under
+// the dump's own name.
+func WriteArchive(w io.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.Base(dir) + "/" + e.Name()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,122 @@
+package flightrec
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/dubbogo/gost/log/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// keepLines is how many session lines a dump gets.
+const keepLines = 500
+
+// recent holds the last session lines logged at info level or above. Debug
+// lines are left out: getty formats whole packets into some of them.
+var recent = &ring{buf: make([]string, keepLines)}
+
+// CaptureLogs tees the dubbo-go and getty loggers into the lines dumps get.
+// config.Load installs new loggers, so call it after every Load.
+func CaptureLogs() {
+	lg, ok := logger.GetLogger().(*zap.SugaredLogger)
+	if !ok {
+		log.Printf("flightrec: dubbo-go logs through %T, dumps will have no session lines\n", logger.GetLogger())
+		return
+	}
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	if lg == recent.tee {
+		return
+	}
+	core := ringCore{r: recent, enc: zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
+		TimeKey:        "time",
+		LevelKey:       "level",
+		CallerKey:      "caller",
+		MessageKey:     "message",
+		StacktraceKey:  "stacktrace",
+		EncodeLevel:    zapcore.CapitalLevelEncoder,
+		EncodeTime:     zapcore.TimeEncoderOfLayout("2006-01-02 15:04:05.000"),
+		EncodeDuration: zapcore.StringDurationEncoder,
+		EncodeCaller:   zapcore.ShortCallerEncoder,
+	})}
+	recent.tee = lg.Desugar().WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, core)
+	})).Sugar()
+	logger.SetLogger(recent.tee)
+	getty.SetLogger(recent.tee)
+}
+
+// ring keeps the last len(buf) lines.
+type ring struct {
+	mu   sync.Mutex
+	buf  []string
+	next int
+	full bool
+	tee  *zap.SugaredLogger
+}
+
+func (r *ring) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = line
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// lines returns the lines kept, oldest first.
+func (r *ring) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]string(nil), r.buf[:r.next]...)
+	}
+	return append(append([]string(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+// isSession tells lines about getty sessions: getty's own, and dubbo-go's
+// that name a session.
+func isSession(ent zapcore.Entry) bool {
+	return strings.Contains(ent.Caller.File, "dubbo-getty") ||
+		strings.Contains(ent.Message, "session") ||
+		strings.Contains(ent.Message, "TCP_CLIENT") ||
+		strings.Contains(ent.Message, "TCP_SERVER")
+}
+
+// ringCore is a zapcore.Core adding session lines to a ring.
+type ringCore struct {
+	r      *ring
+	enc    zapcore.Encoder
+	fields []zapcore.Field
+}
+
+func (c ringCore) Enabled(l zapcore.Level) bool { return l >= zapcore.InfoLevel }
+
+func (c ringCore) With(fields []zapcore.Field) zapcore.Core {
+	c.fields = append(append([]zapcore.Field(nil), c.fields...), fields...)
+	return c
+}
+
+func (c ringCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) && isSession(ent) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c ringCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	all := make([]zapcore.Field, 0, len(c.fields)+len(fields))
+	buf, err := c.enc.EncodeEntry(ent, append(append(all, c.fields...), fields...))
+	if err != nil {
+		return err
+	}
+	c.r.add(buf.String())
+	buf.Free()
+	return nil
+}
+
+func (c ringCore) Sync() error { return nil }
@@ -0,0 +1,296 @@
+// Package hedge is a cluster for providers that stall now and then. It sends
+// a call to one provider and, when no answer has come after the hedge delay,
+// sends it again to another, then returns the first success. The delay is a
+// fixed duration or a percentile of the latencies seen lately, so only the
+// slowest few calls are hedged. The vendored forking cluster sends every copy
+// at once, doubling the load, and failover only tries another provider once
+// the request timeout has passed.
+//
+// Hedging sends a call twice, so it is only for calls that are safe to
+// repeat, like SayHello.
+package hedge
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clusterpkg "dubbo.apache.org/dubbo-go/v3/cluster/cluster"
+	"dubbo.apache.org/dubbo-go/v3/cluster/cluster/base"
+	"dubbo.apache.org/dubbo-go/v3/cluster/directory"
+	"dubbo.apache.org/dubbo-go/v3/common"
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+	"dubbo.apache.org/dubbo-go/v3/protocol/invocation"
+	"github.com/dubbogo/gost/log/logger"
+
+	"dubbo-demo/internal/capacity"
+)
+
+// ClusterKey names the cluster, for a reference's cluster.
+const ClusterKey = "hedged"
+
+// Settings, from a reference's params.
+const (
+	// DelayKey is how long an attempt may go unanswered before the next one
+	// is sent: a duration like 50ms, or pNN for that percentile of recent
+	// latencies. Default p95.
+	DelayKey = "hedge.delay"
+	// MinDelayKey is the least a percentile delay can be. Default 1ms.
+	MinDelayKey = "hedge.min-delay"
+	// WindowKey is how many recent latencies a percentile is taken over.
+	// Default 200.
+	WindowKey = "hedge.window"
+	// AttemptsKey is how many attempts a call may make, the first one
+	// included. Default 2.
+	AttemptsKey = "hedge.max-attempts"
+)
+
+func init() {
+	extension.SetCluster(ClusterKey, func() clusterpkg.Cluster { return hedgedCluster{} })
+}
+
+type hedgedCluster struct{}
+
+func (hedgedCluster) Join(dir directory.Directory) protocol.Invoker {
+	return clusterpkg.BuildInterceptorChain(&clusterInvoker{
+		BaseClusterInvoker: base.NewBaseClusterInvoker(dir),
+		windows:            map[string]*window{},
+	})
+}
+
+// settings of one reference.
+type settings struct {
+	fixed    time.Duration // the delay when q is 0
+	q        float64       // the percentile of a pNN delay, 0 to 1
+	minDelay time.Duration
+	window   int
+	attempts int
+}
+
+func parseSettings(u *common.URL) settings {
+	s := settings{q: 0.95, minDelay: time.Millisecond, window: 200, attempts: 2}
+	if v := u.GetParam(DelayKey, ""); strings.HasPrefix(v, "p") {
+		if n, err := strconv.ParseFloat(v[1:], 64); err == nil && n > 0 && n < 100 {
+			s.q = n / 100
+		} else {
+			logger.Warnf("hedge: bad %s %q, using p95", DelayKey, v)
+		}
+	} else if v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			s.fixed, s.q = d, 0
+		} else {
+			logger.Warnf("hedge: bad %s %q, using p95", DelayKey, v)
+		}
+	}
+	if d, err := time.ParseDuration(u.GetParam(MinDelayKey, "")); err == nil {
+		s.minDelay = d
+	}
+	if n := u.GetParamInt32(WindowKey, 0); n > 0 {
+		s.window = int(n)
+	}
+	if n := u.GetParamInt32(AttemptsKey, 0); n > 0 {
+		s.attempts = int(n)
+	}
+	return s
+}
+
+// String describes the delay, e.g. "p95" or "50ms".
+func (s settings) String() string {
+	if s.q == 0 {
+		return s.fixed.String()
+	}
+	return "p" + strconv.FormatFloat(100*s.q, 'f', -1, 64)
+}
+
+type clusterInvoker struct {
+	base.BaseClusterInvoker
+
+	once     sync.Once
+	settings settings
+
+	mu      sync.Mutex
+	windows map[string]*window // recent latencies by method
+}
+
+// delay is how long method's attempts may go unanswered, 0 for not yet
+// known.
+func (c *clusterInvoker) delay(method string) (time.Duration, *window) {
+	c.mu.Lock()
+	w := c.windows[method]
+	if w == nil {
+		w = newWindow(c.settings.window)
+		c.windows[method] = w
+	}
+	c.mu.Unlock()
+	if c.settings.q == 0 {
+		return c.settings.fixed, w
+	}
+	d := w.percentile(c.settings.q)
+	if d > 0 && d < c.settings.minDelay {
+		d = c.settings.minDelay
+	}
+	return d, w
+}
+
+// attempt is one copy of a call.
+type attempt struct {
+	n        int // 1 for the first
+	inv      protocol.Invocation
+	provider string
+	result   protocol.Result
+	took     time.Duration
+}
+
+// Invoke sends inv to one provider, and to another every delay until one
+// of them succeeds or max-attempts have been sent. Attempts that fail are
+// not retried: a call whose attempts have all failed returns the last
+// failure, so one that fails before the delay fails at once.
+func (c *clusterInvoker) Invoke(ctx context.Context, inv protocol.Invocation) protocol.Result {
+	if err := c.CheckWhetherDestroyed(); err != nil {
+		return &protocol.RPCResult{Err: err}
+	}
+	invokers := c.Directory.List(inv)
+	if err := c.CheckInvokers(invokers, inv); err != nil {
+		return &protocol.RPCResult{Err: err}
+	}
+	c.once.Do(func() { c.settings = parseSettings(invokers[0].GetURL()) })
+	method := inv.ActualMethodName()
+	lb := base.GetLoadBalance(invokers[0], method)
+	delay, w := c.delay(method)
+	// the attempts still out once a call has returned are of no use
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan *attempt, c.settings.attempts)
+	var invoked []protocol.Invoker
+	send := func() {
+		// a hedge goes to a provider not tried yet, if there is one
+		candidates := others(invokers, invoked)
+		if len(candidates) == 0 {
+			candidates = invokers
+		}
+		ivk := c.DoSelect(lb, inv, candidates, nil)
+		invoked = append(invoked, ivk)
+		a := &attempt{n: len(invoked), inv: clone(inv)}
+		actx := capacity.WithProvider(ctx, &a.provider)
+		go func() {
+			start := time.Now()
+			a.result = ivk.Invoke(actx, a.inv)
+			a.took = time.Since(start)
+			results <- a
+		}()
+	}
+
+	send()
+	var (
+		t     *time.Timer
+		hedge <-chan time.Time // nil while no more hedges are due
+	)
+	if delay > 0 && c.settings.attempts > 1 {
+		t = time.NewTimer(delay)
+		defer t.Stop()
+		hedge = t.C
+	}
+	var last *attempt
+	for pending := 1; pending > 0; {
+		select {
+		case a := <-results:
+			pending--
+			if a.result.Error() == nil {
+				// only winners count: a stalled attempt that lost would
+				// drag the percentile up to the stall
+				w.add(a.took)
+				won(ctx, method, delay, len(invoked), inv, a)
+				return a.result
+			}
+			last = a
+		case <-hedge:
+			send()
+			pending++
+			if len(invoked) < c.settings.attempts {
+				t.Reset(delay)
+			} else {
+				hedge = nil
+			}
+		}
+	}
+	failed(method, delay, len(invoked))
+	return last.result
+}
+
+// others returns the invokers not in invoked.
+func others(invokers, invoked []protocol.Invoker) []protocol.Invoker {
+	var out []protocol.Invoker
+next:
+	for _, ivk := range invokers {
+		for _, done := range invoked {
+			if ivk == done {
+				continue next
+			}
+		}
+		out = append(out, ivk)
+	}
+	return out
+}
+
+// clone copies inv for one attempt. Each attempt has attachments of its own,
+// which the consumer filters write to, and a reply of its own to decode into.
+func clone(inv protocol.Invocation) protocol.Invocation {
+	attachments := make(map[string]interface{}, len(inv.Attachments()))
+	for k, v := range inv.Attachments() {
+		attachments[k] = v
+	}
+	c := invocation.NewRPCInvocationWithOptions(
+		invocation.WithMethodName(inv.MethodName()),
+		invocation.WithParameterTypes(inv.ParameterTypes()),
+		invocation.WithParameterTypeNames(inv.ParameterTypeNames()),
+		invocation.WithParameterValues(inv.ParameterValues()),
+		invocation.WithArguments(inv.Arguments()),
+		invocation.WithAttachments(attachments),
+		invocation.WithInvoker(inv.Invoker()),
+	)
+	for k, v := range inv.Attributes() {
+		c.SetAttribute(k, v)
+	}
+	if r := inv.Reply(); r != nil {
+		if t := reflect.TypeOf(r); t.Kind() == reflect.Ptr {
+			c.SetReply(reflect.New(t.Elem()).Interface())
+		} else {
+			c.SetReply(r)
+		}
+	}
+	return c
+}
+
+// won hands the winning attempt's reply and provider to the caller and
+// records the win.
+func won(ctx context.Context, method string, delay time.Duration, sent int, inv protocol.Invocation, a *attempt) {
+	if r := inv.Reply(); r != nil && r != a.inv.Reply() && reflect.TypeOf(r).Kind() == reflect.Ptr {
+		reflect.ValueOf(r).Elem().Set(reflect.ValueOf(a.inv.Reply()).Elem())
+		a.result.SetResult(r)
+	}
+	if p := capacity.ProviderOut(ctx); p != nil {
+		*p = a.provider
+	}
+	if n, ok := ctx.Value(attemptKey{}).(*int); ok {
+		*n = a.n
+	}
+	record(method, delay, sent, a.n)
+}
+
+func failed(method string, delay time.Duration, sent int) {
+	record(method, delay, sent, 0)
+}
+
+type attemptKey struct{}
+
+// WithAttempt returns ctx in which a hedged call writes which of its
+// attempts succeeded to *n: 1 for the first, 2 for the first hedge, and so
+// on. A call that fails leaves it alone.
+func WithAttempt(ctx context.Context, n *int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, n)
+}
@@ -0,0 +1,61 @@
+package hedge
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// minSamples is how many latencies a window needs before it has
+// percentiles; until then calls are not hedged.
+const minSamples = 20
+
+// window keeps the latencies of the attempts that last won a method's calls.
+type window struct {
+	mu     sync.Mutex
+	buf    []time.Duration
+	next   int
+	full   bool
+	stale  int // samples added since sorted was taken
+	sorted []time.Duration
+}
+
+func newWindow(size int) *window {
+	return &window{buf: make([]time.Duration, size)}
+}
+
+func (w *window) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf[w.next] = d
+	w.next = (w.next + 1) % len(w.buf)
+	if w.next == 0 {
+		w.full = true
+	}
+	w.stale++
+}
+
+// percentile returns the q-th percentile of the window, 0 while it has
+// fewer than minSamples. It sorts the window again only after a twentieth
+// of it has changed.
+func (w *window) percentile(q float64) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := w.next
+	if w.full {
+		n = len(w.buf)
+	}
+	if n < minSamples {
+		return 0
+	}
+	if w.sorted == nil || w.stale*20 >= n {
+		w.sorted = append(w.sorted[:0], w.buf[:n]...)
+		sort.Slice(w.sorted, func(i, j int) bool { return w.sorted[i] < w.sorted[j] })
+		w.stale = 0
+	}
+	i := int(q*float64(len(w.sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	return w.sorted[i]
+}
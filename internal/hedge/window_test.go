@@ -0,0 +1,54 @@
+package hedge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	for _, tc := range []struct {
+		name string
+		size int
+		adds int // latencies 1ms, 2ms, ... added in order
+		q    float64
+		want time.Duration
+	}{
+		{"empty", 200, 0, 0.95, 0},
+		{"one short of minSamples", 200, minSamples - 1, 0.95, 0},
+		{"minSamples", 200, minSamples, 0.95, ms(19)},
+		{"p95", 200, 100, 0.95, ms(95)},
+		{"p50", 200, 100, 0.5, ms(50)},
+		{"lowest", 200, 100, 0.001, ms(1)},
+		{"highest", 200, 100, 0.999, ms(100)},
+		{"full window keeps the latest", 20, 40, 0.5, ms(30)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newWindow(tc.size)
+			for i := 1; i <= tc.adds; i++ {
+				w.add(ms(i))
+			}
+			if got := w.percentile(tc.q); got != tc.want {
+				t.Errorf("percentile(%v) of %d latencies in a window of %d = %v, want %v", tc.q, tc.adds, tc.size, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestPercentileResorts checks that a percentile follows new latencies once
+// enough of the window has changed since it was last sorted.
+func TestPercentileResorts(t *testing.T) {
+	w := newWindow(100)
+	for i := 0; i < 100; i++ {
+		w.add(time.Millisecond)
+	}
+	if got := w.percentile(0.95); got != time.Millisecond {
+		t.Fatalf("p95 of 1ms latencies = %v", got)
+	}
+	for i := 0; i < 10; i++ {
+		w.add(time.Second)
+	}
+	if got := w.percentile(0.95); got != time.Second {
+		t.Fatalf("p95 after a tenth of the window turned 1s = %v, want 1s", got)
+	}
+}
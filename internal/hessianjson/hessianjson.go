@@ -0,0 +1,65 @@
+// Package hessianjson turns hessian decoded values into something
+// encoding/json can print.
+package hessianjson
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"unicode/utf8"
+
+	hessian "github.com/apache/dubbo-go-hessian2"
+)
+
+// Value converts v in place where it can: map keys become strings, readable
+// byte slices become text and POJOs become maps with a "class" key.
+func Value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, field := range v {
+			m[fmt.Sprint(k)] = Value(field)
+		}
+		return m
+	case map[string]interface{}:
+		for k, field := range v {
+			v[k] = Value(field)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = Value(v[i])
+		}
+		return v
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return v
+	case hessian.POJO:
+		return pojoFields(v)
+	case error:
+		return v.Error()
+	default:
+		return v
+	}
+}
+
+func pojoFields(p hessian.POJO) interface{} {
+	rv := reflect.Indirect(reflect.ValueOf(p))
+	if rv.Kind() != reflect.Struct {
+		return p
+	}
+	m := map[string]interface{}{"class": p.JavaClassName()}
+	fields := make([]string, 0, rv.NumField())
+	for i := 0; i < rv.NumField(); i++ {
+		if rv.Type().Field(i).IsExported() {
+			fields = append(fields, rv.Type().Field(i).Name)
+		}
+	}
+	sort.Strings(fields)
+	for _, name := range fields {
+		m[name] = Value(rv.FieldByName(name).Interface())
+	}
+	return m
+}
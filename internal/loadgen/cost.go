@@ -0,0 +1,175 @@
+package loadgen
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CostDist produces the simulated server-side cost sent with each request.
+type CostDist interface {
+	Next() time.Duration
+	String() string
+}
+
+// ParseCost builds a CostDist from a spec of the form
+//
+//	fixed:5s
+//	uniform:3s,10s
+//	exp:5s          (exponential with the given mean)
+//	hist:costs.txt  (one "<duration> <weight>" pair per line)
+func ParseCost(spec string) (CostDist, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "fixed":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("fixed cost %q: %w", arg, err)
+		}
+		return fixedCost(d), nil
+	case "uniform":
+		lo, hi, ok := strings.Cut(arg, ",")
+		if !ok {
+			return nil, fmt.Errorf("uniform cost %q: want min,max", arg)
+		}
+		min, err := time.ParseDuration(lo)
+		if err != nil {
+			return nil, fmt.Errorf("uniform cost min %q: %w", lo, err)
+		}
+		max, err := time.ParseDuration(hi)
+		if err != nil {
+			return nil, fmt.Errorf("uniform cost max %q: %w", hi, err)
+		}
+		if max < min {
+			return nil, fmt.Errorf("uniform cost %q: max < min", arg)
+		}
+		return &uniformCost{min: min, max: max, rnd: newRand()}, nil
+	case "exp":
+		mean, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("exp cost %q: %w", arg, err)
+		}
+		return &expCost{mean: mean, rnd: newRand()}, nil
+	case "hist":
+		return loadHistogram(arg)
+	default:
+		return nil, fmt.Errorf("unknown cost distribution %q", spec)
+	}
+}
+
+// FormatCost renders d the way the provider parses the "cost" request key.
+func FormatCost(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+type fixedCost time.Duration
+
+func (c fixedCost) Next() time.Duration { return time.Duration(c) }
+
+func (c fixedCost) String() string { return "fixed:" + time.Duration(c).String() }
+
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newRand() *lockedRand {
+	return &lockedRand{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Int63n(n)
+}
+
+func (r *lockedRand) ExpFloat64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.ExpFloat64()
+}
+
+type uniformCost struct {
+	min, max time.Duration
+	rnd      *lockedRand
+}
+
+func (c *uniformCost) Next() time.Duration {
+	if c.max == c.min {
+		return c.min
+	}
+	return c.min + time.Duration(c.rnd.Int63n(int64(c.max-c.min)))
+}
+
+func (c *uniformCost) String() string { return fmt.Sprintf("uniform:%v,%v", c.min, c.max) }
+
+type expCost struct {
+	mean time.Duration
+	rnd  *lockedRand
+}
+
+func (c *expCost) Next() time.Duration {
+	return time.Duration(c.rnd.ExpFloat64() * float64(c.mean))
+}
+
+func (c *expCost) String() string { return "exp:" + c.mean.String() }
+
+type histCost struct {
+	path   string
+	values []time.Duration
+	cumsum []int64
+	total  int64
+	rnd    *lockedRand
+}
+
+func loadHistogram(path string) (*histCost, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := &histCost{path: path, rnd: newRand()}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		d, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		weight := int64(1)
+		if len(fields) > 1 {
+			if weight, err = strconv.ParseInt(fields[1], 10, 64); err != nil || weight < 0 {
+				return nil, fmt.Errorf("%s:%d: bad weight %q", path, line, fields[1])
+			}
+		}
+		h.total += weight
+		h.values = append(h.values, d)
+		h.cumsum = append(h.cumsum, h.total)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if h.total == 0 {
+		return nil, fmt.Errorf("%s: histogram is empty", path)
+	}
+	return h, nil
+}
+
+func (c *histCost) Next() time.Duration {
+	n := c.rnd.Int63n(c.total)
+	i := sort.Search(len(c.cumsum), func(i int) bool { return c.cumsum[i] > n })
+	return c.values[i]
+}
+
+func (c *histCost) String() string { return "hist:" + c.path }
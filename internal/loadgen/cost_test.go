@@ -0,0 +1,98 @@
+package loadgen
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCost(t *testing.T) {
+	dir := t.TempDir()
+	hist := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	weighted := hist("weighted.txt", "# cost weight\n100ms 3\n\n2s\n5s 0\n")
+	badWeight := hist("bad-weight.txt", "1s x\n")
+	badDuration := hist("bad-duration.txt", "1s\nsoon 2\n")
+	empty := hist("empty.txt", "# nothing\n1s 0\n")
+
+	for _, tc := range []struct {
+		spec string
+		// every draw must be one of in, or else within [min, max]
+		in       []time.Duration
+		min, max time.Duration
+		// mean, if set, is what the draws must average to within 10%
+		mean time.Duration
+		err  string
+	}{
+		{spec: "fixed:5s", in: []time.Duration{5 * time.Second}},
+		{spec: "fixed:0s", in: []time.Duration{0}},
+		{spec: "uniform:3s,10s", min: 3 * time.Second, max: 10 * time.Second, mean: 6500 * time.Millisecond},
+		{spec: "uniform:1s,1s", in: []time.Duration{time.Second}},
+		{spec: "exp:5s", min: 0, max: time.Hour, mean: 5 * time.Second},
+		{spec: "hist:" + weighted, in: []time.Duration{100 * time.Millisecond, 2 * time.Second}, mean: 575 * time.Millisecond},
+
+		{spec: "fixed:5", err: `fixed cost "5"`},
+		{spec: "fixed", err: `fixed cost ""`},
+		{spec: "uniform:3s", err: "want min,max"},
+		{spec: "uniform:x,1s", err: `uniform cost min "x"`},
+		{spec: "uniform:1s,x", err: `uniform cost max "x"`},
+		{spec: "uniform:5s,1s", err: "max < min"},
+		{spec: "exp:", err: `exp cost ""`},
+		{spec: "hist:" + filepath.Join(dir, "missing.txt"), err: "no such file"},
+		{spec: "hist:" + badWeight, err: `:1: bad weight "x"`},
+		{spec: "hist:" + badDuration, err: ":2: time: invalid duration"},
+		{spec: "hist:" + empty, err: "histogram is empty"},
+		{spec: "gauss:1s", err: `unknown cost distribution "gauss:1s"`},
+		{spec: "5s", err: `unknown cost distribution "5s"`},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			c, err := ParseCost(tc.spec)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("ParseCost(%q) = %v, %v; want an error containing %q", tc.spec, c, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCost(%q) = %v", tc.spec, err)
+			}
+			if c.String() != tc.spec {
+				t.Errorf("String() = %q, want %q", c.String(), tc.spec)
+			}
+			const draws = 10000
+			var sum time.Duration
+			for i := 0; i < draws; i++ {
+				d := c.Next()
+				sum += d
+				if tc.in != nil {
+					if !contains(tc.in, d) {
+						t.Fatalf("drew %v, want one of %v", d, tc.in)
+					}
+				} else if d < tc.min || d > tc.max {
+					t.Fatalf("drew %v, want within [%v, %v]", d, tc.min, tc.max)
+				}
+			}
+			if tc.mean > 0 {
+				if mean := sum / draws; mean < tc.mean*9/10 || mean > tc.mean*11/10 {
+					t.Errorf("draws average %v, want about %v", mean, tc.mean)
+				}
+			}
+		})
+	}
+}
+
+func contains(ds []time.Duration, d time.Duration) bool {
+	for _, x := range ds {
+		if x == d {
+			return true
+		}
+	}
+	return false
+}
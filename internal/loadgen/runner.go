@@ -0,0 +1,62 @@
+package loadgen
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Config controls the shape of a load run.
+type Config struct {
+	// Concurrency is the number of workers issuing calls in parallel.
+	Concurrency int
+	// QPS caps the aggregate call rate; zero means as fast as the workers go.
+	QPS float64
+	// Duration bounds the run; zero means until ctx is cancelled.
+	Duration time.Duration
+}
+
+// Run drives call from cfg.Concurrency workers until the duration elapses or
+// ctx is done, then waits for in-flight calls and returns the collected stats.
+func Run(ctx context.Context, cfg Config, stats *Stats, call func(ctx context.Context) error) *Stats {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	limit := rate.Inf
+	burst := cfg.Concurrency
+	if cfg.QPS > 0 {
+		limit = rate.Limit(cfg.QPS)
+		burst = int(math.Max(1, math.Ceil(cfg.QPS/10)))
+	}
+	limiter := rate.NewLimiter(limit, burst)
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := limiter.Wait(ctx); err != nil {
+					return
+				}
+				// calls run to completion on their own timeouts so that a
+				// run ending mid-flight does not show up as cancellations
+				st := time.Now()
+				err := call(context.Background())
+				stats.Observe(time.Since(st), err)
+			}
+		}()
+	}
+	wg.Wait()
+	stats.Stop()
+	return stats
+}
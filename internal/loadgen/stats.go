@@ -0,0 +1,140 @@
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sampleSize caps the latencies Stats keeps for percentiles. A run that
+// goes on until interrupted would otherwise hold every latency it saw.
+const sampleSize = 100000
+
+// Stats collects per-call latencies and outcomes of a load run. Past
+// sampleSize calls, percentiles come from a uniform sample of the
+// latencies; the call count and maximum stay exact.
+type Stats struct {
+	// Classify maps a failed call onto the kind it is counted under.
+	Classify func(error) string
+
+	mu        sync.Mutex
+	start     time.Time
+	end       time.Time
+	calls     int
+	max       time.Duration
+	latencies []time.Duration // reservoir sample of at most size
+	size      int
+	rnd       *lockedRand
+	errors    map[string]int
+}
+
+// NewStats returns Stats whose clock starts now.
+func NewStats(classify func(error) string) *Stats {
+	return &Stats{
+		Classify: classify,
+		start:    time.Now(),
+		size:     sampleSize,
+		rnd:      newRand(),
+		errors:   make(map[string]int),
+	}
+}
+
+// Observe records one call.
+func (s *Stats) Observe(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if latency > s.max {
+		s.max = latency
+	}
+	if len(s.latencies) < s.size {
+		s.latencies = append(s.latencies, latency)
+	} else if i := s.rnd.Int63n(int64(s.calls)); i < int64(s.size) {
+		// each call seen so far stays in the sample with equal chance
+		s.latencies[i] = latency
+	}
+	if err != nil {
+		kind := "error"
+		if s.Classify != nil {
+			kind = s.Classify(err)
+		}
+		s.errors[kind]++
+	}
+}
+
+// Stop freezes the wall clock used for throughput.
+func (s *Stats) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+}
+
+// Percentile returns the q-th (0..1) latency percentile of all observed
+// calls; 1 gives the maximum.
+func (s *Stats) Percentile(q float64) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q >= 1 {
+		return s.max
+	}
+	return percentile(s.sorted(), q)
+}
+
+func (s *Stats) sorted() []time.Duration {
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(q*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Report writes a human-readable summary of the run to w.
+func (s *Stats) Report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := s.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(s.start)
+	sorted := s.sorted()
+	failed := 0
+	for _, n := range s.errors {
+		failed += n
+	}
+
+	fmt.Fprintf(w, "requests: %d ok: %d failed: %d elapsed: %v\n",
+		s.calls, s.calls-failed, failed, elapsed.Round(time.Millisecond))
+	if elapsed > 0 {
+		fmt.Fprintf(w, "throughput: %.2f req/s\n", float64(s.calls)/elapsed.Seconds())
+	}
+	if s.calls > 0 {
+		fmt.Fprintf(w, "latency: p50=%v p90=%v p99=%v max=%v\n",
+			percentile(sorted, 0.50), percentile(sorted, 0.90), percentile(sorted, 0.99), s.max)
+	}
+	kinds := make([]string, 0, len(s.errors))
+	for kind := range s.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "errors[%s]: %d\n", kind, s.errors[kind])
+	}
+}
@@ -0,0 +1,74 @@
+package loadgen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsPercentile(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	for _, tc := range []struct {
+		name  string
+		calls int // latencies 1ms, 2ms, ... observed in order
+		q     float64
+		want  time.Duration
+	}{
+		{"empty", 0, 0.5, 0},
+		{"empty max", 0, 1, 0},
+		{"one call", 1, 0.99, ms(1)},
+		{"p50", 100, 0.5, ms(50)},
+		{"p90", 100, 0.9, ms(90)},
+		{"p99", 100, 0.99, ms(99)},
+		{"lowest", 100, 0.001, ms(1)},
+		{"max", 100, 1, ms(100)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewStats(nil)
+			for i := 1; i <= tc.calls; i++ {
+				s.Observe(ms(i), nil)
+			}
+			if got := s.Percentile(tc.q); got != tc.want {
+				t.Errorf("Percentile(%v) of %d calls = %v, want %v", tc.q, tc.calls, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestStatsSample checks that a long run keeps a bounded sample whose
+// percentiles still track the latencies, with the count and max exact.
+func TestStatsSample(t *testing.T) {
+	s := NewStats(nil)
+	s.size = 1000
+	const calls = 100000
+	for i := 0; i < calls; i++ {
+		// 1ms to 100ms, evenly
+		s.Observe(time.Duration(i%100+1)*time.Millisecond, nil)
+	}
+	s.Observe(10*time.Second, nil)
+
+	if len(s.latencies) != s.size {
+		t.Errorf("kept %d latencies, want %d", len(s.latencies), s.size)
+	}
+	if got := s.Percentile(1); got != 10*time.Second {
+		t.Errorf("max = %v, want 10s", got)
+	}
+	for _, tc := range []struct {
+		q        float64
+		min, max time.Duration
+	}{
+		{0.5, 40 * time.Millisecond, 60 * time.Millisecond},
+		{0.9, 80 * time.Millisecond, 100 * time.Millisecond},
+	} {
+		if got := s.Percentile(tc.q); got < tc.min || got > tc.max {
+			t.Errorf("Percentile(%v) = %v, want within [%v, %v]", tc.q, got, tc.min, tc.max)
+		}
+	}
+
+	var out bytes.Buffer
+	s.Report(&out)
+	if !strings.Contains(out.String(), "requests: 100001 ok: 100001") || !strings.Contains(out.String(), "max=10s") {
+		t.Errorf("report does not count every call or the max:\n%s", out.String())
+	}
+}
@@ -0,0 +1,306 @@
+// Package localregistry provides registries that need no network service:
+// "file" shares instances through a directory, "memory" through the current
+// process. Both follow the nacos registry's naming and its subscribe/notify
+// contract, so directory and failover behave the same as against Nacos.
+//
+//	registries:
+//	  local:
+//	    protocol: file          # or memory
+//	    address: .registry      # directory, or namespace for memory
+//	    group: myGroup
+//	    registry-type: interface
+package localregistry
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common"
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/registry"
+	"dubbo.apache.org/dubbo-go/v3/remoting"
+	"github.com/dubbogo/gost/log/logger"
+	perrors "github.com/pkg/errors"
+)
+
+const (
+	FileKey   = "file"
+	MemoryKey = "memory"
+
+	// PollIntervalKey is the registry param for how often the file registry
+	// rescans its directory.
+	PollIntervalKey = "poll-interval"
+	// HeartbeatKey is the registry param for how often a provider refreshes
+	// its file; files not refreshed for three heartbeats are dropped.
+	HeartbeatKey = "heartbeat"
+
+	defaultGroup        = "DEFAULT_GROUP"
+	defaultPollInterval = time.Second
+	defaultHeartbeat    = 5 * time.Second
+)
+
+func init() {
+	extension.SetRegistry(FileKey, newFileRegistry)
+	extension.SetRegistry(MemoryKey, newMemoryRegistry)
+}
+
+type localRegistry struct {
+	*common.URL
+	store        store
+	pollInterval time.Duration
+	heartbeat    time.Duration
+
+	mu         sync.Mutex
+	registered map[string]*common.URL // by service+key
+	listeners  map[string]chan struct{}
+	done       chan struct{}
+	destroyed  bool
+}
+
+func newFileRegistry(url *common.URL) (registry.Registry, error) {
+	dir := url.Location
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "dubbo-demo-registry")
+	}
+	heartbeat := url.GetParamDuration(HeartbeatKey, defaultHeartbeat.String())
+	r := newLocalRegistry(url, &fileStore{dir: dir, ttl: 3 * heartbeat})
+	r.pollInterval = url.GetParamDuration(PollIntervalKey, defaultPollInterval.String())
+	r.heartbeat = heartbeat
+	logger.Infof("[File Registry] New file registry in %s with url = %+v", dir, url.ToMap())
+	go r.keepAlive()
+	return r, nil
+}
+
+func newMemoryRegistry(url *common.URL) (registry.Registry, error) {
+	logger.Infof("[Memory Registry] New memory registry %q with url = %+v", url.Location, url.ToMap())
+	return newLocalRegistry(url, memStoreFor(url.Location)), nil
+}
+
+func newLocalRegistry(url *common.URL, s store) *localRegistry {
+	return &localRegistry{
+		URL:          url,
+		store:        s,
+		pollInterval: defaultPollInterval,
+		registered:   map[string]*common.URL{},
+		listeners:    map[string]chan struct{}{},
+		done:         make(chan struct{}),
+	}
+}
+
+func getCategory(url *common.URL) string {
+	role, _ := strconv.Atoi(url.GetParam(constant.RegistryRoleKey, strconv.Itoa(constant.NacosDefaultRoleType)))
+	return common.DubboNodes[role]
+}
+
+// serviceName mirrors the nacos registry: category:interface:version:group
+func serviceName(category string, url *common.URL) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(category)
+	for _, key := range []string{constant.InterfaceKey, constant.VersionKey, constant.GroupKey} {
+		buffer.WriteString(constant.NacosServiceNameSeparator)
+		buffer.WriteString(strings.TrimSpace(url.GetParam(key, "")))
+	}
+	return buffer.String()
+}
+
+func (r *localRegistry) qualify(service string) string {
+	return r.URL.GetParam(constant.RegistryGroupKey, defaultGroup) + "@@" + service
+}
+
+func instanceKey(url *common.URL) string {
+	common.HandleRegisterIPAndPort(url)
+	return net.JoinHostPort(url.Ip, url.Port)
+}
+
+// Register stores @url under its category so subscribers of the service see it.
+func (r *localRegistry) Register(url *common.URL) error {
+	url = url.Clone()
+	url.SetParam(constant.MethodsKey, strings.Join(url.Methods, ","))
+	service := r.qualify(serviceName(getCategory(url), url))
+	key := instanceKey(url)
+	logger.Infof("[Local Registry] Register %s %s", service, key)
+	if err := r.store.put(service, key, url.String()); err != nil {
+		return perrors.WithMessagef(err, "register %s to local registry", service)
+	}
+	r.mu.Lock()
+	r.registered[service+"/"+key] = url
+	r.mu.Unlock()
+	return nil
+}
+
+// UnRegister removes @url, the same way an expired nacos instance disappears.
+func (r *localRegistry) UnRegister(url *common.URL) error {
+	service := r.qualify(serviceName(getCategory(url), url))
+	key := instanceKey(url)
+	logger.Infof("[Local Registry] UnRegister %s %s", service, key)
+	r.mu.Lock()
+	delete(r.registered, service+"/"+key)
+	r.mu.Unlock()
+	return r.store.remove(service, key)
+}
+
+// Subscribe blocks, notifying add/update/del events for the providers of @url
+// until UnSubscribe or Destroy. Like nacos, only consumers subscribe.
+func (r *localRegistry) Subscribe(url *common.URL, notifyListener registry.NotifyListener) error {
+	role, _ := strconv.Atoi(url.GetParam(constant.RegistryRoleKey, ""))
+	if role != common.CONSUMER {
+		return nil
+	}
+	service := r.qualify(serviceName(common.DubboNodes[common.PROVIDER], url))
+
+	stop := make(chan struct{})
+	r.mu.Lock()
+	if r.destroyed {
+		r.mu.Unlock()
+		return perrors.New("local registry is destroyed")
+	}
+	if old, ok := r.listeners[url.Key()]; ok {
+		close(old)
+	}
+	r.listeners[url.Key()] = stop
+	r.mu.Unlock()
+
+	known := map[string]string{}
+	for {
+		changed := r.store.changed()
+		current, err := r.store.list(service)
+		if err != nil {
+			logger.Warnf("[Local Registry] list %s = error{%v}", service, err)
+		} else {
+			notifyDiff(notifyListener, known, current)
+			known = current
+		}
+
+		var poll <-chan time.Time
+		if changed == nil {
+			poll = time.After(r.pollInterval)
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-r.done:
+			return nil
+		case <-changed:
+		case <-poll:
+		}
+	}
+}
+
+func notifyDiff(listener registry.NotifyListener, known, current map[string]string) {
+	for key, raw := range current {
+		old, ok := known[key]
+		switch {
+		case !ok:
+			notify(listener, remoting.EventTypeAdd, raw)
+		case old != raw:
+			notify(listener, remoting.EventTypeUpdate, raw)
+		}
+	}
+	for key, raw := range known {
+		if _, ok := current[key]; !ok {
+			notify(listener, remoting.EventTypeDel, raw)
+		}
+	}
+}
+
+func notify(listener registry.NotifyListener, action remoting.EventType, raw string) {
+	url, err := common.NewURL(raw)
+	if err != nil {
+		logger.Errorf("[Local Registry] bad url %q: %v", raw, err)
+		return
+	}
+	event := &registry.ServiceEvent{Action: action, Service: url}
+	logger.Infof("[Local Registry] Update begin, service event: %v", event.String())
+	listener.Notify(event)
+}
+
+// UnSubscribe stops the Subscribe loop of @url.
+func (r *localRegistry) UnSubscribe(url *common.URL, _ registry.NotifyListener) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stop, ok := r.listeners[url.Key()]; ok {
+		close(stop)
+		delete(r.listeners, url.Key())
+	}
+	return nil
+}
+
+// LoadSubscribeInstances synchronously notifies the providers known right now.
+func (r *localRegistry) LoadSubscribeInstances(url *common.URL, notify registry.NotifyListener) error {
+	service := r.qualify(serviceName(common.DubboNodes[common.PROVIDER], url))
+	current, err := r.store.list(service)
+	if err != nil {
+		return perrors.WithMessagef(err, "could not query the instances for %s", service)
+	}
+	notifyDiff(notify, nil, current)
+	return nil
+}
+
+// keepAlive refreshes the file of every registered url until Destroy.
+func (r *localRegistry) keepAlive() {
+	fs, ok := r.store.(*fileStore)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		for id, url := range r.registered {
+			service, key, _ := strings.Cut(id, "/")
+			if err := fs.touch(service, key); err != nil {
+				// the file was removed underneath us, put it back
+				if err := fs.put(service, key, url.String()); err != nil {
+					logger.Warnf("[File Registry] heartbeat %s = error{%v}", id, err)
+				}
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// GetURL gets its registration URL
+func (r *localRegistry) GetURL() *common.URL {
+	return r.URL
+}
+
+// IsAvailable is always true; there is no remote side to lose.
+func (r *localRegistry) IsAvailable() bool {
+	return true
+}
+
+// Destroy unregisters everything this registry registered and stops its
+// subscriptions.
+func (r *localRegistry) Destroy() {
+	r.mu.Lock()
+	if r.destroyed {
+		r.mu.Unlock()
+		return
+	}
+	r.destroyed = true
+	close(r.done)
+	urls := make([]*common.URL, 0, len(r.registered))
+	for _, url := range r.registered {
+		urls = append(urls, url)
+	}
+	r.mu.Unlock()
+
+	for _, url := range urls {
+		logger.Infof("DeRegister Local URL:%+v", url)
+		if err := r.UnRegister(url); err != nil {
+			logger.Errorf("Deregister URL:%+v err:%v", url, err.Error())
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package localregistry
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// store keeps the raw provider/consumer URLs of each service, keyed by
+// "ip:port". It is the only part that differs between the file and the
+// in-process registry.
+type store interface {
+	put(service, key, url string) error
+	remove(service, key string) error
+	list(service string) (map[string]string, error)
+	// changed returns a channel that is closed on the next change to any
+	// service, or nil if the store can only be polled.
+	changed() <-chan struct{}
+}
+
+// memStore is shared by every registry in the process that uses the same
+// namespace, which is what lets a provider and a consumer in one test binary
+// find each other.
+type memStore struct {
+	mu       sync.Mutex
+	services map[string]map[string]string
+	notify   chan struct{}
+}
+
+var (
+	memStoresMu sync.Mutex
+	memStores   = map[string]*memStore{}
+)
+
+func memStoreFor(namespace string) *memStore {
+	memStoresMu.Lock()
+	defer memStoresMu.Unlock()
+	s, ok := memStores[namespace]
+	if !ok {
+		s = &memStore{services: map[string]map[string]string{}, notify: make(chan struct{})}
+		memStores[namespace] = s
+	}
+	return s
+}
+
+func (s *memStore) put(service, key, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.services[service] == nil {
+		s.services[service] = map[string]string{}
+	}
+	s.services[service][key] = url
+	s.broadcast()
+	return nil
+}
+
+func (s *memStore) remove(service, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.services[service], key)
+	s.broadcast()
+	return nil
+}
+
+func (s *memStore) list(service string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string, len(s.services[service]))
+	for k, v := range s.services[service] {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *memStore) changed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notify
+}
+
+func (s *memStore) broadcast() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// fileStore lays services out as <dir>/<service>/<ip_port> files holding one
+// URL each. A provider refreshes the mtime of its files as a heartbeat, and
+// files older than ttl are treated like an expired ephemeral instance.
+type fileStore struct {
+	dir string
+	ttl time.Duration
+}
+
+func (s *fileStore) path(service, key string) string {
+	return filepath.Join(s.dir, escape(service), escape(key))
+}
+
+func (s *fileStore) put(service, key, url string) error {
+	p := s.path(service, key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// write then rename so that a concurrent list never sees half a URL
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte(url), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *fileStore) touch(service, key string) error {
+	now := time.Now()
+	return os.Chtimes(s.path(service, key), now, now)
+}
+
+func (s *fileStore) remove(service, key string) error {
+	err := os.Remove(s.path(service, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStore) list(service string) (map[string]string, error) {
+	out := map[string]string{}
+	entries, err := os.ReadDir(filepath.Join(s.dir, escape(service)))
+	if os.IsNotExist(err) {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if s.ttl > 0 && time.Since(info.ModTime()) > s.ttl {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, escape(service), e.Name()))
+		if err != nil {
+			if _, ok := err.(*fs.PathError); ok {
+				continue
+			}
+			return nil, err
+		}
+		out[unescape(e.Name())] = string(data)
+	}
+	return out, nil
+}
+
+func (s *fileStore) changed() <-chan struct{} { return nil }
+
+// service names and keys contain ':' which is not portable in file names
+func escape(s string) string   { return strings.ReplaceAll(s, ":", "_") }
+func unescape(s string) string { return strings.ReplaceAll(s, "_", ":") }
@@ -0,0 +1,240 @@
+// Package metrics exports the demo's Prometheus metrics: dubbo-go's own,
+// which the metrics filter feeds to the vendored metrics/prometheus reporter,
+// and the app-specific ones below, all on one /metrics endpoint.
+package metrics
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	_ "unsafe" // go:linkname
+
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	dubbometrics "dubbo.apache.org/dubbo-go/v3/metrics"
+	_ "dubbo.apache.org/dubbo-go/v3/metrics/prometheus" // registers the reporter replaced below
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// reporterName is the name dubbo-go's metrics config and filter look the
+// reporter up by.
+const reporterName = "prometheus"
+
+// newPrometheusReporter builds the vendored reporter. It is a singleton that
+// keeps the config of its first call, which is metrics.enable from the
+// config, but it starts another listener on every call in pull mode. The
+// metrics filter calls it with the defaults, so a process with the filter
+// would bind :9090 even with metrics disabled.
+//
+//go:linkname newPrometheusReporter dubbo.apache.org/dubbo-go/v3/metrics/prometheus.newPrometheusReporter
+func newPrometheusReporter(cfg *dubbometrics.ReporterConfig) dubbometrics.Reporter
+
+func init() {
+	// push mode has no listener (dubbo-go has no pushgateway support yet);
+	// Serve and Handler serve the metrics instead
+	extension.SetMetricReporter(reporterName, func(cfg *dubbometrics.ReporterConfig) dubbometrics.Reporter {
+		c := *cfg
+		c.Mode = dubbometrics.ReportModePush
+		return newPrometheusReporter(&c)
+	})
+}
+
+// costs are the upper bounds of the cost label: a call is counted under the
+// first one at or above the cost it asked for.
+var costs = []time.Duration{
+	0, 10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 15, 30, 60, 120}
+
+var (
+	consumerLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "latency_seconds",
+		Help:      "SayHello latency seen by the consumer, by requested cost and outcome.",
+		Buckets:   latencyBuckets,
+	}, []string{"cost", "outcome"})
+	consumerOverhead = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "overhead_seconds",
+		Help:      "Latency of successful SayHello calls beyond the cost they asked for, by requested cost.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+	}, []string{"cost"})
+	consumerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "errors_total",
+		Help:      "Failed SayHello calls by error class.",
+	}, []string{"class"})
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "breaker_state",
+		Help:      "1 for the state the method's circuit breaker is in, 0 for the others.",
+	}, []string{"method", "state"})
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "breaker_transitions_total",
+		Help:      "Circuit breaker state changes by method and the states left and entered.",
+	}, []string{"method", "from", "to"})
+	providerCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "provider_calls_total",
+		Help:      "SayHello calls by the provider address they went to and outcome.",
+	}, []string{"provider", "outcome"})
+	providerRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "provider_remaining",
+		Help:      "Remaining capacity the provider's adaptivesvc limiter reported with its last response.",
+	}, []string{"provider"})
+	providerInflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "provider_inflight",
+		Help:      "Calls in flight the provider's adaptivesvc limiter reported with its last response.",
+	}, []string{"provider"})
+	hedges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "hedges_total",
+		Help:      "Extra attempts the hedged cluster sent, by method.",
+	}, []string{"method"})
+	hedgeWins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "hedge_wins_total",
+		Help:      "Hedged cluster calls by method and the attempt that succeeded first, 0 when none did.",
+	}, []string{"method", "attempt"})
+	hedgeDelay = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "demo",
+		Subsystem: "consumer",
+		Name:      "hedge_delay_seconds",
+		Help:      "How long the hedged cluster last let an attempt go unanswered before sending the next, by method.",
+	}, []string{"method"})
+	responseBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "demo",
+		Subsystem: "provider",
+		Name:      "response_bytes",
+		Help:      "Size of the SayHello response body.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 10), // 64B to 16MiB
+	})
+)
+
+// costLabel names the cost bucket of cost.
+func costLabel(cost time.Duration) string {
+	for _, c := range costs {
+		if cost <= c {
+			return c.String()
+		}
+	}
+	return "+Inf"
+}
+
+// ObserveCall records one consumer call that asked for cost and took
+// latency. class is the failure class of a failed call, empty for success.
+func ObserveCall(cost, latency time.Duration, class string) {
+	label := costLabel(cost)
+	if class != "" {
+		consumerLatency.WithLabelValues(label, "error").Observe(latency.Seconds())
+		consumerErrors.WithLabelValues(class).Inc()
+		return
+	}
+	consumerLatency.WithLabelValues(label, "ok").Observe(latency.Seconds())
+	consumerOverhead.WithLabelValues(label).Observe((latency - cost).Seconds())
+}
+
+// breakerStates are the states of a circuit breaker.
+var breakerStates = []string{"closed", "open", "half-open"}
+
+// BreakerState sets the state of method's circuit breaker.
+func BreakerState(method, state string) {
+	for _, s := range breakerStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		breakerState.WithLabelValues(method, s).Set(v)
+	}
+}
+
+// BreakerTransition records method's circuit breaker going from one state to
+// another.
+func BreakerTransition(method, from, to string) {
+	breakerTransitions.WithLabelValues(method, from, to).Inc()
+	BreakerState(method, to)
+}
+
+// ProviderCall records one call that went to provider and ended with
+// outcome: ok, error, or rejected by the provider's limiter.
+func ProviderCall(provider, outcome string) {
+	providerCalls.WithLabelValues(provider, outcome).Inc()
+}
+
+// ProviderCapacity sets what provider's adaptivesvc limiter last reported.
+func ProviderCapacity(provider string, remaining, inflight uint64) {
+	providerRemaining.WithLabelValues(provider).Set(float64(remaining))
+	providerInflight.WithLabelValues(provider).Set(float64(inflight))
+}
+
+// ObserveHedge records one call of method through the hedged cluster: the
+// delay it hedged after, 0 when not yet known, how many attempts it sent and
+// which one succeeded, 0 for none.
+func ObserveHedge(method string, delay time.Duration, sent, wonBy int) {
+	if sent > 1 {
+		hedges.WithLabelValues(method).Add(float64(sent - 1))
+	}
+	hedgeWins.WithLabelValues(method, strconv.Itoa(wonBy)).Inc()
+	hedgeDelay.WithLabelValues(method).Set(delay.Seconds())
+}
+
+// ObserveResponse records the size of one provider response body.
+func ObserveResponse(n int) {
+	responseBytes.Observe(float64(n))
+}
+
+// InFlight exports the provider's in-flight call count, read from count on
+// every scrape.
+func InFlight(count func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "demo",
+		Subsystem: "provider",
+		Name:      "in_flight",
+		Help:      "SayHello calls the provider is working on.",
+	}, func() float64 { return float64(count()) })
+}
+
+// Queued exports how many SayHello calls wait for one of the provider's
+// -capacity slots, read from count on every scrape.
+func Queued(count func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "demo",
+		Subsystem: "provider",
+		Name:      "queued",
+		Help:      "SayHello calls waiting for a slot of the provider's -capacity.",
+	}, func() float64 { return float64(count()) })
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve serves Handler on addr at /metrics in the background.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	log.Printf("metrics listening on %s\n", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics listener stopped: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,144 @@
+// Package record persists SayHello invocations as JSON lines so that a run
+// can be replayed later with the same requests and pacing.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+// Entry is one recorded invocation.
+type Entry struct {
+	Time        time.Time              `json:"time"`
+	Request     map[string]interface{} `json:"request"`
+	Attachments map[string]interface{} `json:"attachments,omitempty"`
+	Provider    string                 `json:"provider,omitempty"` // address of the provider called, if known
+	Attempt     int                    `json:"attempt,omitempty"`  // which attempt of a hedged call answered
+	Outcome     string                 `json:"outcome"`
+	Class       string                 `json:"class,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	LatencyMs   float64                `json:"latency_ms"`
+}
+
+// NewEntry builds the entry for a call that started at st and ended now.
+func NewEntry(st time.Time, req map[string]interface{}, attachments map[string]interface{}, err error) Entry {
+	e := Entry{
+		Time:        st,
+		Request:     req,
+		Attachments: attachments,
+		Outcome:     OutcomeOK,
+		LatencyMs:   float64(time.Since(st).Microseconds()) / 1e3,
+	}
+	if err != nil {
+		e.Outcome = OutcomeError
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Writer appends entries to a file; it is safe for concurrent use.
+type Writer struct {
+	mu  sync.Mutex
+	f   *os.File
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+// Create opens path for appending, creating it if needed.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	return &Writer{f: f, buf: buf, enc: json.NewEncoder(buf)}, nil
+}
+
+// Write appends e as a single line and flushes it, so a crashed run still
+// leaves every completed call on disk.
+func (w *Writer) Write(e Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(e); err != nil {
+		return err
+	}
+	return w.buf.Flush()
+}
+
+// Close flushes and closes the underlying file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buf.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// ReadFile loads every entry of a recording, ordered as written.
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read decodes entries from r. JSON numbers come back as int64 when they are
+// integral and float64 otherwise, matching what the client originally sent.
+func Read(r io.Reader) ([]Entry, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	var entries []Entry
+	for line := 1; ; line++ {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, fmt.Errorf("record %d: %w", line, err)
+		}
+		e.Request = normalizeMap(e.Request)
+		e.Attachments = normalizeMap(e.Attachments)
+		entries = append(entries, e)
+	}
+}
+
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		m[k] = normalize(v)
+	}
+	return m
+}
+
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		return normalizeMap(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,175 @@
+// Package reqlog ties the log lines of one call together across the consumer
+// and the provider. The consumer filter gives every call a request ID and
+// sends it as an attachment; the provider filter puts it, with the session
+// and remote address, into a zap logger carried in the call's context. Both
+// log one JSON line per call, so a consumer timeout and the provider's
+// completion of the same call share a request_id to grep for.
+package reqlog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/config"
+	"dubbo.apache.org/dubbo-go/v3/filter"
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"dubbo-demo/internal/failure"
+	"dubbo-demo/internal/sessions"
+)
+
+const (
+	// ConsumerFilterKey names the filter that sends the request ID and logs
+	// the call, for consumer.filter or a reference's filter.
+	ConsumerFilterKey = "reqlog-consumer"
+	// ProviderFilterKey names the filter that picks it up and logs the call
+	// as served, for provider.filter or a service's filter.
+	ProviderFilterKey = "reqlog-provider"
+
+	// IDKey is the attachment holding the request ID.
+	IDKey = "demo-request-id"
+)
+
+func init() {
+	extension.SetFilter(ConsumerFilterKey, func() filter.Filter { return consumerFilter{} })
+	extension.SetFilter(ProviderFilterKey, func() filter.Filter { return providerFilter{} })
+}
+
+var (
+	baseOnce sync.Once
+	base     *zap.Logger
+)
+
+// Logger returns the logger request lines go to: JSON on stdout, where
+// dubbo-go's console logger writes, at the level of dubbo.logger.level. The
+// level is read on first use, so call it after the config is loaded.
+func Logger() *zap.Logger {
+	baseOnce.Do(func() {
+		level := zapcore.InfoLevel
+		if lc := config.GetRootConfig().Logger; lc != nil && lc.Level != "" {
+			if l, err := zapcore.ParseLevel(lc.Level); err == nil {
+				level = l
+			}
+		}
+		// dubbo-go's JSON keys, with milliseconds to order the lines of a call
+		enc := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+			MessageKey:     "msg",
+			LevelKey:       "level",
+			TimeKey:        "time",
+			CallerKey:      "line",
+			StacktraceKey:  "stacktrace",
+			EncodeLevel:    zapcore.CapitalLevelEncoder,
+			EncodeTime:     zapcore.TimeEncoderOfLayout("2006-01-02 15:04:05.000"),
+			EncodeDuration: zapcore.MillisDurationEncoder,
+			EncodeCaller:   zapcore.ShortCallerEncoder,
+		})
+		base = zap.New(zapcore.NewCore(enc, zapcore.Lock(os.Stdout), level), zap.AddCaller())
+	})
+	return base
+}
+
+type ctxKey struct{}
+
+// NewContext returns ctx carrying lg.
+func NewContext(ctx context.Context, lg *zap.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, lg)
+}
+
+// From returns the logger in ctx, or Logger without request fields.
+func From(ctx context.Context) *zap.Logger {
+	if lg, ok := ctx.Value(ctxKey{}).(*zap.Logger); ok {
+		return lg
+	}
+	return Logger()
+}
+
+// NewID returns a new request ID.
+func NewID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// fields are the ones every line of a call carries.
+func fields(ctx context.Context, id string, inv protocol.Invocation) []zap.Field {
+	f := []zap.Field{zap.String("request_id", id), zap.String("method", inv.MethodName())}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		f = append(f, zap.String("trace_id", sc.TraceID().String()))
+	}
+	return f
+}
+
+// outcome describes how a call ended.
+func outcome(err error) []zap.Field {
+	if err == nil {
+		return []zap.Field{zap.String("outcome", "ok")}
+	}
+	return []zap.Field{zap.String("outcome", "error"), zap.String("error", failure.Summary(err))}
+}
+
+type consumerFilter struct{}
+
+// Invoke sends the call's request ID, made up unless the caller put one in
+// the attachments of its context, and logs a "call" line with the provider
+// address once it returns.
+func (consumerFilter) Invoke(ctx context.Context, invoker protocol.Invoker, inv protocol.Invocation) protocol.Result {
+	id, _ := inv.Attachments()[IDKey].(string)
+	if id == "" {
+		id = NewID()
+		inv.SetAttachment(IDKey, id)
+	}
+	start := time.Now()
+	result := invoker.Invoke(ctx, inv)
+	lg := Logger().With(fields(ctx, id, inv)...).With(
+		zap.String("side", "consumer"),
+		zap.String("remote", invoker.GetURL().Location),
+		zap.Int64("cost_ms", time.Since(start).Milliseconds()),
+	)
+	if class, failed := failure.ClassifyResult(result); failed {
+		lg.Warn("call", append(outcome(result.Error()), zap.String("class", class.String()))...)
+	} else {
+		lg.Info("call", outcome(nil)...)
+	}
+	return result
+}
+
+func (consumerFilter) OnResponse(_ context.Context, result protocol.Result, _ protocol.Invoker, _ protocol.Invocation) protocol.Result {
+	return result
+}
+
+type providerFilter struct{}
+
+// Invoke hands the call a logger with its request ID, remote address and
+// getty session, and logs a "served" line once it returns.
+func (providerFilter) Invoke(ctx context.Context, invoker protocol.Invoker, inv protocol.Invocation) protocol.Result {
+	id, _ := inv.Attachments()[IDKey].(string)
+	remote, _ := inv.Attachments()[constant.RemoteAddr].(string)
+	lf := append(fields(ctx, id, inv), zap.String("side", "provider"), zap.String("remote", remote))
+	if s := sessions.ServerByRemote(remote); s != nil {
+		lf = append(lf, zap.Uint32("session", s.ID()))
+	}
+	lg := Logger().With(lf...)
+
+	start := time.Now()
+	result := invoker.Invoke(NewContext(ctx, lg), inv)
+	lg = lg.With(zap.Int64("cost_ms", time.Since(start).Milliseconds()))
+	if err := result.Error(); err != nil {
+		lg.Warn("served", outcome(err)...)
+	} else {
+		lg.Info("served", outcome(nil)...)
+	}
+	return result
+}
+
+func (providerFilter) OnResponse(_ context.Context, result protocol.Result, _ protocol.Invoker, _ protocol.Invocation) protocol.Result {
+	return result
+}
@@ -0,0 +1,163 @@
+package sessions
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+	_ "unsafe" // go:linkname
+
+	"dubbo.apache.org/dubbo-go/v3/remoting"
+	gettyremoting "dubbo.apache.org/dubbo-go/v3/remoting/getty"
+	getty "github.com/apache/dubbo-getty"
+)
+
+// exchangeClientMap holds the consumer's *remoting.ExchangeClient for every
+// provider address it has referred to.
+//
+//go:linkname exchangeClientMap dubbo.apache.org/dubbo-go/v3/protocol/dubbo.exchangeClientMap
+var exchangeClientMap *sync.Map
+
+// pendingResponses holds a *remoting.PendingResponse for every request still
+// waiting for its response, heartbeats included. dubbo-go does not remove
+// the entry when a call times out, only when the response finally arrives.
+//
+//go:linkname pendingResponses dubbo.apache.org/dubbo-go/v3/remoting.pendingResponses
+var pendingResponses *sync.Map
+
+// ClientStat is a snapshot of the consumer side of one provider address.
+type ClientStat struct {
+	Address string `json:"address"`
+	// References is ExchangeClient.GetActiveNumber: the references sharing
+	// the client, not the calls in flight on it.
+	References uint32 `json:"references"`
+	Sessions   []Stat `json:"sessions"` // Requests counts responses received
+}
+
+// ClientStats returns a ClientStat for every provider address the consumer
+// has a client for, sorted by address. A client whose connection was lost
+// has no sessions until the next call connects it again.
+func ClientStats() []ClientStat {
+	var out []ClientStat
+	exchangeClientMap.Range(func(k, v interface{}) bool {
+		ec, ok := v.(*remoting.ExchangeClient)
+		if !ok {
+			return true
+		}
+		cs := ClientStat{Address: fmt.Sprint(k), References: ec.GetActiveNumber()}
+		eachClientSession(ec, func(s getty.Session, requests int32) {
+			st := StatOf(s)
+			st.Requests = requests
+			cs.Sessions = append(cs.Sessions, st)
+		})
+		out = append(out, cs)
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// eachClientSession calls fn for every getty session of ec, with the number
+// of responses dubbo-go has read on it.
+func eachClientSession(ec *remoting.ExchangeClient, fn func(s getty.Session, requests int32)) {
+	client, ok := field(reflect.ValueOf(ec).Elem(), "client").Interface().(*gettyremoting.Client)
+	if !ok || client == nil {
+		return
+	}
+	cv := reflect.ValueOf(client).Elem()
+	mux := field(cv, "gettyClientMux").Addr().Interface().(*sync.RWMutex)
+	mux.RLock()
+	conn := reflect.ValueOf(field(cv, "gettyClient").Interface())
+	mux.RUnlock()
+	if conn.IsNil() {
+		return
+	}
+	connv := conn.Elem()
+	lock := field(connv, "lock").Addr().Interface().(*sync.RWMutex)
+	lock.RLock()
+	defer lock.RUnlock()
+	list := field(connv, "sessions")
+	for i := 0; i < list.Len(); i++ {
+		rs := list.Index(i).Elem()
+		s, ok := field(rs, "session").Interface().(getty.Session)
+		if !ok || s == nil {
+			continue
+		}
+		fn(s, loadInt32(rs, "reqNum"))
+	}
+}
+
+// Client returns the sessions of every consumer client in the process.
+func Client() []getty.Session {
+	var out []getty.Session
+	exchangeClientMap.Range(func(_, v interface{}) bool {
+		if ec, ok := v.(*remoting.ExchangeClient); ok {
+			eachClientSession(ec, func(s getty.Session, _ int32) { out = append(out, s) })
+		}
+		return true
+	})
+	return out
+}
+
+// ClientByID returns the consumer session whose getty ID is id, as in
+// Stat.ID.
+func ClientByID(id uint32) getty.Session {
+	for _, s := range Client() {
+		if s.ID() == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// PendingStat summarises the requests waiting for a response.
+type PendingStat struct {
+	Count  int           `json:"count"`
+	Oldest time.Duration `json:"oldest"` // how long the oldest has waited
+}
+
+// Pending reports the requests waiting for a response across every client
+// in the process. Entries older than the request timeout belong to calls
+// that already failed and whose response never came.
+func Pending() PendingStat {
+	var ps PendingStat
+	now := time.Now()
+	pendingResponses.Range(func(_, v interface{}) bool {
+		pr, ok := v.(*remoting.PendingResponse)
+		if !ok {
+			return true
+		}
+		ps.Count++
+		if start := field(reflect.ValueOf(pr).Elem(), "start").Interface().(time.Time); now.Sub(start) > ps.Oldest {
+			ps.Oldest = now.Sub(start)
+		}
+		return true
+	})
+	return ps
+}
+
+// Ping sends a heartbeat on a consumer session, the same one getty's cron
+// sends every heartbeat-period, and returns how long the reply took.
+func Ping(s getty.Session, timeout time.Duration) (time.Duration, error) {
+	req := remoting.NewRequest("2.0.2")
+	req.TwoWay = true
+	req.Event = true
+	resp := remoting.NewPendingResponse(req.ID)
+	remoting.AddPendingResponse(resp)
+	// unlike a timed out call, leave no entry behind
+	defer pendingResponses.Delete(remoting.SequenceType(req.ID))
+
+	start := time.Now()
+	// -1 keeps the session's tcp-write-timeout: any other value replaces it
+	// on the connection for every later write
+	if _, _, err := s.WritePkg(req, -1); err != nil {
+		return 0, err
+	}
+	select {
+	case <-resp.Done:
+		return time.Since(start), resp.Err
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("no heartbeat response within %v", timeout)
+	}
+}
@@ -0,0 +1,144 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/constant"
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/filter"
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+	"dubbo.apache.org/dubbo-go/v3/protocol/invocation"
+	"dubbo.apache.org/dubbo-go/v3/remoting"
+	getty "github.com/apache/dubbo-getty"
+
+	"dubbo-demo/internal/chaos"
+)
+
+// ProviderFilterKey names the filter that tells GateReads which goroutine
+// reads each accepted session. Without it in provider.filter, GateReads
+// finds no session.
+const ProviderFilterKey = "sessions-provider"
+
+// readerKey is the invocation attribute holding the ID of the goroutine that
+// decoded the request.
+const readerKey = "sessions.reader"
+
+// ErrUnread is returned by GateReads for a session no request has been read
+// from yet.
+var ErrUnread = errors.New("no request read from the session yet")
+
+func init() {
+	remoting.RegistryCodec("dubbo", &codec{next: remoting.GetCodec("dubbo")})
+	extension.SetFilter(ProviderFilterKey, func() filter.Filter { return providerFilter{} })
+}
+
+// reads maps accepted sessions to the goroutines getty reads them on, and
+// those to the Direction gating them.
+var reads = struct {
+	sync.Mutex
+	readers map[string]int64           // by remote address
+	gates   map[int64]*chaos.Direction // by reading goroutine
+}{readers: map[string]int64{}, gates: map[int64]*chaos.Direction{}}
+
+// GateReads has d decide when getty may go on reading s: while d is paused
+// the read loop of s holds the next request it decodes, and with a rate set
+// it waits after each request for the bandwidth the request took. Either
+// way it takes no more bytes off the socket, so the consumer's send buffer
+// fills up. Nothing of getty's is changed: the wait happens in the dubbo
+// codec, which getty calls on the read goroutine of the session.
+func GateReads(s getty.Session, d *chaos.Direction) error {
+	open := map[string]bool{}
+	for _, s := range Server() {
+		open[s.RemoteAddr()] = true
+	}
+	reads.Lock()
+	defer reads.Unlock()
+	for remote, g := range reads.readers {
+		if !open[remote] {
+			delete(reads.readers, remote)
+			delete(reads.gates, g)
+		}
+	}
+	g, ok := reads.readers[s.RemoteAddr()]
+	if !ok {
+		return ErrUnread
+	}
+	reads.gates[g] = d
+	return nil
+}
+
+// codec passes everything on to the dubbo codec. After decoding a request
+// it labels the invocation with the goroutine it was read on, then holds
+// that goroutine as long as its gate says.
+type codec struct {
+	next remoting.Codec
+}
+
+func (c *codec) EncodeRequest(req *remoting.Request) (*bytes.Buffer, error) {
+	return c.next.EncodeRequest(req)
+}
+
+func (c *codec) EncodeResponse(resp *remoting.Response) (*bytes.Buffer, error) {
+	return c.next.EncodeResponse(resp)
+}
+
+func (c *codec) Decode(data []byte) (*remoting.DecodeResult, int, error) {
+	res, n, err := c.next.Decode(data)
+	if err != nil || res == nil || !res.IsRequest {
+		return res, n, err
+	}
+	req, ok := res.Result.(*remoting.Request)
+	if !ok {
+		return res, n, err
+	}
+	g := goid()
+	if inv, ok := req.Data.(*invocation.RPCInvocation); ok {
+		inv.SetAttribute(readerKey, g)
+	}
+	reads.Lock()
+	d := reads.gates[g]
+	reads.Unlock()
+	if d != nil {
+		d.Wait(nil)
+		time.Sleep(d.Pace(n))
+	}
+	return res, n, err
+}
+
+type providerFilter struct{}
+
+// Invoke notes which goroutine reads the session the call came in on.
+func (providerFilter) Invoke(ctx context.Context, invoker protocol.Invoker, inv protocol.Invocation) protocol.Result {
+	g, _ := inv.GetAttribute(readerKey)
+	remote, _ := inv.GetAttachment(constant.RemoteAddr)
+	if g, ok := g.(int64); ok && remote != "" {
+		reads.Lock()
+		reads.readers[remote] = g
+		reads.Unlock()
+	}
+	return invoker.Invoke(ctx, inv)
+}
+
+func (providerFilter) OnResponse(_ context.Context, result protocol.Result, _ protocol.Invoker, _ protocol.Invocation) protocol.Result {
+	return result
+}
+
+// goid returns the ID of the calling goroutine, from the header of its stack
+// trace. Go leaves it out of the API on purpose; it is only used to tell
+// getty's read goroutines apart, as the codec is told nothing else about
+// the session it decodes.
+func goid() int64 {
+	var buf [32]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	g, _ := strconv.ParseInt(string(b), 10, 64)
+	return g
+}
@@ -0,0 +1,145 @@
+// Package sessions reaches into dubbo-go's dubbo protocol to find the getty
+// sessions behind it, on the provider and on the consumer side. dubbo-go
+// keeps them in unexported fields and package variables, so this goes
+// through reflection and go:linkname and is tied to the vendored dubbo-go
+// v3.1 layout.
+package sessions
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"dubbo.apache.org/dubbo-go/v3/protocol/dubbo"
+	gettyremoting "dubbo.apache.org/dubbo-go/v3/remoting/getty"
+	getty "github.com/apache/dubbo-getty"
+)
+
+// field returns the named field of struct value v, readable and writable
+// even when it is unexported.
+func field(v reflect.Value, name string) reflect.Value {
+	f := v.FieldByName(name)
+	if !f.IsValid() {
+		panic("sessions: dubbo-go has no field " + name + " in " + v.Type().String())
+	}
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+}
+
+// loadInt32 atomically reads the named int32 field of struct value v, for
+// the counters dubbo-go updates with atomic.AddInt32.
+func loadInt32(v reflect.Value, name string) int32 {
+	return atomic.LoadInt32(field(v, name).Addr().Interface().(*int32))
+}
+
+// Stat is a snapshot of one getty session, with the counters getty prints in
+// its "Read Bytes: ..., Write Pkgs: ..." session warnings.
+type Stat struct {
+	ID         uint32    `json:"id"`
+	Local      string    `json:"local"`
+	Remote     string    `json:"remote"`
+	ReadBytes  uint32    `json:"read_bytes"`
+	WriteBytes uint32    `json:"write_bytes"`
+	ReadPkgs   uint32    `json:"read_pkgs"`
+	WritePkgs  uint32    `json:"write_pkgs"`
+	Requests   int32     `json:"requests,omitempty"`
+	Active     time.Time `json:"last_active"`
+	Closed     bool      `json:"closed"`
+}
+
+// StatOf reads the counters of s.
+func StatOf(s getty.Session) Stat {
+	st := Stat{
+		ID:     s.ID(),
+		Local:  s.LocalAddr(),
+		Remote: s.RemoteAddr(),
+		Active: s.GetActive(),
+		Closed: s.IsClosed(),
+	}
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return st
+	}
+	conn := field(v.Elem(), "Connection")
+	if conn.IsNil() || conn.Elem().Kind() != reflect.Ptr {
+		return st
+	}
+	c := conn.Elem().Elem()
+	load := func(name string) uint32 {
+		return uint32(field(c, name).Addr().MethodByName("Load").Call(nil)[0].Uint())
+	}
+	st.ReadBytes = load("readBytes")
+	st.WriteBytes = load("writeBytes")
+	st.ReadPkgs = load("readPkgNum")
+	st.WritePkgs = load("writePkgNum")
+	return st
+}
+
+// eachServer calls fn for every session accepted by a dubbo protocol server
+// in the process, with the number of requests dubbo-go has seen on it.
+func eachServer(fn func(s getty.Session, requests int32)) {
+	proto, ok := dubbo.GetProtocol().(*dubbo.DubboProtocol)
+	if !ok {
+		return
+	}
+	pv := reflect.ValueOf(proto).Elem()
+	lock := field(pv, "serverLock").Addr().Interface().(*sync.Mutex)
+
+	var servers []*gettyremoting.Server
+	lock.Lock()
+	iter := field(pv, "serverMap").MapRange()
+	for iter.Next() {
+		es := iter.Value().Elem()
+		if srv, ok := es.FieldByName("Server").Interface().(*gettyremoting.Server); ok && srv != nil {
+			servers = append(servers, srv)
+		}
+	}
+	lock.Unlock()
+
+	for _, srv := range servers {
+		handler := field(reflect.ValueOf(srv).Elem(), "rpcHandler")
+		if handler.IsNil() {
+			continue
+		}
+		hv := handler.Elem()
+		rwlock := field(hv, "rwlock").Addr().Interface().(*sync.RWMutex)
+		rwlock.RLock()
+		iter := field(hv, "sessionMap").MapRange()
+		for iter.Next() {
+			requests := loadInt32(iter.Value().Elem(), "reqNum")
+			fn(iter.Key().Interface().(getty.Session), requests)
+		}
+		rwlock.RUnlock()
+	}
+}
+
+// Server returns the sessions accepted by every dubbo protocol server in the
+// process.
+func Server() []getty.Session {
+	var out []getty.Session
+	eachServer(func(s getty.Session, _ int32) { out = append(out, s) })
+	return out
+}
+
+// ServerStats returns a Stat for every accepted session.
+func ServerStats() []Stat {
+	var out []Stat
+	eachServer(func(s getty.Session, requests int32) {
+		st := StatOf(s)
+		st.Requests = requests
+		out = append(out, st)
+	})
+	return out
+}
+
+// ServerByRemote returns the accepted session whose peer address is addr, as
+// found in the remote-addr attachment of a provider invocation.
+func ServerByRemote(addr string) getty.Session {
+	for _, s := range Server() {
+		if s.RemoteAddr() == addr {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dubbo.apache.org/dubbo-go/v3/common/extension"
+	"dubbo.apache.org/dubbo-go/v3/filter"
+	"dubbo.apache.org/dubbo-go/v3/protocol"
+	_ "dubbo.apache.org/dubbo-go/v3/protocol/dubbo" // registers the codec wrapped below
+	"dubbo.apache.org/dubbo-go/v3/remoting"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProviderFilterKey names the filter that lets otelServerTrace read the trace
+// context of a dubbo call. It must come before otelServerTrace in
+// provider.filter.
+const ProviderFilterKey = "tracing-provider"
+
+func init() {
+	remoting.RegistryCodec("dubbo", &codec{next: remoting.GetCodec("dubbo")})
+	extension.SetFilter(ProviderFilterKey, func() filter.Filter { return providerFilter{} })
+}
+
+// carrier reads trace context from attachments. The consumer filter writes
+// strings, which is also what the dubbo protocol decodes; triple delivers
+// []string.
+type carrier map[string]interface{}
+
+func (c carrier) Get(key string) string {
+	switch v := c[key].(type) {
+	case string:
+		return v
+	case []string:
+		if len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (c carrier) Set(key, value string) { c[key] = value }
+
+func (c carrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+type providerFilter struct{}
+
+// Invoke wraps the trace attachments in []string, the only shape
+// otelServerTrace reads; over dubbo it would start every provider span in a
+// trace of its own.
+func (providerFilter) Invoke(ctx context.Context, invoker protocol.Invoker, inv protocol.Invocation) protocol.Result {
+	for _, key := range propagator.Fields() {
+		if s, ok := inv.Attachments()[key].(string); ok {
+			inv.SetAttachment(key, []string{s})
+		}
+	}
+	return invoker.Invoke(ctx, inv)
+}
+
+func (providerFilter) OnResponse(_ context.Context, result protocol.Result, _ protocol.Invoker, _ protocol.Invocation) protocol.Result {
+	return result
+}
+
+// contextOf returns the trace context in the attachments of a request's
+// invocation.
+func contextOf(data interface{}) trace.SpanContext {
+	var inv protocol.Invocation
+	switch d := data.(type) {
+	case *protocol.Invocation: // requests being encoded
+		inv = *d
+	case protocol.Invocation: // decoded requests
+		inv = d
+	default:
+		return trace.SpanContext{}
+	}
+	ctx := propagator.Extract(context.Background(), carrier(inv.Attachments()))
+	return trace.SpanContextFromContext(ctx)
+}
+
+// staleAfter is how long a request's trace context is kept for its response.
+// Responses to requests that timed out may never come.
+const staleAfter = 10 * time.Minute
+
+type waiting struct {
+	sc trace.SpanContext
+	at time.Time
+}
+
+// codec times the dubbo codec. Requests are traced under the consumer's call
+// span from their attachments; responses carry no attachments to speak of,
+// so the request's context is kept by request ID until its response passes.
+type codec struct {
+	next remoting.Codec
+
+	sent   sync.Map // consumer: request ID to context, until the response is decoded
+	served sync.Map // provider: request ID to context, until the response is encoded
+	stored atomic.Int64
+}
+
+func (c *codec) EncodeRequest(req *remoting.Request) (*bytes.Buffer, error) {
+	if req.Event || current() == nil {
+		return c.next.EncodeRequest(req)
+	}
+	sc := contextOf(req.Data)
+	start := time.Now()
+	buf, err := c.next.EncodeRequest(req)
+	if sc.IsSampled() {
+		record(sc, "dubbo.encode request", start, req.ID, size(buf), err)
+		c.keep(&c.sent, req.ID, sc)
+	}
+	return buf, err
+}
+
+func (c *codec) EncodeResponse(resp *remoting.Response) (*bytes.Buffer, error) {
+	if resp.IsHeartbeat() || current() == nil {
+		return c.next.EncodeResponse(resp)
+	}
+	start := time.Now()
+	buf, err := c.next.EncodeResponse(resp)
+	if w, ok := c.served.LoadAndDelete(resp.ID); ok {
+		record(w.(waiting).sc, "dubbo.encode response", start, resp.ID, size(buf), err)
+	}
+	return buf, err
+}
+
+func (c *codec) Decode(data []byte) (*remoting.DecodeResult, int, error) {
+	start := time.Now()
+	res, n, err := c.next.Decode(data)
+	if res == nil || current() == nil {
+		return res, n, err
+	}
+	switch r := res.Result.(type) {
+	case *remoting.Request:
+		if r.Event {
+			break
+		}
+		if sc := contextOf(r.Data); sc.IsSampled() {
+			record(sc, "dubbo.decode request", start, r.ID, n, err)
+			c.keep(&c.served, r.ID, sc)
+		}
+	case *remoting.Response:
+		if w, ok := c.sent.LoadAndDelete(r.ID); ok {
+			record(w.(waiting).sc, "dubbo.decode response", start, r.ID, n, err)
+		}
+	}
+	return res, n, err
+}
+
+// keep stores sc for request id, and now and then forgets the ones whose
+// response never passed.
+func (c *codec) keep(m *sync.Map, id int64, sc trace.SpanContext) {
+	m.Store(id, waiting{sc: sc, at: time.Now()})
+	if c.stored.Add(1)%1024 != 0 {
+		return
+	}
+	old := time.Now().Add(-staleAfter)
+	for _, pending := range []*sync.Map{&c.sent, &c.served} {
+		pending.Range(func(k, v interface{}) bool {
+			if v.(waiting).at.Before(old) {
+				pending.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+func size(buf *bytes.Buffer) int {
+	if buf == nil {
+		return 0
+	}
+	return buf.Len()
+}
+
+// record adds a span under parent for codec work on a frame of n bytes that
+// ran from start until now.
+func record(parent trace.SpanContext, name string, start time.Time, id int64, n int, err error) {
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	_, span := otel.Tracer(scopeName).Start(ctx, name, trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.Int64("dubbo.request_id", id),
+		attribute.Int("dubbo.frame_bytes", n),
+	))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
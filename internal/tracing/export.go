@@ -0,0 +1,229 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// flushEvery is how often ended spans are written out.
+const flushEvery = time.Second
+
+// The types below are the OTLP-JSON encoding of a TracesData message, as
+// written by the collector's file exporter: IDs in hex, 64-bit integers and
+// timestamps as strings.
+
+type tracesData struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanJSON `json:"spans"`
+}
+
+type scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type spanJSON struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	TraceState        string      `json:"traceState,omitempty"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []keyValue  `json:"attributes,omitempty"`
+	Events            []eventJSON `json:"events,omitempty"`
+	Status            statusJSON  `json:"status"`
+}
+
+type eventJSON struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []keyValue `json:"attributes,omitempty"`
+}
+
+// statusJSON codes are OTLP's: 0 unset, 1 ok, 2 error.
+type statusJSON struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func keyValues(attrs []attribute.KeyValue) []keyValue {
+	out := make([]keyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v anyValue
+		switch a.Value.Type() {
+		case attribute.BOOL:
+			b := a.Value.AsBool()
+			v.BoolValue = &b
+		case attribute.INT64:
+			i := strconv.FormatInt(a.Value.AsInt64(), 10)
+			v.IntValue = &i
+		case attribute.FLOAT64:
+			f := a.Value.AsFloat64()
+			v.DoubleValue = &f
+		default:
+			// slices go out in their JSON form rather than as arrayValue
+			s := a.Value.Emit()
+			v.StringValue = &s
+		}
+		out = append(out, keyValue{Key: string(a.Key), Value: v})
+	}
+	return out
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// snapshot encodes an ended span.
+func (s *span) snapshot() spanJSON {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := spanJSON{
+		TraceID:           s.sc.TraceID().String(),
+		SpanID:            s.sc.SpanID().String(),
+		TraceState:        s.sc.TraceState().String(),
+		Name:              s.name,
+		Kind:              int(s.kind),
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes:        keyValues(s.attrs),
+	}
+	if s.parent.IsValid() {
+		j.ParentSpanID = s.parent.String()
+	}
+	if j.Kind == 0 {
+		j.Kind = 1 // internal
+	}
+	for _, e := range s.events {
+		j.Events = append(j.Events, eventJSON{TimeUnixNano: unixNano(e.at), Name: e.name, Attributes: keyValues(e.attrs)})
+	}
+	switch s.status {
+	case codes.Ok:
+		j.Status.Code = 1
+	case codes.Error:
+		j.Status = statusJSON{Code: 2, Message: s.desc}
+	}
+	return j
+}
+
+// exporter buffers ended spans and writes them as one TracesData line per
+// flush.
+type exporter struct {
+	resource resource
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	pending map[scope][]spanJSON
+}
+
+func newExporter(f *os.File, service string) *exporter {
+	e := &exporter{
+		resource: resource{Attributes: keyValues([]attribute.KeyValue{
+			attribute.String("service.name", service),
+			attribute.Int("process.pid", os.Getpid()),
+		})},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		f:       f,
+		w:       bufio.NewWriter(f),
+		pending: map[scope][]spanJSON{},
+	}
+	go e.loop()
+	return e
+}
+
+func (e *exporter) loop() {
+	defer close(e.done)
+	t := time.NewTicker(flushEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := e.flush(); err != nil {
+				log.Printf("tracing: %v\n", err)
+			}
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *exporter) add(sc scope, s spanJSON) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.f == nil {
+		return
+	}
+	e.pending[sc] = append(e.pending[sc], s)
+}
+
+func (e *exporter) flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.f == nil || len(e.pending) == 0 {
+		return nil
+	}
+	rs := resourceSpans{Resource: e.resource}
+	for sc, spans := range e.pending {
+		rs.ScopeSpans = append(rs.ScopeSpans, scopeSpans{Scope: sc, Spans: spans})
+	}
+	e.pending = map[scope][]spanJSON{}
+	line, err := json.Marshal(tracesData{ResourceSpans: []resourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+	e.w.Write(line)
+	e.w.WriteByte('\n')
+	return e.w.Flush()
+}
+
+func (e *exporter) close() error {
+	close(e.stop)
+	<-e.done
+	err := e.flush()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	e.f = nil
+	return err
+}
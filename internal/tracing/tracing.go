@@ -0,0 +1,253 @@
+// Package tracing records OpenTelemetry spans into a local file, so a call
+// can be followed from the consumer through the wire to the provider without
+// a collector. dubbo-go's otelClientTrace and otelServerTrace filters make the
+// call spans through the otel globals, which Setup points here; the dubbo
+// codec is wrapped to add hessian encode and decode spans, and Start adds
+// spans from application code. Trace context travels in the traceparent and
+// tracestate attachments.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scopeName is the instrumentation scope of the spans this package and the
+// demo binaries make themselves.
+const scopeName = "dubbo-demo"
+
+// propagator is what carries trace context in attachments.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Provider is a trace.TracerProvider that samples root spans at a fixed
+// ratio, follows the parent's decision otherwise, and writes every sampled
+// span to an OTLP-JSON file when it ends.
+type Provider struct {
+	ratio float64
+	out   *exporter
+}
+
+// active is the provider Setup installed, nil while tracing is off.
+var (
+	activeMu sync.RWMutex
+	active   *Provider
+)
+
+// Setup starts tracing into path, appending OTLP-JSON lines, and makes the
+// Provider the otel global. service names the process in the spans' resource;
+// ratio is the share of root spans sampled, from 0 to 1.
+func Setup(path, service string, ratio float64) (*Provider, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{ratio: ratio, out: newExporter(f, service)}
+	otel.SetTextMapPropagator(propagator)
+	otel.SetTracerProvider(p)
+	activeMu.Lock()
+	active = p
+	activeMu.Unlock()
+	return p, nil
+}
+
+// current returns the active provider, or nil.
+func current() *Provider {
+	activeMu.RLock()
+	defer activeMu.RUnlock()
+	return active
+}
+
+// Tracer implements trace.TracerProvider.
+func (p *Provider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	cfg := trace.NewTracerConfig(opts...)
+	return &tracer{p: p, scope: scope{Name: name, Version: cfg.InstrumentationVersion()}}
+}
+
+// Flush writes the spans ended so far.
+func (p *Provider) Flush() error {
+	return p.out.flush()
+}
+
+// Close flushes and closes the file. Spans ending later are dropped.
+func (p *Provider) Close() error {
+	activeMu.Lock()
+	if active == p {
+		active = nil
+	}
+	activeMu.Unlock()
+	return p.out.close()
+}
+
+// Start starts a span named name under the span in ctx, for application code.
+// It returns a no-op span while tracing is off.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(scopeName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+type tracer struct {
+	p     *Provider
+	scope scope
+}
+
+func (t *tracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	var parent trace.SpanContext
+	if !cfg.NewRoot() {
+		parent = trace.SpanContextFromContext(ctx)
+	}
+	scc := trace.SpanContextConfig{SpanID: newSpanID(), TraceState: parent.TraceState()}
+	sampled := rand.Float64() < t.p.ratio
+	if parent.IsValid() {
+		scc.TraceID = parent.TraceID()
+		sampled = parent.IsSampled()
+	} else {
+		scc.TraceID = newTraceID()
+	}
+	if sampled {
+		scc.TraceFlags = trace.FlagsSampled
+	}
+	s := &span{
+		t:      t,
+		sc:     trace.NewSpanContext(scc),
+		parent: parent.SpanID(),
+		name:   name,
+		kind:   cfg.SpanKind(),
+		start:  cfg.Timestamp(),
+		attrs:  cfg.Attributes(),
+	}
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+func newTraceID() trace.TraceID {
+	var id trace.TraceID
+	binary.BigEndian.PutUint64(id[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(id[8:], rand.Uint64())
+	return id
+}
+
+func newSpanID() trace.SpanID {
+	var id trace.SpanID
+	binary.BigEndian.PutUint64(id[:], rand.Uint64())
+	return id
+}
+
+// span records itself only when sampled; an unsampled span still carries its
+// context so that the decision reaches the provider.
+type span struct {
+	t      *tracer
+	sc     trace.SpanContext
+	parent trace.SpanID
+	kind   trace.SpanKind
+
+	mu     sync.Mutex
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  []attribute.KeyValue
+	events []spanEvent
+	status codes.Code
+	desc   string
+}
+
+type spanEvent struct {
+	name  string
+	at    time.Time
+	attrs []attribute.KeyValue
+}
+
+func (s *span) End(opts ...trace.SpanEndOption) {
+	cfg := trace.NewSpanEndConfig(opts...)
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = cfg.Timestamp()
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if s.sc.IsSampled() {
+		s.t.p.out.add(s.t.scope, s.snapshot())
+	}
+}
+
+func (s *span) AddEvent(name string, opts ...trace.EventOption) {
+	if !s.IsRecording() {
+		return
+	}
+	cfg := trace.NewEventConfig(opts...)
+	at := cfg.Timestamp()
+	if at.IsZero() {
+		at = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, spanEvent{name: name, at: at, attrs: cfg.Attributes()})
+}
+
+func (s *span) IsRecording() bool {
+	if !s.sc.IsSampled() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end.IsZero()
+}
+
+func (s *span) RecordError(err error, opts ...trace.EventOption) {
+	if err == nil {
+		return
+	}
+	opts = append(opts, trace.WithAttributes(
+		attribute.String("exception.type", fmt.Sprintf("%T", err)),
+		attribute.String("exception.message", err.Error()),
+	))
+	s.AddEvent("exception", opts...)
+}
+
+func (s *span) SpanContext() trace.SpanContext { return s.sc }
+
+func (s *span) SetStatus(code codes.Code, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Ok is final, and an error only keeps its description
+	if s.status == codes.Ok || code < s.status {
+		return
+	}
+	s.status = code
+	if code == codes.Error {
+		s.desc = description
+	}
+}
+
+func (s *span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *span) SetAttributes(kv ...attribute.KeyValue) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, kv...)
+}
+
+func (s *span) TracerProvider() trace.TracerProvider { return s.t.p }